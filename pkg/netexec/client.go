@@ -0,0 +1,513 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client calls the HTTP endpoints of a netexec server.
+type Client struct {
+	// BaseURL is the server's URL, e.g. "http://10.0.0.1:8080".
+	BaseURL string
+	// HTTPClient sends the requests, http.DefaultClient if nil.
+	HTTPClient *http.Client
+}
+
+// NewClient returns a Client for the netexec server at baseURL.
+func NewClient(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// DialRequest are the parameters of /dial.
+type DialRequest struct {
+	Host string
+	Port int
+	// Request is the path for HTTP, or the command for the other protocols,
+	// e.g. "hostname", "clientip" or "echo <msg>".
+	Request  string
+	Protocol string
+	Tries    int
+	// GroupBy, "response" or a dotted JSON field, identifies the backend of
+	// each response to analyze their distribution, which the Expect fields
+	// check.
+	GroupBy        string
+	ExpectBackends int
+	ExpectAffinity bool
+	ExpectUniform  bool
+	// SocketOptions are applied to the socket of every try.
+	SocketOptions *SocketOptions
+	// ConnectTimeout and ReadTimeout bound every try, 5s if zero, and
+	// Timeout the whole dial.
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	Timeout        time.Duration
+	// Retries is the number of times a try failing with an error of the
+	// RetryOn classes, any if empty, is retried, after a Backoff doubling at
+	// every retry and randomized by ±Jitter of it.
+	Retries int
+	Backoff time.Duration
+	Jitter  float64
+	RetryOn []string
+}
+
+func (r DialRequest) values() url.Values {
+	values := url.Values{}
+	values.Set("host", r.Host)
+	values.Set("port", strconv.Itoa(r.Port))
+	values.Set("request", r.Request)
+	if r.Protocol != "" {
+		values.Set("protocol", r.Protocol)
+	}
+	if r.Tries > 0 {
+		values.Set("tries", strconv.Itoa(r.Tries))
+	}
+	if r.GroupBy != "" {
+		values.Set("groupBy", r.GroupBy)
+	}
+	if r.ExpectBackends > 0 {
+		values.Set("expectBackends", strconv.Itoa(r.ExpectBackends))
+	}
+	if r.ExpectAffinity {
+		values.Set("expectAffinity", "true")
+	}
+	if r.ExpectUniform {
+		values.Set("expectUniform", "true")
+	}
+	if o := r.SocketOptions; o != nil {
+		for name, value := range map[string]*int{
+			"tos":               o.TOS,
+			"ttl":               o.TTL,
+			"keepaliveIdle":     o.KeepAliveIdle,
+			"keepaliveInterval": o.KeepAliveInterval,
+			"keepaliveCount":    o.KeepAliveCount,
+			"linger":            o.Linger,
+			"mss":               o.MSS,
+			"sndbuf":            o.SendBuffer,
+			"rcvbuf":            o.ReceiveBuffer,
+		} {
+			if value != nil {
+				values.Set(name, strconv.Itoa(*value))
+			}
+		}
+		if o.NoDelay != nil {
+			values.Set("nodelay", strconv.FormatBool(*o.NoDelay))
+		}
+		if o.KeepAlive != nil {
+			values.Set("keepalive", strconv.FormatBool(*o.KeepAlive))
+		}
+	}
+	for name, value := range map[string]time.Duration{
+		"connectTimeout": r.ConnectTimeout,
+		"readTimeout":    r.ReadTimeout,
+		"timeout":        r.Timeout,
+		"backoff":        r.Backoff,
+	} {
+		if value > 0 {
+			values.Set(name, value.String())
+		}
+	}
+	if r.Retries > 0 {
+		values.Set("retries", strconv.Itoa(r.Retries))
+	}
+	if r.Jitter > 0 {
+		values.Set("jitter", strconv.FormatFloat(r.Jitter, 'g', -1, 64))
+	}
+	if len(r.RetryOn) > 0 {
+		values.Set("retryOn", strings.Join(r.RetryOn, ","))
+	}
+	return values
+}
+
+// Hostname returns the host name of the server.
+func (c *Client) Hostname(ctx context.Context) (string, error) {
+	return c.getString(ctx, "/hostname", nil)
+}
+
+// ClientIP returns the client address seen by the server.
+func (c *Client) ClientIP(ctx context.Context) (string, error) {
+	return c.getString(ctx, "/clientip", nil)
+}
+
+// ClientIPReport returns the forwarding chain seen by the server. If expected
+// is not empty, the report's verdict tells whether this client IP survived.
+func (c *Client) ClientIPReport(ctx context.Context, expected string) (*ClientIPReport, error) {
+	values := url.Values{"format": {"json"}}
+	if expected != "" {
+		values.Set("expected", expected)
+	}
+	report := &ClientIPReport{}
+	if err := c.getJSON(ctx, "/clientip", values, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// ClientInfo returns the TTL and TOS of this client's packets, as the server
+// received them.
+func (c *Client) ClientInfo(ctx context.Context) (*ClientInfo, error) {
+	info := &ClientInfo{}
+	if err := c.getJSON(ctx, "/clientinfo", nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Echo returns msg, as echoed by the server.
+func (c *Client) Echo(ctx context.Context, msg string) (string, error) {
+	return c.getString(ctx, "/echo", url.Values{"msg": {msg}})
+}
+
+// Header returns the request headers received by the server.
+func (c *Client) Header(ctx context.Context) (http.Header, error) {
+	header := http.Header{}
+	if err := c.getJSON(ctx, "/header", nil, &header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// Healthz returns an error unless the server is ready.
+func (c *Client) Healthz(ctx context.Context) error {
+	_, err := c.getString(ctx, "/healthz", nil)
+	return err
+}
+
+// LimitsUsage returns the current usage of the server's limits, which must
+// be configured.
+func (c *Client) LimitsUsage(ctx context.Context) (*LimitsUsage, error) {
+	usage := &LimitsUsage{}
+	if err := c.getJSON(ctx, "/healthz", nil, usage); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// Dial makes the server send requests to another server.
+func (c *Client) Dial(ctx context.Context, req DialRequest) (*DialResult, error) {
+	result := &DialResult{}
+	if err := c.getJSON(ctx, "/dial", req.values(), result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DialMTU makes the server probe the path MTU towards another server, with
+// the "udp", "tcp" or "http" protocol.
+func (c *Client) DialMTU(ctx context.Context, host string, port int, protocol string, maxMTU int) ([]MTUResult, error) {
+	values := DialRequest{Host: host, Port: port, Protocol: protocol}.values()
+	values.Del("request")
+	values.Set("mode", "mtu")
+	if maxMTU > 0 {
+		values.Set("maxMTU", strconv.Itoa(maxMTU))
+	}
+	result := struct {
+		Results []MTUResult `json:"results"`
+	}{}
+	if err := c.getJSON(ctx, "/dial", values, &result); err != nil {
+		return nil, err
+	}
+	return result.Results, nil
+}
+
+// DialThroughput makes the server measure its throughput towards another
+// server, over streams parallel connections for duration. direction is
+// "upload" or "download".
+func (c *Client) DialThroughput(ctx context.Context, host string, port int, direction string, streams int, duration time.Duration) (*ThroughputResult, error) {
+	values := DialRequest{Host: host, Port: port}.values()
+	values.Del("request")
+	values.Set("mode", "throughput")
+	values.Set("duration", duration.String())
+	if direction != "" {
+		values.Set("direction", direction)
+	}
+	if streams > 0 {
+		values.Set("streams", strconv.Itoa(streams))
+	}
+	result := &ThroughputResult{}
+	if err := c.getJSON(ctx, "/dial", values, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DialIdle makes the server check, over "tcp" or "udp", after which idle
+// duration its sessions to another server stop working. It returns once the
+// longest of intervals is over.
+func (c *Client) DialIdle(ctx context.Context, host string, port int, protocol string, intervals []time.Duration) (*IdleResult, error) {
+	values := DialRequest{Host: host, Port: port, Protocol: protocol}.values()
+	values.Del("request")
+	values.Set("mode", "idle")
+	if len(intervals) > 0 {
+		items := make([]string, 0, len(intervals))
+		for _, interval := range intervals {
+			items = append(items, interval.String())
+		}
+		values.Set("intervals", strings.Join(items, ","))
+	}
+	result := &IdleResult{}
+	if err := c.getJSON(ctx, "/dial", values, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DialClock makes the server estimate the offset of the clock of another
+// server from its own, over "udp", "tcp" or "http" timestamp exchanges.
+func (c *Client) DialClock(ctx context.Context, host string, port int, protocol string, rounds int) (*ClockResult, error) {
+	values := DialRequest{Host: host, Port: port, Protocol: protocol}.values()
+	values.Del("request")
+	values.Set("mode", "clock")
+	if rounds > 0 {
+		values.Set("rounds", strconv.Itoa(rounds))
+	}
+	result := &ClockResult{}
+	if err := c.getJSON(ctx, "/dial", values, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DNS makes the server resolve name, of type "A" or "AAAA", and explain how
+// its resolver got the answers. timeout bounds each query, the resolv.conf
+// timeout applies if it is 0.
+func (c *Client) DNS(ctx context.Context, name, qtype string, timeout time.Duration) (*DNSResult, error) {
+	values := url.Values{"name": {name}}
+	if qtype != "" {
+		values.Set("type", qtype)
+	}
+	if timeout > 0 {
+		values.Set("timeout", timeout.String())
+	}
+	result := &DNSResult{}
+	if err := c.getJSON(ctx, "/dns", values, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Shell runs cmd on the server and returns its combined output. The error
+// includes the output if the command failed.
+func (c *Client) Shell(ctx context.Context, cmd string) (string, error) {
+	result := map[string]string{}
+	if err := c.getJSON(ctx, "/shell", url.Values{"cmd": {cmd}}, &result); err != nil {
+		return "", err
+	}
+	if result["error"] != "" {
+		return result["output"], fmt.Errorf("command %q failed: %s: %s", cmd, result["error"], result["output"])
+	}
+	return result["output"], nil
+}
+
+// Faults returns the active fault rules.
+func (c *Client) Faults(ctx context.Context) ([]FaultRule, error) {
+	var rules []FaultRule
+	if err := c.getJSON(ctx, "/fault", nil, &rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// AddFault adds a fault rule and returns it as stored by the server, with
+// its ID and expiry.
+func (c *Client) AddFault(ctx context.Context, rule FaultRule) (*FaultRule, error) {
+	body, err := json.Marshal(rule)
+	if err != nil {
+		return nil, err
+	}
+	added := &FaultRule{}
+	if err := c.do(ctx, http.MethodPost, "/fault", nil, bytes.NewReader(body), added); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// ClearFaults removes the fault rule with the given id, or every rule if id
+// is 0, and returns the number of removed rules.
+func (c *Client) ClearFaults(ctx context.Context, id int) (int, error) {
+	var values url.Values
+	if id != 0 {
+		values = url.Values{"id": {strconv.Itoa(id)}}
+	}
+	result := map[string]int{}
+	if err := c.do(ctx, http.MethodDelete, "/fault", values, nil, &result); err != nil {
+		return 0, err
+	}
+	return result["removed"], nil
+}
+
+// SubmitJob starts a job on the server and returns it, with its ID.
+func (c *Client) SubmitJob(ctx context.Context, spec JobSpec) (*Job, error) {
+	body, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := c.do(ctx, http.MethodPost, "/jobs", nil, bytes.NewReader(body), job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Jobs returns the running jobs and the finished ones still kept, without
+// their results.
+func (c *Client) Jobs(ctx context.Context) ([]Job, error) {
+	var jobs []Job
+	if err := c.getJSON(ctx, "/jobs", nil, &jobs); err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Job returns the job with the given id and its results after the since
+// sequence number, so that polling with the last Seq seen gets the new ones.
+func (c *Client) Job(ctx context.Context, id, since int) (*Job, error) {
+	job := &Job{}
+	values := url.Values{"since": {strconv.Itoa(since)}}
+	if err := c.getJSON(ctx, "/jobs/"+strconv.Itoa(id), values, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// FollowJob calls fn with each result of the job with the given id after
+// the since sequence number, as they come, until the job finishes, ctx is
+// done or fn returns an error.
+func (c *Client) FollowJob(ctx context.Context, id, since int, fn func(JobResult) error) error {
+	path := "/jobs/" + strconv.Itoa(id)
+	values := url.Values{"since": {strconv.Itoa(since)}, "follow": {"true"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+path+"?"+values.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s returned %s: %s", path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var result JobResult
+		if err := decoder.Decode(&result); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to decode the results of GET %s: %v", path, err)
+		}
+		if err := fn(result); err != nil {
+			return err
+		}
+	}
+}
+
+// CancelJob cancels the job with the given id and returns it once stopped.
+func (c *Client) CancelJob(ctx context.Context, id int) (*Job, error) {
+	job := &Job{}
+	if err := c.do(ctx, http.MethodDelete, "/jobs/"+strconv.Itoa(id), nil, nil, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Config returns the effective configuration of the server, secrets
+// redacted.
+func (c *Client) Config(ctx context.Context) (*Config, error) {
+	cfg := &Config{}
+	if err := c.getJSON(ctx, "/config", nil, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Metrics returns the server's metrics in the Prometheus text format.
+func (c *Client) Metrics(ctx context.Context) (string, error) {
+	return c.getString(ctx, "/metrics", nil)
+}
+
+// SysInfo returns the interfaces, routes, sockets and other network settings
+// of the server's network namespace.
+func (c *Client) SysInfo(ctx context.Context) (*SysInfo, error) {
+	info := &SysInfo{}
+	if err := c.getJSON(ctx, "/sysinfo", nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Exit makes the server exit with code after wait, allowing timeout for the
+// connections to close.
+func (c *Client) Exit(ctx context.Context, code int, wait, timeout time.Duration) error {
+	values := url.Values{"code": {strconv.Itoa(code)}, "wait": {wait.String()}, "timeout": {timeout.String()}}
+	_, err := c.getString(ctx, "/exit", values)
+	return err
+}
+
+func (c *Client) getString(ctx context.Context, path string, values url.Values) (string, error) {
+	var body []byte
+	if err := c.do(ctx, http.MethodGet, path, values, nil, &body); err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, values url.Values, v interface{}) error {
+	return c.do(ctx, http.MethodGet, path, values, nil, v)
+}
+
+// do sends a request and decodes the JSON response into v, or stores the raw
+// body if v is a *[]byte. Responses other than 2xx are returned as errors.
+func (c *Client) do(ctx context.Context, method, path string, values url.Values, body io.Reader, v interface{}) error {
+	u := c.BaseURL + path
+	if len(values) > 0 {
+		u += "?" + values.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read the response of %s %s: %v", method, path, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if raw, ok := v.(*[]byte); ok {
+		*raw = data
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to decode the response of %s %s: %v", method, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ClientInfo is the answer of /clientinfo and of the "clientinfo" command,
+// describing the IP header of what the client sent as it arrived.
+type ClientInfo struct {
+	Client   string `json:"client"`
+	Protocol string `json:"protocol"`
+	// TTL is the IPv4 TTL or IPv6 hop limit of the received packets.
+	TTL *int `json:"ttl,omitempty"`
+	// InitialTTL is the TTL the client most likely sent, the next of 64,
+	// 128 and 255, and Hops the number of routers that decremented it.
+	InitialTTL *int `json:"initialTTL,omitempty"`
+	Hops       *int `json:"hops,omitempty"`
+	// TOS is the IPv4 TOS or IPv6 traffic class of the received packets,
+	// made of the DSCP and ECN bits.
+	TOS  *int `json:"tos,omitempty"`
+	DSCP *int `json:"dscp,omitempty"`
+	ECN  *int `json:"ecn,omitempty"`
+	// TCPInfo are the server's TCP_INFO statistics of the connection.
+	TCPInfo *TCPStats `json:"tcpInfo,omitempty"`
+}
+
+// receivedHeader holds the IP header fields the kernel reported for the
+// packets of a client, -1 when it did not.
+type receivedHeader struct {
+	ttl, tos int
+}
+
+var unknownHeader = receivedHeader{ttl: -1, tos: -1}
+
+func newClientInfo(protocol, client string, header receivedHeader) *ClientInfo {
+	info := &ClientInfo{Client: client, Protocol: protocol}
+	if header.ttl >= 0 {
+		ttl := header.ttl
+		info.TTL = &ttl
+		for _, initial := range []int{64, 128, 255} {
+			if ttl <= initial {
+				hops := initial - ttl
+				info.InitialTTL, info.Hops = &initial, &hops
+				break
+			}
+		}
+	}
+	if header.tos >= 0 {
+		tos, dscp, ecn := header.tos, header.tos>>2, header.tos&3
+		info.TOS, info.DSCP, info.ECN = &tos, &dscp, &ecn
+	}
+	return info
+}
+
+func (s *Server) clientInfoHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET /clientinfo")
+	writeJSON(w, http.StatusOK, newTCPClientInfo("http", r.RemoteAddr, requestConn(r)))
+}
+
+// newTCPClientInfo describes the client of conn, a TCP connection.
+func newTCPClientInfo(protocol, client string, conn net.Conn) *ClientInfo {
+	tcpConn, ok := underlyingTCPConn(conn)
+	if !ok {
+		return newClientInfo(protocol, client, unknownHeader)
+	}
+	info := newClientInfo(protocol, client, tcpReceivedHeader(tcpConn))
+	info.TCPInfo = connTCPStats(tcpConn)
+	return info
+}
+
+// receiveHeaders asks the kernel to report the TTL and TOS of the packets
+// received on conn, an IPv4 or IPv6 UDP socket or TCP listener. IPv6
+// sockets also ask for them for IPv4-mapped clients.
+func receiveHeaders(conn syscall.Conn) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		log.Printf("Failed to get the socket of %v: %v", conn, err)
+		return
+	}
+	if err := controlSocket(raw, func(fd int) error {
+		ipv6, _ := socketKind(fd)
+		ipv4Err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVTTL, 1)
+		if ipv4Err == nil {
+			ipv4Err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+		}
+		if !ipv6 {
+			return ipv4Err
+		}
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVHOPLIMIT, 1); err != nil {
+			return err
+		}
+		return unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1)
+	}); err != nil {
+		log.Printf("Failed to report the TTL and TOS of received packets: %v", err)
+	}
+}
+
+// parseReceivedHeader reads the TTL and TOS out of the control messages
+// received along with a packet, or returned by IP_PKTOPTIONS.
+func parseReceivedHeader(oob []byte) receivedHeader {
+	header := unknownHeader
+	messages, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return header
+	}
+	for _, m := range messages {
+		var value int
+		switch len(m.Data) {
+		case 1:
+			// IP_TOS is a single byte for UDP.
+			value = int(m.Data[0])
+		case 4:
+			value = int(int32(nativeEndian.Uint32(m.Data)))
+		default:
+			continue
+		}
+		switch {
+		case m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TTL,
+			m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_HOPLIMIT:
+			header.ttl = value
+		case m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_TOS,
+			m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_TCLASS:
+			header.tos = value
+		}
+	}
+	return header
+}
+
+// tcpReceivedHeader returns the IP header fields the kernel keeps for conn:
+// the hop limit and traffic class of the last in-order segment over IPv6,
+// only the TOS of the SYN over IPv4, whose TTL Linux does not keep.
+func tcpReceivedHeader(conn *net.TCPConn) receivedHeader {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return unknownHeader
+	}
+	ipv4 := false
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ipv4 = addr.IP.To4() != nil
+	}
+	header := unknownHeader
+	_ = controlSocket(raw, func(fd int) error {
+		level, opt := unix.IPPROTO_IPV6, unix.IPV6_2292PKTOPTIONS
+		if ipv4 {
+			level, opt = unix.IPPROTO_IP, unix.IP_PKTOPTIONS
+		}
+		// GetsockoptString would stop at the first zero byte.
+		buf := make([]byte, 256)
+		size := uint32(len(buf))
+		if _, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), uintptr(level), uintptr(opt),
+			uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+			return errno
+		}
+		header = parseReceivedHeader(buf[:size])
+		if ipv4 {
+			// IP_PKTOPTIONS reports the multicast TTL, not a received one.
+			header.ttl = -1
+		}
+		return nil
+	})
+	return header
+}
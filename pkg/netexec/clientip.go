@@ -0,0 +1,166 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	netutils "k8s.io/utils/net"
+)
+
+func clientIPHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET /clientip")
+	printRequest(r)
+	if r.FormValue("format") == "json" {
+		report, err := newClientIPReport(r, r.FormValue("expected"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+	fmt.Fprintf(w, r.RemoteAddr)
+	pc, ok := underlyingProxyConn(requestConn(r))
+	if !ok || pc.proxyHeader() == nil {
+		return
+	}
+	// The connection carried a PROXY header: r.RemoteAddr is the proxied
+	// client, also report who actually connected and what the proxy said.
+	header := pc.proxyHeader()
+	fmt.Fprintf(w, "\npeer: %s", pc.Conn.RemoteAddr())
+	fmt.Fprintf(w, "\nproxy: v%d %s %s -> %s", header.Version, header.Command, header.Source, header.Destination)
+	for _, tlv := range header.TLVs {
+		fmt.Fprintf(w, "\ntlv 0x%02x %s: %s", tlv.Type, tlv.Name, tlv.Value)
+	}
+}
+
+// ClientIPReport is the JSON answer of /clientip, describing every hop the
+// request claims to have gone through.
+type ClientIPReport struct {
+	Peer          string             `json:"peer"`
+	LocalAddr     string             `json:"localAddr,omitempty"`
+	ProxyProtocol *ProxyHeader       `json:"proxyProtocol,omitempty"`
+	XForwardedFor []string           `json:"xForwardedFor,omitempty"`
+	Forwarded     []ForwardedElement `json:"forwarded,omitempty"`
+	XRealIP       string             `json:"xRealIP,omitempty"`
+	// Chain lists the client addresses from the original client to the
+	// socket peer.
+	Chain          []string `json:"chain"`
+	OriginalClient string   `json:"originalClient"`
+	Expected       string   `json:"expected,omitempty"`
+	// Verdict is "preserved" if the peer is the expected client,
+	// "proxy-protocol" or "headers" if only the PROXY header or the
+	// forwarding headers carry it, and "lost" otherwise.
+	Verdict string `json:"verdict,omitempty"`
+}
+
+// ForwardedElement is one element of a RFC 7239 Forwarded header.
+type ForwardedElement struct {
+	For   string `json:"for,omitempty"`
+	By    string `json:"by,omitempty"`
+	Host  string `json:"host,omitempty"`
+	Proto string `json:"proto,omitempty"`
+}
+
+func newClientIPReport(r *http.Request, expected string) (*ClientIPReport, error) {
+	var expectedIP net.IP
+	if expected != "" {
+		if expectedIP = netutils.ParseIPSloppy(expected); expectedIP == nil {
+			return nil, fmt.Errorf("argument 'expected' must be an IP address, got %q", expected)
+		}
+	}
+	report := &ClientIPReport{Peer: r.RemoteAddr, Expected: expected}
+	if localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		report.LocalAddr = localAddr.String()
+	}
+	if pc, ok := underlyingProxyConn(requestConn(r)); ok && pc.proxyHeader() != nil {
+		report.Peer = pc.Conn.RemoteAddr().String()
+		report.ProxyProtocol = pc.proxyHeader()
+	}
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				report.XForwardedFor = append(report.XForwardedFor, hop)
+			}
+		}
+	}
+	for _, value := range r.Header.Values("Forwarded") {
+		report.Forwarded = append(report.Forwarded, parseForwarded(value)...)
+	}
+	report.XRealIP = strings.TrimSpace(r.Header.Get("X-Real-IP"))
+
+	// Forwarded supersedes X-Forwarded-For, which supersedes X-Real-IP.
+	switch {
+	case len(report.Forwarded) > 0:
+		for _, element := range report.Forwarded {
+			if element.For != "" {
+				report.Chain = append(report.Chain, element.For)
+			}
+		}
+	case len(report.XForwardedFor) > 0:
+		report.Chain = append(report.Chain, report.XForwardedFor...)
+	case report.XRealIP != "":
+		report.Chain = append(report.Chain, report.XRealIP)
+	}
+	if report.ProxyProtocol != nil && report.ProxyProtocol.Source != "" {
+		report.Chain = append(report.Chain, report.ProxyProtocol.Source)
+	}
+	report.Chain = append(report.Chain, report.Peer)
+	report.OriginalClient = report.Chain[0]
+
+	if expectedIP != nil {
+		report.Verdict = "lost"
+		switch {
+		case expectedIP.Equal(remoteIP(report.Peer)):
+			report.Verdict = "preserved"
+		case report.ProxyProtocol != nil && expectedIP.Equal(remoteIP(report.ProxyProtocol.Source)):
+			report.Verdict = "proxy-protocol"
+		default:
+			claimed := append(append([]string{report.XRealIP}, report.XForwardedFor...), report.Chain...)
+			for _, hop := range claimed {
+				if expectedIP.Equal(remoteIP(hop)) {
+					report.Verdict = "headers"
+				}
+			}
+		}
+	}
+	return report, nil
+}
+
+// parseForwarded parses a RFC 7239 Forwarded header value.
+func parseForwarded(value string) []ForwardedElement {
+	var elements []ForwardedElement
+	for _, part := range strings.Split(value, ",") {
+		var element ForwardedElement
+		for _, pair := range strings.Split(part, ";") {
+			key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok {
+				continue
+			}
+			if unquoted, err := strconv.Unquote(val); err == nil {
+				val = unquoted
+			}
+			switch strings.ToLower(key) {
+			case "for":
+				element.For = val
+			case "by":
+				element.By = val
+			case "host":
+				element.Host = val
+			case "proto":
+				element.Proto = val
+			}
+		}
+		if element != (ForwardedElement{}) {
+			elements = append(elements, element)
+		}
+	}
+	return elements
+}
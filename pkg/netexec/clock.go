@@ -0,0 +1,202 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxClockRounds = 100
+
+// TimestampResult is the JSON answer of /timestamp: the times, in nanoseconds
+// since the epoch, at which the server received the request and sent the
+// answer.
+type TimestampResult struct {
+	Receive  int64 `json:"receive"`
+	Transmit int64 `json:"transmit"`
+}
+
+// ClockResult is the JSON answer of /dial?mode=clock.
+type ClockResult struct {
+	Address  string       `json:"address"`
+	Protocol string       `json:"protocol"`
+	Rounds   []ClockRound `json:"rounds"`
+	// Offset is how far the clock of the peer is ahead of the local one, as
+	// measured by the round with the lowest delay, which the asymmetry of
+	// the path skews the least. Delay is the round trip time of that round,
+	// and bounds the error of the offset to half of it. Offset and Delay are
+	// empty if every round failed.
+	Offset      string `json:"offset,omitempty"`
+	OffsetNanos int64  `json:"offsetNanos"`
+	Delay       string `json:"delay,omitempty"`
+	DelayNanos  int64  `json:"delayNanos"`
+}
+
+// ClockRound is one timestamp exchange with the peer.
+type ClockRound struct {
+	OffsetNanos int64  `json:"offsetNanos"`
+	DelayNanos  int64  `json:"delayNanos"`
+	Error       string `json:"error,omitempty"`
+}
+
+// timestampResponse answers the timestamp command with the receive and
+// transmit timestamps, in nanoseconds since the epoch.
+func timestampResponse(received time.Time) string {
+	return fmt.Sprintf("%d %d", received.UnixNano(), time.Now().UnixNano())
+}
+
+// timestampHandler returns the times at which the request was received and
+// answered, for clients to estimate their clock offset with the server.
+func timestampHandler(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
+	log.Printf("GET /timestamp")
+	writeJSON(w, http.StatusOK, TimestampResult{Receive: received.UnixNano(), Transmit: time.Now().UnixNano()})
+}
+
+// clockDialHandler serves /dial?mode=clock: it exchanges timestamps with the
+// netexec server at host and port over "rounds" rounds, NTP style, and
+// estimates the offset of the peer's clock. It gives up once the request is
+// cancelled.
+func clockDialHandler(w http.ResponseWriter, r *http.Request, host, port, protocol string) {
+	var err error
+	rounds := 8
+	if roundsParam := r.FormValue("rounds"); roundsParam != "" {
+		if rounds, err = strconv.Atoi(roundsParam); err != nil || rounds < 1 || rounds > maxClockRounds {
+			http.Error(w, fmt.Sprintf("rounds parameter must be an integer between 1 and %d, got %q", maxClockRounds, roundsParam), http.StatusBadRequest)
+			return
+		}
+	}
+	interval := 100 * time.Millisecond
+	if intervalParam := r.FormValue("interval"); intervalParam != "" {
+		if interval, err = time.ParseDuration(intervalParam); err != nil || interval < 0 || interval > 10*time.Second {
+			http.Error(w, fmt.Sprintf("interval parameter must be a golang duration up to 10s, got %q", intervalParam), http.StatusBadRequest)
+			return
+		}
+	}
+	protocol = strings.ToLower(protocol)
+	address := net.JoinHostPort(host, port)
+	var exchange func() (TimestampResult, error)
+	var closer func()
+	switch protocol {
+	case "":
+		protocol = "udp"
+		fallthrough
+	case "udp", "tcp":
+		conn, err := (&net.Dialer{Timeout: 5 * time.Second}).DialContext(r.Context(), protocol, address)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("%s dial failed. err:%v", protocol, err), http.StatusBadGateway)
+			return
+		}
+		exchange, closer = commandTimestampExchange(conn, protocol), func() { conn.Close() }
+	case "http":
+		transport := &http.Transport{DialContext: (&net.Dialer{Timeout: 5 * time.Second}).DialContext}
+		exchange, closer = httpTimestampExchange(r.Context(), transport, address), transport.CloseIdleConnections
+	default:
+		http.Error(w, fmt.Sprintf("unsupported protocol for mode clock. %s", protocol), http.StatusBadRequest)
+		return
+	}
+	defer closer()
+	log.Printf("Estimating the clock offset of %s over %d %s rounds", address, rounds, protocol)
+
+	result := ClockResult{Address: address, Protocol: protocol, Rounds: make([]ClockRound, rounds)}
+	best := -1
+	for i := range result.Rounds {
+		if i > 0 && !sleepContext(r.Context(), interval) {
+			log.Printf("Stopped estimating the clock offset of %s after %d rounds: %v", address, i, r.Context().Err())
+			return
+		}
+		round := &result.Rounds[i]
+		sent := time.Now()
+		peer, err := exchange()
+		received := time.Now()
+		if err != nil {
+			round.Error = err.Error()
+			continue
+		}
+		// t1 and t4 are local, t2 and t3 are the peer's.
+		t1, t2, t3, t4 := sent.UnixNano(), peer.Receive, peer.Transmit, received.UnixNano()
+		round.OffsetNanos = ((t2 - t1) + (t3 - t4)) / 2
+		round.DelayNanos = (t4 - t1) - (t3 - t2)
+		if best < 0 || round.DelayNanos < result.Rounds[best].DelayNanos {
+			best = i
+		}
+	}
+	if best >= 0 {
+		result.OffsetNanos = result.Rounds[best].OffsetNanos
+		result.DelayNanos = result.Rounds[best].DelayNanos
+		result.Offset = time.Duration(result.OffsetNanos).String()
+		result.Delay = time.Duration(result.DelayNanos).String()
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// commandTimestampExchange sends the timestamp command over conn, which
+// stays open across rounds.
+func commandTimestampExchange(conn net.Conn, protocol string) func() (TimestampResult, error) {
+	reader := bufio.NewReader(conn)
+	buf := make([]byte, 1024)
+	return func() (TimestampResult, error) {
+		var result TimestampResult
+		request := "timestamp"
+		if protocol == "tcp" {
+			request += "\n"
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(request)); err != nil {
+			return result, fmt.Errorf("%s connection write failed. err:%v", protocol, err)
+		}
+		var reply string
+		if protocol == "tcp" {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return result, fmt.Errorf("reading from tcp connection failed. err:%v", err)
+			}
+			reply = line
+		} else {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return result, fmt.Errorf("reading from udp connection failed. err:%v", err)
+			}
+			reply = string(buf[:n])
+		}
+		if _, err := fmt.Sscanf(strings.TrimSpace(reply), "%d %d", &result.Receive, &result.Transmit); err != nil {
+			return result, fmt.Errorf("unexpected reply %q", reply)
+		}
+		return result, nil
+	}
+}
+
+// httpTimestampExchange gets /timestamp, over a connection kept alive across
+// rounds.
+func httpTimestampExchange(ctx context.Context, transport *http.Transport, address string) func() (TimestampResult, error) {
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	return func() (TimestampResult, error) {
+		var result TimestampResult
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+address+"/timestamp", nil)
+		if err != nil {
+			return result, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return result, fmt.Errorf("request failed. err:%v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return result, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return result, fmt.Errorf("failed to decode the response. err:%v", err)
+		}
+		return result, nil
+	}
+}
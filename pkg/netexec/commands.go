@@ -0,0 +1,271 @@
+// Copyright Authors of Kubernetes.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+Copyright 2014 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package netexec
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ishidawataru/sctp"
+)
+
+// serveUDP answers the hostName, echo and clientIP commands on conn until it
+// is closed.
+func (s *Server) serveUDP(serverConn *net.UDPConn) {
+	defer serverConn.Close()
+	// Large enough for any UDP payload, so that "echo" can answer path MTU
+	// probes.
+	buf := make([]byte, 65535)
+	oob := make([]byte, 128)
+
+	log.Printf("Started UDP server on %s", serverConn.LocalAddr())
+	// Start responding to readiness probes.
+	s.ready.set(true)
+	defer func() {
+		log.Printf("UDP server exited")
+		s.ready.set(false)
+	}()
+	for {
+		n, oobn, _, clientAddress, err := serverConn.ReadMsgUDP(buf, oob)
+		if err != nil {
+			s.serveFailed("UDP", err)
+			return
+		}
+		if !s.allowCommand("udp", clientAddress.IP) {
+			continue
+		}
+		receivedText := strings.ToLower(strings.TrimSpace(string(buf[0:n])))
+		header := parseReceivedHeader(oob[:oobn])
+		action, faulted := s.faults.decide("udp", "", clientAddress.IP, nil)
+		if faulted && action.drop {
+			log.Printf("Fault rule %d: dropping UDP reply to %s", action.rule, clientAddress)
+			s.faultsInjected.inc(strconv.Itoa(action.rule), "udp", "drop")
+			continue
+		}
+		if faulted && action.delay > 0 {
+			// Delay in the background so that one slow reply does not hold
+			// up every other UDP client.
+			log.Printf("Fault rule %d: delaying UDP reply to %s by %v", action.rule, clientAddress, action.delay)
+			s.faultsInjected.inc(strconv.Itoa(action.rule), "udp", "latency")
+			go func() {
+				time.Sleep(action.delay)
+				s.handleUDPCommand(serverConn, receivedText, clientAddress, header)
+			}()
+			continue
+		}
+		s.handleUDPCommand(serverConn, receivedText, clientAddress, header)
+	}
+}
+
+// handleUDPCommand answers a single UDP command.
+func (s *Server) handleUDPCommand(serverConn *net.UDPConn, receivedText string, clientAddress *net.UDPAddr, header receivedHeader) {
+	resp, ok := s.commandResponse("UDP", receivedText, clientAddress.String(), func() *ClientInfo {
+		return newClientInfo("udp", clientAddress.String(), header)
+	})
+	if !ok {
+		return
+	}
+	if _, err := serverConn.WriteToUDP([]byte(resp), clientAddress); err != nil {
+		log.Printf("Failed to write to UDP client %s: %v", clientAddress, err)
+	}
+}
+
+// serveSCTP answers the hostName, echo and clientIP commands, one per
+// association, until listener is closed.
+func (s *Server) serveSCTP(listener *sctp.SCTPListener) {
+	defer listener.Close()
+	buf := make([]byte, 1024)
+
+	log.Printf("Started SCTP server on %s", listener.Addr())
+	// Start responding to readiness probes.
+	s.ready.set(true)
+	defer func() {
+		log.Printf("SCTP server exited")
+		s.ready.set(false)
+	}()
+	for {
+		conn, err := listener.AcceptSCTP()
+		if err != nil {
+			s.serveFailed("SCTP", err)
+			return
+		}
+		clientAddress := conn.RemoteAddr().String()
+		n, err := conn.Read(buf)
+		if err != nil {
+			log.Printf("Failed to read from SCTP client %s: %v", clientAddress, err)
+			conn.Close()
+			continue
+		}
+		receivedText := strings.ToLower(strings.TrimSpace(string(buf[0:n])))
+		if action, faulted := s.faults.decide("sctp", "", remoteIP(clientAddress), nil); faulted {
+			if action.delay > 0 {
+				log.Printf("Fault rule %d: delaying SCTP reply to %s by %v", action.rule, clientAddress, action.delay)
+				s.faultsInjected.inc(strconv.Itoa(action.rule), "sctp", "latency")
+				time.Sleep(action.delay)
+			}
+			if action.close {
+				log.Printf("Fault rule %d: closing SCTP connection from %s without reply", action.rule, clientAddress)
+				s.faultsInjected.inc(strconv.Itoa(action.rule), "sctp", "close")
+				conn.Close()
+				continue
+			}
+		}
+		if resp, ok := s.commandResponse("SCTP", receivedText, clientAddress, nil); ok {
+			if _, err := conn.Write([]byte(resp)); err != nil {
+				log.Printf("Failed to write to SCTP client %s: %v", clientAddress, err)
+			}
+		}
+		conn.Close()
+	}
+}
+
+// serveTCP answers the hostName, echo and clientIP commands, one per line,
+// each optionally prefixed by "misbehave <mode>".
+func (s *Server) serveTCP(ln *misbehavingListener) {
+	defer ln.Close()
+
+	log.Printf("Started TCP server on %s", ln.Addr())
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.serveFailed("TCP", err)
+			return
+		}
+		go s.handleTCPConnection(ln, conn)
+	}
+}
+
+func (s *Server) handleTCPConnection(ln *misbehavingListener, conn net.Conn) {
+	defer conn.Close()
+	if !s.conns.add(conn) {
+		return
+	}
+	defer s.conns.remove(conn)
+	clientAddress := conn.RemoteAddr().String()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && len(line) == 0 {
+			if err != io.EOF {
+				log.Printf("Failed to read from TCP client %s: %v", clientAddress, err)
+			}
+			return
+		}
+		receivedText := strings.ToLower(strings.TrimSpace(line))
+		var m *misbehavior
+		if strings.HasPrefix(receivedText, "misbehave ") {
+			parts := strings.SplitN(receivedText, " ", 3)
+			if m, err = parseMisbehavior(parts[1]); err != nil {
+				log.Printf("Invalid misbehave command from TCP client %s: %v", clientAddress, err)
+				fmt.Fprintf(conn, "%v\n", err)
+				continue
+			}
+			receivedText = ""
+			if len(parts) == 3 {
+				receivedText = parts[2]
+			}
+		}
+		resp, ok := s.commandResponse("TCP", receivedText, clientAddress, func() *ClientInfo {
+			return newTCPClientInfo("tcp", clientAddress, conn)
+		})
+		if !ok && m == nil {
+			continue
+		}
+		var reply []byte
+		if ok {
+			reply = []byte(resp + "\n")
+		}
+		if m != nil {
+			if m.apply(ln, conn, reply) {
+				return
+			}
+			continue
+		}
+		if action, faulted := s.faults.decide("tcp", "", remoteIP(clientAddress), nil); faulted {
+			if action.delay > 0 {
+				log.Printf("Fault rule %d: delaying TCP reply to %s by %v", action.rule, clientAddress, action.delay)
+				s.faultsInjected.inc(strconv.Itoa(action.rule), "tcp", "latency")
+				time.Sleep(action.delay)
+			}
+			if action.close {
+				log.Printf("Fault rule %d: closing TCP connection from %s without reply", action.rule, clientAddress)
+				s.faultsInjected.inc(strconv.Itoa(action.rule), "tcp", "close")
+				return
+			}
+		}
+		if _, err := conn.Write(reply); err != nil {
+			log.Printf("Failed to write to TCP client %s: %v", clientAddress, err)
+			return
+		}
+		if stats := connTCPStats(conn); stats != nil {
+			log.Printf("TCP_INFO of TCP client %s: %s", clientAddress, stats)
+		}
+	}
+}
+
+// commandResponse answers the hostName, echo, clientIP, clientInfo and
+// timestamp commands shared by the UDP, SCTP and TCP servers, clientInfo
+// describing the client beyond its address, if the server can. It returns
+// false for unknown commands.
+func (s *Server) commandResponse(protocol, receivedText, clientAddress string, clientInfo func() *ClientInfo) (string, bool) {
+	received := time.Now()
+	if s.terminating.get() {
+		s.termination.record(strings.ToLower(protocol))
+	}
+	if receivedText == "hostname" {
+		log.Printf("Sending %s hostName response", protocol)
+		return s.hostname, true
+	} else if strings.HasPrefix(receivedText, "echo ") {
+		parts := strings.SplitN(receivedText, " ", 2)
+		resp := ""
+		if len(parts) == 2 {
+			resp = parts[1]
+		}
+		log.Printf("Echoing %v to %s client %s\n", resp, protocol, clientAddress)
+		return resp, true
+	} else if receivedText == "clientip" {
+		log.Printf("Sending clientip back to %s client %s\n", protocol, clientAddress)
+		return clientAddress, true
+	} else if receivedText == "clientinfo" {
+		log.Printf("Sending clientinfo back to %s client %s\n", protocol, clientAddress)
+		info := newClientInfo(strings.ToLower(protocol), clientAddress, unknownHeader)
+		if clientInfo != nil {
+			info = clientInfo()
+		}
+		resp, err := json.Marshal(info)
+		if err != nil {
+			log.Printf("Failed to serialize the clientinfo of %s client %s: %v", protocol, clientAddress, err)
+			return "", false
+		}
+		return string(resp), true
+	} else if receivedText == "timestamp" {
+		return timestampResponse(received), true
+	} else if len(receivedText) > 0 {
+		log.Printf("Unknown %s command received from %s: %v\n", protocol, clientAddress, receivedText)
+	}
+	return "", false
+}
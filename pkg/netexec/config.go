@@ -0,0 +1,347 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/util/sets"
+	netutils "k8s.io/utils/net"
+)
+
+// envPrefix prefixes the environment variables overriding netexec's flags,
+// e.g. NETEXEC_HTTP_PORT for --http-port.
+const envPrefix = "NETEXEC_"
+
+// redactedValue replaces the value of the configuration fields tagged with
+// `redact:"true"` in /config.
+const redactedValue = "<redacted>"
+
+// bindToAny is the UDP listen address used when none is configured.
+const bindToAny = ""
+
+// Config is the configuration of a Server. Every flag added by AddFlags is
+// bound to one of its fields, which the --config file and the NETEXEC_*
+// environment variables may set too. The fields without flag are per-listener
+// settings that only the --config file can set.
+type Config struct {
+	HTTP          HTTPConfig      `json:"http" yaml:"http"`
+	UDP           UDPConfig       `json:"udp" yaml:"udp"`
+	SCTP          ListenerConfig  `json:"sctp" yaml:"sctp"`
+	TCP           TCPConfig       `json:"tcp" yaml:"tcp"`
+	GRPC          ListenerConfig  `json:"grpc" yaml:"grpc"`
+	Multicast     MulticastConfig `json:"multicast" yaml:"multicast"`
+	ProxyProtocol string          `json:"proxyProtocol" yaml:"proxyProtocol"`
+	DelayShutdown int             `json:"delayShutdown" yaml:"delayShutdown"`
+	DrainTimeout  int             `json:"drainTimeout" yaml:"drainTimeout"`
+	JobRetention  int             `json:"jobRetention" yaml:"jobRetention"`
+	Limits        LimitsConfig    `json:"limits" yaml:"limits"`
+	Tracing       TracingConfig   `json:"tracing" yaml:"tracing"`
+	// Hostname replaces the host name answered by /hostname and the
+	// "hostname" commands. It defaults to os.Hostname().
+	Hostname string `json:"hostname,omitempty" yaml:"hostname,omitempty"`
+}
+
+// ListenerConfig is the address a server listens on. An empty address
+// listens on every address; a port of 0 picks a free port and a port of -1
+// disables the server.
+type ListenerConfig struct {
+	Address string `json:"address" yaml:"address"`
+	Port    int    `json:"port" yaml:"port"`
+}
+
+// HTTPConfig configures the HTTP server, which cannot be disabled.
+type HTTPConfig struct {
+	Address           string `json:"address" yaml:"address"`
+	Port              int    `json:"port" yaml:"port"`
+	TLSCertFile       string `json:"tlsCertFile" yaml:"tlsCertFile"`
+	TLSPrivateKeyFile string `json:"tlsPrivateKeyFile" yaml:"tlsPrivateKeyFile" redact:"true"`
+	Override          string `json:"override" yaml:"override"`
+	// HTTPBinPrefix is the path the httpbin endpoints are mounted under,
+	// "/" for the root. They are disabled if it is empty.
+	HTTPBinPrefix string `json:"httpbinPrefix" yaml:"httpbinPrefix"`
+	// VirtualHosts make the server answer as distinct applications depending
+	// on the Host header and SNI of the requests.
+	VirtualHosts []VirtualHostConfig `json:"virtualHosts,omitempty" yaml:"virtualHosts,omitempty"`
+	// ProxyProtocol overrides the global ProxyProtocol for this listener.
+	ProxyProtocol string `json:"proxyProtocol" yaml:"proxyProtocol"`
+}
+
+// UDPConfig configures the UDP servers, one per listen address.
+type UDPConfig struct {
+	Port            int    `json:"port" yaml:"port"`
+	ListenAddresses string `json:"listenAddresses" yaml:"listenAddresses"`
+}
+
+// MulticastConfig configures the multicast servers, one per group and
+// interface. They are disabled if Groups is empty.
+type MulticastConfig struct {
+	Port int `json:"port" yaml:"port"`
+	// Groups and Interfaces are comma separated lists. An empty Interfaces
+	// lets the kernel choose the interface.
+	Groups     string `json:"groups" yaml:"groups"`
+	Interfaces string `json:"interfaces" yaml:"interfaces"`
+}
+
+// TCPConfig configures the TCP command server.
+type TCPConfig struct {
+	Address string `json:"address" yaml:"address"`
+	Port    int    `json:"port" yaml:"port"`
+	// ProxyProtocol overrides the global ProxyProtocol for this listener.
+	ProxyProtocol string `json:"proxyProtocol" yaml:"proxyProtocol"`
+}
+
+// listenAddress returns the "host:port" a listener binds to.
+func listenAddress(address string, port int) string {
+	return net.JoinHostPort(address, strconv.Itoa(port))
+}
+
+// DefaultConfig returns the configuration of netexec without any flag: HTTP
+// on port 8080, UDP on port 8081 and every other server disabled.
+func DefaultConfig() Config {
+	return Config{
+		HTTP:         HTTPConfig{Port: 8080, HTTPBinPrefix: "/httpbin"},
+		UDP:          UDPConfig{Port: 8081},
+		SCTP:         ListenerConfig{Port: -1},
+		TCP:          TCPConfig{Port: -1},
+		GRPC:         ListenerConfig{Port: -1},
+		Multicast:    MulticastConfig{Port: 8084},
+		DrainTimeout: 30,
+		JobRetention: 3600,
+		Tracing:      TracingConfig{ServiceName: "netexec"},
+	}
+}
+
+// AddFlags binds the netexec flags to the fields of c, using their current
+// values as defaults.
+func (c *Config) AddFlags(fs *pflag.FlagSet) {
+	fs.IntVar(&c.HTTP.Port, "http-port", c.HTTP.Port, "HTTP Listen Port")
+	fs.StringVar(&c.HTTP.TLSCertFile, "tls-cert-file", c.HTTP.TLSCertFile,
+		"File containing an x509 certificate for HTTPS. (CA cert, if any, concatenated after server cert)")
+	fs.StringVar(&c.HTTP.TLSPrivateKeyFile, "tls-private-key-file", c.HTTP.TLSPrivateKeyFile,
+		"File containing an x509 private key matching --tls-cert-file")
+	fs.IntVar(&c.UDP.Port, "udp-port", c.UDP.Port, "UDP Listen Port")
+	fs.IntVar(&c.SCTP.Port, "sctp-port", c.SCTP.Port, "SCTP Listen Port")
+	fs.IntVar(&c.TCP.Port, "tcp-port", c.TCP.Port, "TCP Listen Port")
+	fs.IntVar(&c.GRPC.Port, "grpc-port", c.GRPC.Port, "gRPC Listen Port")
+	fs.StringVar(&c.Multicast.Groups, "multicast-groups", c.Multicast.Groups, "A comma separated list of IPv4 or IPv6 multicast groups the multicast servers join. Disabled if empty")
+	fs.StringVar(&c.Multicast.Interfaces, "multicast-interfaces", c.Multicast.Interfaces, "A comma separated list of interfaces the multicast groups are joined on. The kernel chooses if empty")
+	fs.IntVar(&c.Multicast.Port, "multicast-port", c.Multicast.Port, "Multicast Listen Port")
+	fs.StringVar(&c.HTTP.HTTPBinPrefix, "httpbin-prefix", c.HTTP.HTTPBinPrefix, "Path the httpbin-compatible endpoints are mounted under, \"/\" for the root. Disabled if empty")
+	fs.StringVar(&c.HTTP.Override, "http-override", c.HTTP.Override, "Override the HTTP handler to always respond as if it were a GET with this path & params")
+	fs.StringVar(&c.UDP.ListenAddresses, "udp-listen-addresses", c.UDP.ListenAddresses, "A comma separated list of ip addresses the udp servers listen from")
+	fs.StringVar(&c.ProxyProtocol, "proxy-protocol", c.ProxyProtocol, "Whether the HTTP and TCP servers accept a PROXY protocol v1/v2 header (\"accept\") or require it (\"require\"). Disabled if empty")
+	fs.IntVar(&c.DelayShutdown, "delay-shutdown", c.DelayShutdown, "Number of seconds to keep serving, with /healthz failing, when receiving SIGTERM.")
+	fs.Float64Var(&c.Limits.RequestsPerSecond, "limit-rps", c.Limits.RequestsPerSecond, "Number of HTTP requests and UDP commands per second served, beyond which HTTP requests get a 429 and UDP commands are dropped. Unlimited if 0")
+	fs.IntVar(&c.Limits.Burst, "limit-burst", c.Limits.Burst, "Number of requests served at once above --limit-rps. Defaults to --limit-rps")
+	fs.IntVar(&c.Limits.ConcurrentRequests, "limit-concurrent-requests", c.Limits.ConcurrentRequests, "Number of HTTP requests served at once, beyond which they get a 503. Unlimited if 0")
+	fs.IntVar(&c.Limits.ConcurrentConnections, "limit-concurrent-connections", c.Limits.ConcurrentConnections, "Number of HTTP, TCP and gRPC connections open at once, beyond which they are closed. Unlimited if 0")
+	fs.BoolVar(&c.Limits.PerClient, "limit-per-client", c.Limits.PerClient, "Apply the limits to each client IP instead of globally, the one of the PROXY protocol header if any")
+	fs.StringVar(&c.Tracing.Endpoint, "otlp-endpoint", c.Tracing.Endpoint, "URL of the OTLP/HTTP collector the spans are exported to, e.g. http://otel-collector:4318. Disabled if empty")
+	fs.StringVar(&c.Tracing.ServiceName, "otlp-service-name", c.Tracing.ServiceName, "Service name of the exported spans")
+	fs.IntVar(&c.JobRetention, "job-retention", c.JobRetention, "Number of seconds the results of /jobs are kept once the job finished.")
+	fs.IntVar(&c.DrainTimeout, "drain-timeout", c.DrainTimeout, "Number of seconds to wait for in-flight requests to complete when shutting down after SIGTERM.")
+}
+
+// proxyProtocolMode returns the PROXY protocol mode of a listener.
+func (c *Config) proxyProtocolMode(listenerMode string) string {
+	if listenerMode != "" {
+		return listenerMode
+	}
+	return c.ProxyProtocol
+}
+
+// LoadConfig fills cfg, whose fields are bound to flags by AddFlags, from, by
+// increasing precedence, the flags' default values, the config file at path,
+// the NETEXEC_* environment variables and the flags set on the command line.
+// NETEXEC_CONFIG replaces path unless flags has a "config" flag that was set.
+func LoadConfig(flags *pflag.FlagSet, cfg *Config, path string) error {
+	explicit := map[string]string{}
+	flags.Visit(func(f *pflag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	if _, ok := explicit["config"]; !ok && os.Getenv(envPrefix+"CONFIG") != "" {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read config file: %v", err)
+		}
+		// YAML being a superset of JSON, this parses both.
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+		log.Printf("Loaded config file %s", path)
+	}
+	var errs []string
+	flags.VisitAll(func(f *pflag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if value, ok := os.LookupEnv(name); ok && f.Name != "config" {
+			if err := f.Value.Set(value); err != nil {
+				errs = append(errs, fmt.Sprintf("invalid value %q for %s: %v", value, name, err))
+			}
+		}
+	})
+	for name, value := range explicit {
+		if err := flags.Set(name, value); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid value %q for --%s: %v", value, name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []string
+	checkPort := func(name string, port int, optional bool) {
+		if (port < 0 || port > 65535) && !(optional && port == -1) {
+			errs = append(errs, fmt.Sprintf("%s must be a port number, or -1 to disable the server, got %d", name, port))
+		}
+	}
+	checkAddress := func(name, address string) {
+		if address != "" && netutils.ParseIPSloppy(address) == nil {
+			errs = append(errs, fmt.Sprintf("%s must be an IP address, got %q", name, address))
+		}
+	}
+	checkProxyProtocol := func(name, mode string) {
+		if mode != "" && mode != "accept" && mode != "require" {
+			errs = append(errs, fmt.Sprintf("%s must be empty, \"accept\" or \"require\", got %q", name, mode))
+		}
+	}
+	checkPort("http.port", c.HTTP.Port, false)
+	checkPort("udp.port", c.UDP.Port, true)
+	checkPort("sctp.port", c.SCTP.Port, true)
+	checkPort("tcp.port", c.TCP.Port, true)
+	checkPort("grpc.port", c.GRPC.Port, true)
+	checkAddress("http.address", c.HTTP.Address)
+	checkAddress("sctp.address", c.SCTP.Address)
+	checkAddress("tcp.address", c.TCP.Address)
+	checkAddress("grpc.address", c.GRPC.Address)
+	checkProxyProtocol("proxyProtocol", c.ProxyProtocol)
+	checkProxyProtocol("http.proxyProtocol", c.HTTP.ProxyProtocol)
+	checkProxyProtocol("tcp.proxyProtocol", c.TCP.ProxyProtocol)
+	if _, err := parseAddresses(c.UDP.ListenAddresses); err != nil {
+		errs = append(errs, fmt.Sprintf("udp.listenAddresses is invalid: %v", err))
+	}
+	if c.Multicast.Groups != "" {
+		checkPort("multicast.port", c.Multicast.Port, false)
+		if _, err := parseMulticastGroups(c.Multicast.Groups); err != nil {
+			errs = append(errs, fmt.Sprintf("multicast.groups is invalid: %v", err))
+		}
+		if _, err := parseInterfaces(c.Multicast.Interfaces); err != nil {
+			errs = append(errs, fmt.Sprintf("multicast.interfaces is invalid: %v", err))
+		}
+	}
+	if c.HTTP.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.HTTP.TLSCertFile, c.HTTP.TLSPrivateKeyFile); err != nil {
+			errs = append(errs, fmt.Sprintf("http.tlsCertFile and http.tlsPrivateKeyFile are invalid: %v", err))
+		}
+	} else if c.HTTP.TLSPrivateKeyFile != "" {
+		errs = append(errs, "http.tlsPrivateKeyFile requires http.tlsCertFile")
+	}
+	if c.HTTP.Override != "" {
+		if _, err := url.Parse(c.HTTP.Override); err != nil {
+			errs = append(errs, fmt.Sprintf("http.override is invalid: %v", err))
+		}
+	}
+	if c.HTTP.HTTPBinPrefix != "" && !strings.HasPrefix(c.HTTP.HTTPBinPrefix, "/") {
+		errs = append(errs, fmt.Sprintf("http.httpbinPrefix must be empty or start with \"/\", got %q", c.HTTP.HTTPBinPrefix))
+	}
+	for i := range c.HTTP.VirtualHosts {
+		v := c.HTTP.VirtualHosts[i]
+		if err := v.validate(); err != nil {
+			errs = append(errs, fmt.Sprintf("http.virtualHosts[%d] is invalid: %v", i, err))
+		} else if v.TLSCertFile != "" && c.HTTP.TLSCertFile == "" {
+			errs = append(errs, fmt.Sprintf("http.virtualHosts[%d].tlsCertFile requires http.tlsCertFile", i))
+		}
+	}
+	if c.DelayShutdown < 0 {
+		errs = append(errs, fmt.Sprintf("delayShutdown must not be negative, got %d", c.DelayShutdown))
+	}
+	if c.Limits.RequestsPerSecond < 0 || c.Limits.Burst < 0 || c.Limits.ConcurrentRequests < 0 || c.Limits.ConcurrentConnections < 0 {
+		errs = append(errs, "limits must not be negative")
+	}
+	if c.Tracing.Endpoint != "" {
+		if _, err := c.Tracing.tracesURL(); err != nil {
+			errs = append(errs, fmt.Sprintf("tracing.endpoint is invalid: %v", err))
+		}
+	}
+	if c.JobRetention < 0 {
+		errs = append(errs, fmt.Sprintf("jobRetention must not be negative, got %d", c.JobRetention))
+	}
+	if c.DrainTimeout < 0 {
+		errs = append(errs, fmt.Sprintf("drainTimeout must not be negative, got %d", c.DrainTimeout))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// redacted returns a copy of c whose secrets are replaced by redactedValue.
+func (c *Config) redacted() Config {
+	res := *c
+	redactFields(reflect.ValueOf(&res).Elem())
+	return res
+}
+
+func redactFields(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		switch {
+		case field.Kind() == reflect.Struct:
+			redactFields(field)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.Struct:
+			// Copy the elements, shared with the original configuration.
+			elems := reflect.MakeSlice(field.Type(), field.Len(), field.Len())
+			reflect.Copy(elems, field)
+			for j := 0; j < elems.Len(); j++ {
+				redactFields(elems.Index(j))
+			}
+			field.Set(elems)
+		case v.Type().Field(i).Tag.Get("redact") == "true" && field.Kind() == reflect.String && field.String() != "":
+			field.SetString(redactedValue)
+		}
+	}
+}
+
+// configHandler returns the effective configuration, secrets redacted.
+func (s *Server) configHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET /config")
+	writeJSON(w, http.StatusOK, s.config.redacted())
+}
+
+func parseAddresses(addresses string) ([]string, error) {
+	if addresses == "" {
+		return []string{bindToAny}, nil
+	}
+	// Using a set to remove duplicates
+	res := make([]string, 0)
+	split := strings.Split(addresses, ",")
+	for _, address := range split {
+		netAddr := netutils.ParseIPSloppy(address)
+		if netAddr == nil {
+			return nil, fmt.Errorf("parseAddress: invalid address %s", address)
+		}
+		res = append(res, address)
+	}
+	set := sets.NewString(res...)
+	return set.List(), nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec_test
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/pflag"
+
+	"smartdocter/pkg/netexec"
+)
+
+type loadConfigCase struct {
+	// file is the content of the config file, none if empty, passed with
+	// --config unless envConfig.
+	file      string
+	envConfig bool
+	env       map[string]string
+	args      []string
+	// expected changes the default configuration into the loaded one, and
+	// err is the expected error instead.
+	expected func(*netexec.Config)
+	err      string
+}
+
+var _ = Describe("Config", Label("netexec"), func() {
+	DescribeTable("loads the config file, environment and flags by increasing precedence",
+		func(c loadConfigCase) {
+			args := c.args
+			if c.file != "" {
+				path := filepath.Join(GinkgoT().TempDir(), "netexec.yaml")
+				Expect(os.WriteFile(path, []byte(c.file), 0o600)).To(Succeed())
+				if c.envConfig {
+					GinkgoT().Setenv("NETEXEC_CONFIG", path)
+				} else {
+					args = append([]string{"--config", path}, args...)
+				}
+			}
+			for name, value := range c.env {
+				GinkgoT().Setenv(name, value)
+			}
+			cfg := netexec.DefaultConfig()
+			flags := pflag.NewFlagSet("netexec", pflag.ContinueOnError)
+			cfg.AddFlags(flags)
+			configFile := flags.String("config", "", "")
+			Expect(flags.Parse(args)).To(Succeed())
+
+			err := netexec.LoadConfig(flags, &cfg, *configFile)
+			if c.err != "" {
+				Expect(err).To(MatchError(ContainSubstring(c.err)))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			expected := netexec.DefaultConfig()
+			if c.expected != nil {
+				c.expected(&expected)
+			}
+			Expect(cfg).To(Equal(expected))
+		},
+		Entry("flag defaults", loadConfigCase{}),
+		Entry("YAML file", loadConfigCase{
+			file: "http:\n  port: 9080\n  virtualHosts:\n  - hostname: a.example.com\n    status: 503\ntcp:\n  port: 9082\n  proxyProtocol: require\n",
+			expected: func(cfg *netexec.Config) {
+				cfg.HTTP.Port = 9080
+				cfg.HTTP.VirtualHosts = []netexec.VirtualHostConfig{{Hostname: "a.example.com", Status: 503}}
+				cfg.TCP.Port, cfg.TCP.ProxyProtocol = 9082, "require"
+			}}),
+		Entry("JSON file", loadConfigCase{file: `{"udp": {"port": 9081}, "drainTimeout": 5}`,
+			expected: func(cfg *netexec.Config) { cfg.UDP.Port, cfg.DrainTimeout = 9081, 5 }}),
+		Entry("file of NETEXEC_CONFIG", loadConfigCase{file: "grpc:\n  port: 9083\n", envConfig: true,
+			expected: func(cfg *netexec.Config) { cfg.GRPC.Port = 9083 }}),
+		Entry("unknown key in the file", loadConfigCase{file: "http:\n  prot: 9080\n",
+			err: "field prot not found"}),
+		Entry("malformed file", loadConfigCase{file: "http: [", err: "failed to parse config file"}),
+		Entry("environment", loadConfigCase{env: map[string]string{"NETEXEC_HTTP_PORT": "9080", "NETEXEC_LIMIT_PER_CLIENT": "true"},
+			expected: func(cfg *netexec.Config) { cfg.HTTP.Port, cfg.Limits.PerClient = 9080, true }}),
+		Entry("invalid environment", loadConfigCase{env: map[string]string{"NETEXEC_HTTP_PORT": "http"},
+			err: `invalid value "http" for NETEXEC_HTTP_PORT`}),
+		Entry("flags", loadConfigCase{args: []string{"--http-port", "9080", "--proxy-protocol", "accept"},
+			expected: func(cfg *netexec.Config) { cfg.HTTP.Port, cfg.ProxyProtocol = 9080, "accept" }}),
+		Entry("file over the defaults, environment over the file, flags over both", loadConfigCase{
+			file: "http:\n  port: 9080\nudp:\n  port: 9081\ntcp:\n  port: 9082\n",
+			env:  map[string]string{"NETEXEC_UDP_PORT": "10081", "NETEXEC_TCP_PORT": "10082"},
+			args: []string{"--tcp-port", "11082"},
+			expected: func(cfg *netexec.Config) {
+				cfg.HTTP.Port, cfg.UDP.Port, cfg.TCP.Port = 9080, 10081, 11082
+			}}),
+		Entry("--config over NETEXEC_CONFIG", loadConfigCase{file: "grpc:\n  port: 9083\n",
+			env:      map[string]string{"NETEXEC_CONFIG": "/nonexistent/netexec.yaml"},
+			expected: func(cfg *netexec.Config) { cfg.GRPC.Port = 9083 }}),
+		Entry("missing file", loadConfigCase{env: map[string]string{"NETEXEC_CONFIG": "/nonexistent/netexec.yaml"},
+			err: "failed to read config file"}),
+	)
+
+	DescribeTable("validates every setting",
+		func(configure func(*netexec.Config), errs ...string) {
+			cfg := netexec.DefaultConfig()
+			configure(&cfg)
+			err := cfg.Validate()
+			if len(errs) == 0 {
+				Expect(err).NotTo(HaveOccurred())
+				return
+			}
+			for _, e := range errs {
+				Expect(err).To(MatchError(ContainSubstring(e)))
+			}
+		},
+		Entry("default", func(cfg *netexec.Config) {}),
+		Entry("disabled servers and a free port", func(cfg *netexec.Config) {
+			cfg.HTTP.Port, cfg.UDP.Port, cfg.GRPC.Port = 0, -1, -1
+		}),
+		Entry("ports", func(cfg *netexec.Config) { cfg.HTTP.Port, cfg.TCP.Port = -1, 65536 },
+			"http.port must be a port number", "tcp.port must be a port number"),
+		Entry("addresses", func(cfg *netexec.Config) { cfg.HTTP.Address, cfg.UDP.ListenAddresses = "localhost", "127.0.0.1,::x" },
+			`http.address must be an IP address, got "localhost"`, "udp.listenAddresses is invalid"),
+		Entry("PROXY protocol modes", func(cfg *netexec.Config) { cfg.ProxyProtocol, cfg.TCP.ProxyProtocol = "v2", "always" },
+			`proxyProtocol must be empty, "accept" or "require", got "v2"`, `tcp.proxyProtocol must be empty, "accept" or "require", got "always"`),
+		Entry("multicast groups", func(cfg *netexec.Config) { cfg.Multicast.Groups = "192.0.2.1" },
+			"multicast.groups is invalid"),
+		Entry("private key without certificate", func(cfg *netexec.Config) { cfg.HTTP.TLSPrivateKeyFile = "tls.key" },
+			"http.tlsPrivateKeyFile requires http.tlsCertFile"),
+		Entry("missing certificate", func(cfg *netexec.Config) { cfg.HTTP.TLSCertFile = "/nonexistent/tls.crt" },
+			"http.tlsCertFile and http.tlsPrivateKeyFile are invalid"),
+		Entry("httpbin prefix", func(cfg *netexec.Config) { cfg.HTTP.HTTPBinPrefix = "httpbin" },
+			`http.httpbinPrefix must be empty or start with "/", got "httpbin"`),
+		Entry("virtual host certificate without default one", func(cfg *netexec.Config) {
+			cfg.HTTP.VirtualHosts = []netexec.VirtualHostConfig{{Hostname: "a.example.com", TLSCertFile: "a.crt", TLSPrivateKeyFile: "a.key"}}
+		}, "http.virtualHosts[0]"),
+		Entry("negative durations and limits", func(cfg *netexec.Config) {
+			cfg.DelayShutdown, cfg.DrainTimeout, cfg.JobRetention, cfg.Limits.Burst = -1, -1, -1, -1
+		}, "delayShutdown must not be negative", "drainTimeout must not be negative", "jobRetention must not be negative",
+			"limits must not be negative"),
+		Entry("tracing endpoint", func(cfg *netexec.Config) { cfg.Tracing.Endpoint = "otel-collector:4318" },
+			"tracing.endpoint is invalid"),
+	)
+})
@@ -0,0 +1,374 @@
+// Copyright Authors of Kubernetes.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+Copyright 2014 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package netexec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ishidawataru/sctp"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+)
+
+// DialResult is the JSON answer of /dial. Responses is only set if the last
+// try got a non-empty response. SocketOptions, set if any was requested, are
+// the options in effect on the socket of the last try.
+type DialResult struct {
+	Responses     []string          `json:"responses,omitempty"`
+	Errors        []string          `json:"errors,omitempty"`
+	Distribution  *DialDistribution `json:"distribution,omitempty"`
+	SocketOptions *SocketOptions    `json:"socketOptions,omitempty"`
+	// Retries counts the failed tries retried.
+	Retries int `json:"retries,omitempty"`
+	// TCPInfo are the TCP_INFO statistics of the connection of every http
+	// or tcp try that got a response.
+	TCPInfo []*TCPStats `json:"tcpInfo,omitempty"`
+}
+
+func dialHandler(w http.ResponseWriter, r *http.Request) {
+	printRequest(r)
+	values, err := url.Parse(r.URL.RequestURI())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%v", err), http.StatusBadRequest)
+		return
+	}
+
+	host := values.Query().Get("host")
+	port := values.Query().Get("port")
+	request := values.Query().Get("request") // hostName
+	protocol := values.Query().Get("protocol")
+	tryParam := values.Query().Get("tries")
+	mode := values.Query().Get("mode")
+	log.Printf("GET /dial?host=%s&protocol=%s&port=%s&request=%s&tries=%s&mode=%s", host, protocol, port, request, tryParam, mode)
+	switch mode {
+	case "":
+	case "mtu":
+		mtuDialHandler(w, host, port, protocol, values.Query().Get("maxMTU"))
+		return
+	case "multicast":
+		multicastDialHandler(w, r, host, port, request)
+		return
+	case "clock":
+		clockDialHandler(w, r, host, port, protocol)
+		return
+	case "idle":
+		idleDialHandler(w, r, host, port, protocol)
+		return
+	case "throughput":
+		throughputDialHandler(w, r, host, port)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("unsupported mode. %s", mode), http.StatusBadRequest)
+		return
+	}
+	tries := 1
+	if len(tryParam) > 0 {
+		tries, err = strconv.Atoi(tryParam)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("tries parameter is invalid. %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(request) == 0 {
+		http.Error(w, fmt.Sprintf("request parameter not specified. %v", err), http.StatusBadRequest)
+		return
+	}
+	distribution, err := parseDistributionParams(values.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Unresolvable hosts are failed tries, resolved again by the next ones.
+	hostPort := net.JoinHostPort(host, port)
+	dialer, addr, err := resolveDialer(protocol, hostPort)
+	if err != nil && classifyDialError(err) != dialErrorDNS {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	socketOptions, err := parseSocketOptions(values.Query(), protocol)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	policy, err := parseDialPolicy(values.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx := withDialPolicy(r.Context(), policy)
+	if policy.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.timeout)
+		defer cancel()
+	}
+	var sockets *dialSockets
+	if socketOptions != nil {
+		ctx, sockets = withSocketOptions(ctx, socketOptions)
+	}
+	ctx, tcpStats := withTCPStats(ctx)
+
+	errors := make([]string, 0)
+	responses := make([]string, 0)
+	var response string
+	dialProtocol := strings.ToLower(protocol)
+	if dialProtocol == "" {
+		dialProtocol = "http"
+	}
+	retries := 0
+	for i := 0; i < tries; i++ {
+		for retry := 0; ; retry++ {
+			if dialer == nil {
+				dialer, addr, err = resolveDialer(protocol, hostPort)
+			}
+			if dialer != nil {
+				response, err = dialTry(ctx, dialer, dialProtocol, host, port, request, addr, i+1)
+			}
+			if err == nil || retry == policy.retries || !policy.retryOn[classifyDialError(err)] {
+				break
+			}
+			delay := policy.backoffDelay(retry + 1)
+			log.Printf("Retrying try %d to %s in %v: %v", i+1, hostPort, delay, err)
+			if !sleepContext(ctx, delay) {
+				break
+			}
+			retries++
+		}
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", classifyDialError(err), err))
+		} else {
+			responses = append(responses, response)
+		}
+	}
+	output := DialResult{Retries: retries}
+	if len(response) > 0 {
+		output.Responses = responses
+	}
+	if len(errors) > 0 {
+		output.Errors = errors
+	}
+	if distribution.analysisEnabled {
+		output.Distribution = analyzeDistribution(responses, distribution)
+	}
+	if sockets != nil {
+		output.SocketOptions = sockets.lastEffective()
+	}
+	output.TCPInfo = tcpStats.all()
+	bytes, err := json.Marshal(output)
+	if err == nil {
+		fmt.Fprint(w, string(bytes))
+	} else {
+		http.Error(w, fmt.Sprintf("response could not be serialized. %v", err), http.StatusExpectationFailed)
+	}
+}
+
+// dialFunc sends request to addr and returns the response.
+type dialFunc func(ctx context.Context, request string, addr net.Addr) (string, error)
+
+// resolveDialer returns the dialer of protocol, "http" if empty, and the
+// address of hostPort it dials.
+func resolveDialer(protocol, hostPort string) (dialFunc, net.Addr, error) {
+	var addr net.Addr
+	var dialer dialFunc
+	var err error
+	switch strings.ToLower(protocol) {
+	case "", "http":
+		dialer = dialHTTP
+		addr, err = net.ResolveTCPAddr("tcp", hostPort)
+	case "tcp":
+		dialer = dialTCP
+		addr, err = net.ResolveTCPAddr("tcp", hostPort)
+	case "udp":
+		dialer = dialUDP
+		addr, err = net.ResolveUDPAddr("udp", hostPort)
+	case "sctp":
+		dialer = dialSCTP
+		addr, err = sctp.ResolveSCTPAddr("sctp", hostPort)
+	case "grpc":
+		dialer = dialGRPC
+		addr, err = net.ResolveTCPAddr("tcp", hostPort)
+	default:
+		return nil, nil, fmt.Errorf("unsupported protocol. %s", protocol)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("host and/or port param are invalid. %w", err)
+	}
+	return dialer, addr, nil
+}
+
+// dialTry sends request to addr once with dialer, in a client span.
+func dialTry(ctx context.Context, dialer dialFunc, protocol, host, port, request string, addr net.Addr, try int) (string, error) {
+	ctx, sp := startSpan(ctx, "dial "+protocol, spanKindClient)
+	defer sp.end()
+	sp.setAttribute("net.peer.name", host)
+	sp.setAttribute("net.peer.port", port)
+	sp.setAttribute("netexec.request", request)
+	sp.setAttribute("netexec.try", try)
+	response, err := dialer(ctx, request, addr)
+	if err != nil {
+		sp.setError(err.Error())
+	}
+	return response, err
+}
+
+func dialHTTP(ctx context.Context, request string, addr net.Addr) (string, error) {
+	policy := dialPolicyFromContext(ctx)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialSocket(ctx, network, address, policy.connectTimeout)
+		},
+		ResponseHeaderTimeout: policy.readTimeout,
+	}
+	transport = utilnet.SetTransportDefaults(transport)
+	httpClient := createHTTPClient(transport, policy.connectTimeout+policy.readTimeout)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/%s", addr.String(), request), nil)
+	if err != nil {
+		return "", err
+	}
+	injectHeaders(ctx, req.Header)
+	var conn net.Conn
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { conn = info.Conn },
+	}))
+	resp, err := httpClient.Do(req)
+	defer transport.CloseIdleConnections()
+	if err == nil {
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err == nil {
+			recordTCPStats(ctx, conn)
+			return string(body), nil
+		}
+	}
+	return "", err
+}
+
+func createHTTPClient(transport *http.Transport, timeout time.Duration) *http.Client {
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}
+	return client
+}
+
+// dialSocket connects to address with the socket options of ctx, if any.
+func dialSocket(ctx context.Context, network, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := socketDialer(ctx, timeout).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordSocketOptions(ctx, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func dialTCP(ctx context.Context, request string, addr net.Addr) (string, error) {
+	policy := dialPolicyFromContext(ctx)
+	conn, err := dialSocket(ctx, "tcp", addr.String(), policy.connectTimeout)
+	if err != nil {
+		return "", fmt.Errorf("tcp dial failed. err:%w", err)
+	}
+	Conn := conn.(*net.TCPConn)
+
+	defer Conn.Close()
+	_, err = Conn.Write([]byte(request + "\n"))
+	if err != nil {
+		return "", fmt.Errorf("tcp connection write failed. err:%w", err)
+	}
+	// Closing our side makes the server close the connection after replying.
+	if err = Conn.CloseWrite(); err != nil {
+		return "", fmt.Errorf("tcp connection close write failed. err:%w", err)
+	}
+	e := Conn.SetReadDeadline(policy.readDeadline(ctx))
+	if e != nil {
+		return "", fmt.Errorf("SetReadDeadline failed. err:'%v'", e)
+	}
+	tcpResponse, err := io.ReadAll(Conn)
+	if err == nil && len(tcpResponse) == 0 {
+		// The server closed the connection without answering.
+		err = io.EOF
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading from tcp connection failed. err:'%w'", err)
+	}
+	recordTCPStats(ctx, Conn)
+	return strings.TrimSuffix(string(tcpResponse), "\n"), nil
+}
+
+func dialUDP(ctx context.Context, request string, addr net.Addr) (string, error) {
+	Conn, err := dialSocket(ctx, "udp", addr.String(), 0)
+	if err != nil {
+		return "", fmt.Errorf("udp dial failed. err:%w", err)
+	}
+
+	defer Conn.Close()
+	buf := []byte(request)
+	_, err = Conn.Write(buf)
+	if err != nil {
+		return "", fmt.Errorf("udp connection write failed. err:%w", err)
+	}
+	udpResponse := make([]byte, 65535)
+	e := Conn.SetReadDeadline(dialPolicyFromContext(ctx).readDeadline(ctx))
+	if e != nil {
+		return "", fmt.Errorf("SetReadDeadline failed. err:'%v'", e)
+	}
+	count, err := Conn.Read(udpResponse)
+	if err != nil || count == 0 {
+		return "", fmt.Errorf("reading from udp connection failed. err:'%w'", err)
+	}
+	return string(udpResponse[0:count]), nil
+}
+
+func dialSCTP(ctx context.Context, request string, addr net.Addr) (string, error) {
+	Conn, err := sctpSocketConfig(ctx).Dial("sctp", nil, addr.(*sctp.SCTPAddr))
+	if err != nil {
+		return "", fmt.Errorf("sctp dial failed. err:%w", err)
+	}
+
+	defer Conn.Close()
+	buf := []byte(request)
+	_, err = Conn.Write(buf)
+	if err != nil {
+		return "", fmt.Errorf("sctp connection write failed. err:%w", err)
+	}
+	sctpResponse := make([]byte, 1024)
+	e := Conn.SetReadDeadline(dialPolicyFromContext(ctx).readDeadline(ctx))
+	if e != nil {
+		return "", fmt.Errorf("SetReadDeadline failed. err:'%v'", e)
+	}
+	count, err := Conn.Read(sctpResponse)
+	if err != nil || count == 0 {
+		return "", fmt.Errorf("reading from sctp connection failed. err:'%w'", err)
+	}
+	return string(sctpResponse[0:count]), nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Classes of the errors of /dial.
+const (
+	dialErrorDNS     = "dns"
+	dialErrorRefused = "refused"
+	dialErrorTimeout = "timeout"
+	dialErrorReset   = "reset"
+	dialErrorOther   = "other"
+)
+
+var dialErrorClasses = []string{dialErrorDNS, dialErrorRefused, dialErrorTimeout, dialErrorReset, dialErrorOther}
+
+const (
+	defaultDialTimeout = 5 * time.Second
+	maxDialRetries     = 100
+	maxDialBackoff     = 10 * time.Second
+)
+
+// dialPolicy bounds the tries of a dial and tells which failed ones to retry.
+type dialPolicy struct {
+	// connectTimeout bounds the connection of a try, readTimeout the wait
+	// for its response once the request is sent, and timeout the whole dial.
+	connectTimeout time.Duration
+	readTimeout    time.Duration
+	timeout        time.Duration
+	// retries failed tries at most, after a backoff doubling at every
+	// retry, up to maxDialBackoff, and randomized by ±jitter of it.
+	retries int
+	backoff time.Duration
+	jitter  float64
+	retryOn map[string]bool
+}
+
+var defaultDialPolicy = &dialPolicy{connectTimeout: defaultDialTimeout, readTimeout: defaultDialTimeout}
+
+// parseDialPolicy reads the timeouts and retry policy of the /dial
+// parameters.
+func parseDialPolicy(query url.Values) (*dialPolicy, error) {
+	p := &dialPolicy{connectTimeout: defaultDialTimeout, readTimeout: defaultDialTimeout, backoff: 100 * time.Millisecond}
+	var err error
+	for _, d := range []struct {
+		value *time.Duration
+		name  string
+	}{
+		{&p.connectTimeout, "connectTimeout"},
+		{&p.readTimeout, "readTimeout"},
+		{&p.timeout, "timeout"},
+	} {
+		if value := query.Get(d.name); value != "" {
+			if *d.value, err = time.ParseDuration(value); err != nil || *d.value <= 0 {
+				return nil, fmt.Errorf("%s parameter must be a positive golang duration, got %q", d.name, value)
+			}
+		}
+	}
+	if value := query.Get("retries"); value != "" {
+		if p.retries, err = strconv.Atoi(value); err != nil || p.retries < 0 || p.retries > maxDialRetries {
+			return nil, fmt.Errorf("retries parameter must be an integer between 0 and %d, got %q", maxDialRetries, value)
+		}
+	}
+	if value := query.Get("backoff"); value != "" {
+		if p.backoff, err = time.ParseDuration(value); err != nil || p.backoff < 0 || p.backoff > maxDialBackoff {
+			return nil, fmt.Errorf("backoff parameter must be a non-negative golang duration up to %v, got %q", maxDialBackoff, value)
+		}
+	}
+	if value := query.Get("jitter"); value != "" {
+		if p.jitter, err = strconv.ParseFloat(value, 64); err != nil || p.jitter < 0 || p.jitter > 1 {
+			return nil, fmt.Errorf("jitter parameter must be a number between 0 and 1, got %q", value)
+		}
+	}
+	p.retryOn = map[string]bool{}
+	if value := query.Get("retryOn"); value != "" {
+		for _, class := range strings.Split(value, ",") {
+			class = strings.TrimSpace(class)
+			if !isDialErrorClass(class) {
+				return nil, fmt.Errorf("retryOn parameter must be a comma separated list of %s, got %q", strings.Join(dialErrorClasses, ", "), value)
+			}
+			p.retryOn[class] = true
+		}
+	} else {
+		for _, class := range dialErrorClasses {
+			p.retryOn[class] = true
+		}
+	}
+	return p, nil
+}
+
+func isDialErrorClass(class string) bool {
+	for _, c := range dialErrorClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+type dialPolicyKey struct{}
+
+func withDialPolicy(ctx context.Context, p *dialPolicy) context.Context {
+	return context.WithValue(ctx, dialPolicyKey{}, p)
+}
+
+// dialPolicyFromContext returns the policy of the dial of ctx, or the default
+// one.
+func dialPolicyFromContext(ctx context.Context) *dialPolicy {
+	if p, ok := ctx.Value(dialPolicyKey{}).(*dialPolicy); ok {
+		return p
+	}
+	return defaultDialPolicy
+}
+
+// readDeadline returns when a try of ctx that just sent its request stops
+// waiting for the response.
+func (p *dialPolicy) readDeadline(ctx context.Context) time.Time {
+	deadline := time.Now().Add(p.readTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		return d
+	}
+	return deadline
+}
+
+// backoffDelay returns the delay before the retry-th retry.
+func (p *dialPolicy) backoffDelay(retry int) time.Duration {
+	delay := p.backoff
+	for i := 1; i < retry && delay < maxDialBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxDialBackoff {
+		delay = maxDialBackoff
+	}
+	return time.Duration(float64(delay) * (1 + p.jitter*(2*rand.Float64()-1)))
+}
+
+// sleepContext waits for d, and tells whether ctx was not done first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// classifyDialError tells why a try failed.
+func classifyDialError(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	switch {
+	case errors.As(err, &grpcErr):
+		return classifyGRPCStatus(grpcErr.GRPCStatus())
+	case errors.As(err, &dnsErr):
+		return dialErrorDNS
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return dialErrorRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ENOTCONN),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return dialErrorReset
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return dialErrorTimeout
+	}
+	return dialErrorOther
+}
+
+// classifyGRPCStatus tells why a gRPC call failed, from the message of the
+// status of the connection errors.
+func classifyGRPCStatus(s *status.Status) string {
+	switch s.Code() {
+	case codes.DeadlineExceeded:
+		return dialErrorTimeout
+	case codes.Unavailable:
+		message := s.Message()
+		switch {
+		case strings.Contains(message, "no such host"), strings.Contains(message, "produced zero addresses"):
+			return dialErrorDNS
+		case strings.Contains(message, "connection refused"), strings.Contains(message, "no route to host"),
+			strings.Contains(message, "network is unreachable"):
+			return dialErrorRefused
+		case strings.Contains(message, "connection reset"), strings.Contains(message, "broken pipe"), strings.Contains(message, "EOF"):
+			return dialErrorReset
+		}
+	}
+	return dialErrorOther
+}
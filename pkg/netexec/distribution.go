@@ -0,0 +1,249 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultUniformAlpha is the significance level below which a distribution
+// is not considered uniform.
+const defaultUniformAlpha = 0.01
+
+// DialDistribution is the analysis of the backends that answered the tries
+// of /dial, set if "groupBy" or an expectation is given.
+type DialDistribution struct {
+	// GroupBy is "response", or the JSON field identifying backends.
+	GroupBy  string         `json:"groupBy"`
+	Backends []BackendCount `json:"backends"`
+	// Unidentified counts the responses GroupBy could not be read from.
+	Unidentified int `json:"unidentified,omitempty"`
+	// ChiSquare measures the deviation from a uniform distribution over the
+	// expected number of backends, or the answering ones, and PValue is the
+	// probability of a deviation at least as large if it were uniform.
+	ChiSquare  float64      `json:"chiSquare"`
+	PValue     float64      `json:"pValue"`
+	LongestRun BackendCount `json:"longestRun"`
+	// Checks are the outcomes of the expectations, and Pass is set if they
+	// all passed.
+	Checks []DialCheck `json:"checks,omitempty"`
+	Pass   bool        `json:"pass"`
+}
+
+// BackendCount is the number of responses of a backend.
+type BackendCount struct {
+	Backend string  `json:"backend"`
+	Count   int     `json:"count"`
+	Share   float64 `json:"share,omitempty"`
+}
+
+// DialCheck is the outcome of an expectation on the distribution.
+type DialCheck struct {
+	Name     string `json:"name"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Pass     bool   `json:"pass"`
+}
+
+// distributionParams are the /dial parameters of the distribution analysis.
+type distributionParams struct {
+	groupBy         string
+	expectBackends  int
+	expectAffinity  bool
+	expectUniform   bool
+	alpha           float64
+	analysisEnabled bool
+}
+
+func parseDistributionParams(query url.Values) (distributionParams, error) {
+	p := distributionParams{groupBy: query.Get("groupBy"), alpha: defaultUniformAlpha}
+	var err error
+	if value := query.Get("expectBackends"); value != "" {
+		if p.expectBackends, err = strconv.Atoi(value); err != nil || p.expectBackends < 1 {
+			return p, fmt.Errorf("expectBackends parameter must be a positive integer, got %q", value)
+		}
+	}
+	if value := query.Get("expectAffinity"); value != "" {
+		if p.expectAffinity, err = strconv.ParseBool(value); err != nil {
+			return p, fmt.Errorf("expectAffinity parameter must be a boolean, got %q", value)
+		}
+	}
+	if value := query.Get("expectUniform"); value != "" {
+		if p.expectUniform, err = strconv.ParseBool(value); err != nil {
+			return p, fmt.Errorf("expectUniform parameter must be a boolean, got %q", value)
+		}
+	}
+	if value := query.Get("alpha"); value != "" {
+		if p.alpha, err = strconv.ParseFloat(value, 64); err != nil || p.alpha <= 0 || p.alpha >= 1 {
+			return p, fmt.Errorf("alpha parameter must be a number between 0 and 1, got %q", value)
+		}
+	}
+	p.analysisEnabled = p.groupBy != "" || p.expectBackends > 0 || p.expectAffinity || p.expectUniform
+	if p.groupBy == "" {
+		p.groupBy = "response"
+	}
+	return p, nil
+}
+
+// backendIdentity returns the backend that sent response: the response
+// itself, or the value of the dotted JSON field groupBy.
+func backendIdentity(response, groupBy string) (string, bool) {
+	if groupBy == "response" {
+		return strings.TrimSpace(response), true
+	}
+	var value interface{}
+	if err := json.Unmarshal([]byte(response), &value); err != nil {
+		return "", false
+	}
+	for _, key := range strings.Split(groupBy, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = object[key]; !ok {
+			return "", false
+		}
+	}
+	if s, ok := value.(string); ok {
+		return s, true
+	}
+	data, err := json.Marshal(value)
+	return string(data), err == nil
+}
+
+// analyzeDistribution aggregates the responses of the tries, in order, by
+// backend and checks the expectations.
+func analyzeDistribution(responses []string, p distributionParams) *DialDistribution {
+	d := &DialDistribution{GroupBy: p.groupBy, Backends: []BackendCount{}}
+	counts := map[string]int{}
+	identified := 0
+	var run BackendCount
+	for _, response := range responses {
+		backend, ok := backendIdentity(response, p.groupBy)
+		if !ok {
+			d.Unidentified++
+			run = BackendCount{}
+			continue
+		}
+		identified++
+		counts[backend]++
+		if run.Backend == backend && run.Count > 0 {
+			run.Count++
+		} else {
+			run = BackendCount{Backend: backend, Count: 1}
+		}
+		if run.Count > d.LongestRun.Count {
+			d.LongestRun = run
+		}
+	}
+	for backend, count := range counts {
+		d.Backends = append(d.Backends, BackendCount{Backend: backend, Count: count, Share: float64(count) / float64(identified)})
+	}
+	sort.Slice(d.Backends, func(i, j int) bool {
+		if d.Backends[i].Count != d.Backends[j].Count {
+			return d.Backends[i].Count > d.Backends[j].Count
+		}
+		return d.Backends[i].Backend < d.Backends[j].Backend
+	})
+
+	// Backends expected but never seen count as observed zero times.
+	k := len(counts)
+	if p.expectBackends > k {
+		k = p.expectBackends
+	}
+	d.PValue = 1
+	if k > 1 && identified > 0 {
+		expected := float64(identified) / float64(k)
+		for _, backend := range d.Backends {
+			d.ChiSquare += math.Pow(float64(backend.Count)-expected, 2) / expected
+		}
+		d.ChiSquare += float64(k-len(counts)) * expected
+		d.PValue = chiSquareSurvival(d.ChiSquare, k-1)
+	}
+
+	if p.expectBackends > 0 {
+		d.Checks = append(d.Checks, DialCheck{
+			Name:     "backends",
+			Expected: strconv.Itoa(p.expectBackends),
+			Actual:   strconv.Itoa(len(counts)),
+			Pass:     len(counts) == p.expectBackends,
+		})
+	}
+	if p.expectAffinity {
+		d.Checks = append(d.Checks, DialCheck{
+			Name:     "affinity",
+			Expected: "1 backend",
+			Actual:   fmt.Sprintf("%d backends", len(counts)),
+			Pass:     len(counts) == 1 && d.Unidentified == 0,
+		})
+	}
+	if p.expectUniform {
+		d.Checks = append(d.Checks, DialCheck{
+			Name:     "uniform",
+			Expected: fmt.Sprintf("pValue >= %g", p.alpha),
+			Actual:   fmt.Sprintf("pValue %.4g", d.PValue),
+			Pass:     d.PValue >= p.alpha,
+		})
+	}
+	d.Pass = true
+	for _, check := range d.Checks {
+		d.Pass = d.Pass && check.Pass
+	}
+	return d
+}
+
+// chiSquareSurvival returns the probability that a chi-square variable with
+// dof degrees of freedom is at least x.
+func chiSquareSurvival(x float64, dof int) float64 {
+	if x <= 0 {
+		return 1
+	}
+	return upperRegularizedGamma(float64(dof)/2, x/2)
+}
+
+// upperRegularizedGamma returns Q(a, x), computed with its series below a+1
+// and its continued fraction above, as in Numerical Recipes.
+func upperRegularizedGamma(a, x float64) float64 {
+	const epsilon = 1e-12
+	lgamma, _ := math.Lgamma(a)
+	prefix := math.Exp(-x + a*math.Log(x) - lgamma)
+	if x < a+1 {
+		sum, term := 1/a, 1/a
+		for n := 1; n < 1000 && math.Abs(term) > math.Abs(sum)*epsilon; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+		}
+		return math.Max(0, 1-sum*prefix)
+	}
+	const tiny = 1e-300
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for i := 1; i < 1000; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < epsilon {
+			break
+		}
+	}
+	return prefix * h
+}
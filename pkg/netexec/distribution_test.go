@@ -0,0 +1,108 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"net/url"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+type distributionCase struct {
+	responses    []string
+	query        string
+	backends     []BackendCount
+	unidentified int
+	chiSquare    float64
+	pValue       float64
+	longestRun   BackendCount
+	checks       []DialCheck
+	pass         bool
+}
+
+var _ = Describe("Distribution analysis", Label("netexec"), func() {
+	// interleave returns the responses of the backends in turn, counts[i]
+	// of backends[i], until they all ran out.
+	interleave := func(backends []string, counts ...int) []string {
+		var res []string
+		for more := true; more; {
+			more = false
+			for i, backend := range backends {
+				if counts[i] > 0 {
+					res = append(res, backend)
+					counts[i]--
+					more = true
+				}
+			}
+		}
+		return res
+	}
+
+	DescribeTable("aggregates the backends and checks the expectations",
+		func(c distributionCase) {
+			query, err := url.ParseQuery(c.query)
+			Expect(err).NotTo(HaveOccurred())
+			p, err := parseDistributionParams(query)
+			Expect(err).NotTo(HaveOccurred())
+			d := analyzeDistribution(c.responses, p)
+			Expect(d.Backends).To(Equal(c.backends))
+			Expect(d.Unidentified).To(Equal(c.unidentified))
+			Expect(d.ChiSquare).To(BeNumerically("~", c.chiSquare, 1e-9))
+			Expect(d.PValue).To(BeNumerically("~", c.pValue, 1e-6))
+			Expect(d.LongestRun).To(Equal(c.longestRun))
+			Expect(d.Checks).To(Equal(c.checks))
+			Expect(d.Pass).To(Equal(c.pass))
+		},
+		Entry("60/40 over 2 backends", distributionCase{
+			responses: interleave([]string{"a", "b"}, 60, 40), query: "expectBackends=2&expectUniform=true",
+			backends:  []BackendCount{{Backend: "a", Count: 60, Share: 0.6}, {Backend: "b", Count: 40, Share: 0.4}},
+			chiSquare: 4, pValue: 0.0455003, longestRun: BackendCount{Backend: "a", Count: 20},
+			checks: []DialCheck{
+				{Name: "backends", Expected: "2", Actual: "2", Pass: true},
+				{Name: "uniform", Expected: "pValue >= 0.01", Actual: "pValue 0.0455", Pass: true},
+			},
+			pass: true}),
+		Entry("60/40 over 2 backends at a higher alpha", distributionCase{
+			responses: interleave([]string{"a", "b"}, 60, 40), query: "expectUniform=true&alpha=0.05",
+			backends:  []BackendCount{{Backend: "a", Count: 60, Share: 0.6}, {Backend: "b", Count: 40, Share: 0.4}},
+			chiSquare: 4, pValue: 0.0455003, longestRun: BackendCount{Backend: "a", Count: 20},
+			checks: []DialCheck{{Name: "uniform", Expected: "pValue >= 0.05", Actual: "pValue 0.0455", Pass: false}}}),
+		Entry("uniform over 5 backends", distributionCase{
+			responses: interleave([]string{"a", "b", "c", "d", "e"}, 22, 22, 20, 18, 18), query: "groupBy=response",
+			backends: []BackendCount{{Backend: "a", Count: 22, Share: 0.22}, {Backend: "b", Count: 22, Share: 0.22},
+				{Backend: "c", Count: 20, Share: 0.2}, {Backend: "d", Count: 18, Share: 0.18}, {Backend: "e", Count: 18, Share: 0.18}},
+			// Q(2, 0.4) = e^-0.4 * 1.4
+			chiSquare: 0.8, pValue: 0.9384481, longestRun: BackendCount{Backend: "a", Count: 1},
+			pass: true}),
+		Entry("backend expected but never seen", distributionCase{
+			responses: interleave([]string{"a", "b"}, 15, 15), query: "expectBackends=3",
+			backends: []BackendCount{{Backend: "a", Count: 15, Share: 0.5}, {Backend: "b", Count: 15, Share: 0.5}},
+			// Q(1, 7.5) = e^-7.5
+			chiSquare: 15, pValue: 0.000553084, longestRun: BackendCount{Backend: "a", Count: 1},
+			checks: []DialCheck{{Name: "backends", Expected: "3", Actual: "2", Pass: false}}}),
+		Entry("single backend", distributionCase{
+			responses: []string{"a\n", "a\n", "a\n"}, query: "expectAffinity=true&expectUniform=true",
+			backends: []BackendCount{{Backend: "a", Count: 3, Share: 1}},
+			pValue:   1, longestRun: BackendCount{Backend: "a", Count: 3},
+			checks: []DialCheck{
+				{Name: "affinity", Expected: "1 backend", Actual: "1 backends", Pass: true},
+				{Name: "uniform", Expected: "pValue >= 0.01", Actual: "pValue 1", Pass: true},
+			},
+			pass: true}),
+		Entry("no responses", distributionCase{
+			query: "expectBackends=2&expectAffinity=true", backends: []BackendCount{}, pValue: 1,
+			checks: []DialCheck{
+				{Name: "backends", Expected: "2", Actual: "0", Pass: false},
+				{Name: "affinity", Expected: "1 backend", Actual: "0 backends", Pass: false},
+			}}),
+		Entry("dotted JSON field", distributionCase{
+			responses: []string{`{"pod": {"name": "a"}}`, `{"pod": {"name": "a"}}`, `not JSON`, `{"pod": {"name": "a"}}`,
+				`{"pod": {"ip": "192.0.2.1"}}`, `{"pod": "b"}`, `{"pod": {"name": 2}}`},
+			query:        "groupBy=pod.name&expectAffinity=true",
+			backends:     []BackendCount{{Backend: "a", Count: 3, Share: 0.75}, {Backend: "2", Count: 1, Share: 0.25}},
+			unidentified: 3, chiSquare: 1, pValue: 0.3173105, longestRun: BackendCount{Backend: "a", Count: 2},
+			checks: []DialCheck{{Name: "affinity", Expected: "1 backend", Actual: "2 backends", Pass: false}}}),
+	)
+})
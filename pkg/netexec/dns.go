@@ -0,0 +1,386 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hostsPath = "/etc/hosts"
+	// maxNdots is the largest ndots value the resolver honors.
+	maxNdots = 15
+)
+
+var dnsTypes = map[string]uint16{"A": 1, "AAAA": 28}
+
+var dnsRcodeNames = []string{"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED"}
+
+// DNSResult is the JSON answer of /dns.
+type DNSResult struct {
+	Name       string      `json:"name"`
+	Type       string      `json:"type"`
+	ResolvConf *ResolvConf `json:"resolvConf"`
+	Ndots      int         `json:"ndots"`
+	// Hosts are the addresses /etc/hosts has for the name, which the
+	// resolver returns without asking any nameserver.
+	Hosts []string `json:"hosts"`
+	// Candidates are the names the resolver tries, in order.
+	Candidates []DNSCandidate `json:"candidates"`
+	// MatchedName is the candidate the resolver stops at, the first whose
+	// decisive answer has addresses, and MatchedSuffix the search domain it
+	// was built from, if any.
+	MatchedName   string   `json:"matchedName,omitempty"`
+	MatchedSuffix string   `json:"matchedSuffix,omitempty"`
+	Answers       []string `json:"answers"`
+}
+
+// DNSCandidate is a fully qualified name the resolver tries, asked to every
+// nameserver.
+type DNSCandidate struct {
+	Name    string     `json:"name"`
+	Suffix  string     `json:"suffix,omitempty"`
+	Queries []DNSQuery `json:"queries"`
+	// DecidedBy is the nameserver whose answer the resolver keeps for the
+	// candidate, see decisiveQuery, if any.
+	DecidedBy string `json:"decidedBy,omitempty"`
+}
+
+// DNSQuery is the answer of one nameserver for one candidate.
+type DNSQuery struct {
+	Nameserver string `json:"nameserver"`
+	RTT        string `json:"rtt,omitempty"`
+	// Rcode is the response code, e.g. "NOERROR" or "NXDOMAIN". A NOERROR
+	// without answers means the name exists but has no record of the type.
+	Rcode     string   `json:"rcode,omitempty"`
+	Answers   []string `json:"answers,omitempty"`
+	Truncated bool     `json:"truncated,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// option returns the integer value of a "name:value" option, or def.
+func (c *ResolvConf) option(name string, def int) int {
+	value := def
+	for _, option := range c.Options {
+		if key, v, ok := strings.Cut(option, ":"); ok && key == name {
+			if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+				value = n
+			}
+		}
+	}
+	return value
+}
+
+// dnsCandidates returns the names the resolver tries for name, in order, with
+// the search domain each one was built from: the name itself first if it has
+// at least ndots dots, last otherwise, and alone if it ends with a dot.
+func dnsCandidates(name string, search []string, ndots int) []DNSCandidate {
+	if strings.HasSuffix(name, ".") {
+		return []DNSCandidate{{Name: name}}
+	}
+	var candidates []DNSCandidate
+	for _, suffix := range search {
+		candidates = append(candidates, DNSCandidate{Name: name + "." + strings.TrimSuffix(suffix, ".") + ".", Suffix: suffix})
+	}
+	absolute := DNSCandidate{Name: name + "."}
+	if strings.Count(name, ".") >= ndots {
+		return append([]DNSCandidate{absolute}, candidates...)
+	}
+	return append(candidates, absolute)
+}
+
+// lookupHosts returns the addresses of a hosts file for name.
+func lookupHosts(path, name string, qtype uint16) []string {
+	addresses := []string{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return addresses
+	}
+	name = strings.TrimSuffix(name, ".")
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || (ip.To4() != nil) != (qtype == dnsTypes["A"]) {
+			continue
+		}
+		for _, alias := range fields[1:] {
+			if strings.EqualFold(alias, name) {
+				addresses = append(addresses, ip.String())
+				break
+			}
+		}
+	}
+	return addresses
+}
+
+// dnsHandler resolves "name" like the resolver of the server would, and
+// explains how: the candidates built from the search list, the answer of
+// every nameserver for each of them, and whether /etc/hosts answered.
+func dnsHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	qtypeName := strings.ToUpper(r.FormValue("type"))
+	log.Printf("GET /dns?name=%s&type=%s", name, qtypeName)
+	if name == "" {
+		http.Error(w, "name parameter not specified.", http.StatusBadRequest)
+		return
+	}
+	if qtypeName == "" {
+		qtypeName = "A"
+	}
+	qtype, ok := dnsTypes[qtypeName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unsupported type. %s, acceptable values: A, AAAA", qtypeName), http.StatusBadRequest)
+		return
+	}
+	conf, err := readResolvConf(resolvConfPath)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read %s. %v", resolvConfPath, err), http.StatusInternalServerError)
+		return
+	}
+	timeout := time.Duration(conf.option("timeout", 5)) * time.Second
+	if timeoutParam := r.FormValue("timeout"); timeoutParam != "" {
+		if timeout, err = time.ParseDuration(timeoutParam); err != nil || timeout <= 0 || timeout > time.Minute {
+			http.Error(w, fmt.Sprintf("timeout parameter must be a positive golang duration up to 1m, got %q", timeoutParam), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ndots := conf.option("ndots", 1)
+	if ndots > maxNdots {
+		ndots = maxNdots
+	}
+	result := DNSResult{
+		Name:       name,
+		Type:       qtypeName,
+		ResolvConf: conf,
+		Ndots:      ndots,
+		Hosts:      lookupHosts(hostsPath, name, qtype),
+		Candidates: dnsCandidates(name, conf.Search, ndots),
+		Answers:    []string{},
+	}
+	var wg sync.WaitGroup
+	for i := range result.Candidates {
+		candidate := &result.Candidates[i]
+		candidate.Queries = make([]DNSQuery, len(conf.Nameservers))
+		for j, nameserver := range conf.Nameservers {
+			wg.Add(1)
+			go func(query *DNSQuery, nameserver string) {
+				defer wg.Done()
+				*query = queryDNS(nameserver, candidate.Name, qtype, timeout)
+			}(&candidate.Queries[j], nameserver)
+		}
+	}
+	wg.Wait()
+	result.match()
+	writeJSON(w, http.StatusOK, result)
+}
+
+// match finds the candidate the resolver stops at, and the answers it
+// returns, from the answers of every nameserver.
+func (r *DNSResult) match() {
+	if len(r.Hosts) > 0 {
+		r.Answers = r.Hosts
+	}
+	for i := range r.Candidates {
+		candidate := &r.Candidates[i]
+		query, ok := decisiveQuery(candidate)
+		if !ok {
+			continue
+		}
+		candidate.DecidedBy = query.Nameserver
+		if hasAddress(query.Answers) && r.MatchedName == "" {
+			r.MatchedName = candidate.Name
+			r.MatchedSuffix = candidate.Suffix
+			if len(r.Hosts) == 0 {
+				r.Answers = query.Answers
+			}
+		}
+	}
+}
+
+// decisiveQuery returns the answer the resolver keeps for candidate: it asks
+// the nameservers in order, and the first one answering NOERROR or NXDOMAIN
+// settles the candidate, even without addresses. Failures and the other
+// response codes, e.g. SERVFAIL or REFUSED, make it ask the next one. With
+// the "rotate" option the resolver starts with another nameserver at every
+// query, which this does not follow.
+func decisiveQuery(candidate *DNSCandidate) (DNSQuery, bool) {
+	for _, query := range candidate.Queries {
+		if query.Error == "" && (query.Rcode == "NOERROR" || query.Rcode == "NXDOMAIN") {
+			return query, true
+		}
+	}
+	return DNSQuery{}, false
+}
+
+// hasAddress tells whether answers resolve the name: a CNAME alone does not.
+func hasAddress(answers []string) bool {
+	for _, answer := range answers {
+		if !strings.HasPrefix(answer, "CNAME ") {
+			return true
+		}
+	}
+	return false
+}
+
+// queryDNS asks nameserver for the records of type qtype of the fully
+// qualified name, over UDP.
+func queryDNS(nameserver, name string, qtype uint16, timeout time.Duration) DNSQuery {
+	query := DNSQuery{Nameserver: nameserver}
+	id := uint16(rand.Intn(1 << 16))
+	msg, err := dnsQueryMessage(id, name, qtype)
+	if err != nil {
+		query.Error = err.Error()
+		return query
+	}
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(nameserver, "53"), timeout)
+	if err != nil {
+		query.Error = fmt.Sprintf("dial failed. err:%v", err)
+		return query
+	}
+	defer conn.Close()
+	start := time.Now()
+	_ = conn.SetDeadline(start.Add(timeout))
+	if _, err := conn.Write(msg); err != nil {
+		query.Error = fmt.Sprintf("write failed. err:%v", err)
+		return query
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			query.Error = fmt.Sprintf("read failed. err:%v", err)
+			return query
+		}
+		if n < 2 || binary.BigEndian.Uint16(buf) != id {
+			// A late answer to another query.
+			continue
+		}
+		query.RTT = time.Since(start).String()
+		rcode, truncated, answers, err := parseDNSResponse(buf[:n], qtype)
+		query.Rcode, query.Truncated, query.Answers = rcode, truncated, answers
+		if err != nil {
+			query.Error = err.Error()
+		}
+		return query
+	}
+}
+
+// dnsQueryMessage builds a recursive query for name.
+func dnsQueryMessage(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)      // one question
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1) // class IN
+	return msg, nil
+}
+
+// parseDNSResponse returns the response code of a DNS response, whether it was
+// truncated, and its answers: the addresses of type qtype and the CNAMEs.
+func parseDNSResponse(msg []byte, qtype uint16) (string, bool, []string, error) {
+	if len(msg) < 12 {
+		return "", false, nil, errors.New("short DNS response")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	rcode := strconv.Itoa(int(flags & 0xf))
+	if int(flags&0xf) < len(dnsRcodeNames) {
+		rcode = dnsRcodeNames[flags&0xf]
+	}
+	truncated := flags&0x0200 != 0
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	records := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	var err error
+	for i := 0; i < questions; i++ {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return rcode, truncated, nil, err
+		}
+		off += 4
+	}
+	var answers []string
+	for i := 0; i < records; i++ {
+		if _, off, err = readDNSName(msg, off); err != nil {
+			return rcode, truncated, answers, err
+		}
+		if off+10 > len(msg) {
+			return rcode, truncated, answers, errors.New("short DNS record")
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return rcode, truncated, answers, errors.New("short DNS record")
+		}
+		switch {
+		case rtype == qtype && (length == net.IPv4len || length == net.IPv6len):
+			answers = append(answers, net.IP(msg[off:off+length]).String())
+		case rtype == 5: // CNAME
+			if cname, _, err := readDNSName(msg, off); err == nil {
+				answers = append(answers, "CNAME "+cname)
+			}
+		}
+		off += length
+	}
+	return rcode, truncated, answers, nil
+}
+
+// readDNSName reads the possibly compressed name at off, and returns it with
+// the offset following it.
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("short DNS name")
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errors.New("invalid DNS name compression")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+length > len(msg) {
+				return "", 0, errors.New("short DNS name")
+			}
+			labels = append(labels, string(msg[off+1:off+1+length]))
+			off += 1 + length
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("DNS resolution", Label("netexec"), func() {
+	// candidates answers two candidates, of the search domain and absolute,
+	// with the queries of two nameservers each.
+	candidates := func(search, absolute [2]DNSQuery) []DNSCandidate {
+		for i, server := range []string{"10.0.0.10", "10.0.0.11"} {
+			search[i].Nameserver, absolute[i].Nameserver = server, server
+		}
+		return []DNSCandidate{
+			{Name: "db.svc.cluster.local.", Suffix: "svc.cluster.local", Queries: search[:]},
+			{Name: "db.", Queries: absolute[:]},
+		}
+	}
+	nxdomain := DNSQuery{Rcode: "NXDOMAIN"}
+	servfail := DNSQuery{Rcode: "SERVFAIL"}
+	timeout := DNSQuery{Error: "read failed. err:i/o timeout"}
+	noData := DNSQuery{Rcode: "NOERROR"}
+	cname := DNSQuery{Rcode: "NOERROR", Answers: []string{"CNAME db.example.com."}}
+	found := func(address string) DNSQuery {
+		return DNSQuery{Rcode: "NOERROR", Answers: []string{address}}
+	}
+
+	DescribeTable("stops at the candidate the resolver would",
+		func(hosts []string, search, absolute [2]DNSQuery, matchedName string, decidedBy []string, answers []string) {
+			result := &DNSResult{Hosts: hosts, Candidates: candidates(search, absolute), Answers: []string{}}
+			result.match()
+			Expect(result.MatchedName).To(Equal(matchedName))
+			Expect([]string{result.Candidates[0].DecidedBy, result.Candidates[1].DecidedBy}).To(Equal(decidedBy))
+			Expect(result.Answers).To(Equal(answers))
+		},
+		Entry("first candidate found", []string{},
+			[2]DNSQuery{found("192.0.2.1"), found("192.0.2.2")}, [2]DNSQuery{found("192.0.2.3"), found("192.0.2.3")},
+			"db.svc.cluster.local.", []string{"10.0.0.10", "10.0.0.10"}, []string{"192.0.2.1"}),
+		Entry("failing nameserver skipped", []string{},
+			[2]DNSQuery{servfail, found("192.0.2.2")}, [2]DNSQuery{timeout, found("192.0.2.3")},
+			"db.svc.cluster.local.", []string{"10.0.0.11", "10.0.0.11"}, []string{"192.0.2.2"}),
+		Entry("NXDOMAIN settles the candidate", []string{},
+			[2]DNSQuery{nxdomain, found("192.0.2.2")}, [2]DNSQuery{found("192.0.2.3"), nxdomain},
+			"db.", []string{"10.0.0.10", "10.0.0.10"}, []string{"192.0.2.3"}),
+		Entry("NOERROR without addresses settles the candidate", []string{},
+			[2]DNSQuery{cname, found("192.0.2.2")}, [2]DNSQuery{noData, found("192.0.2.3")},
+			"", []string{"10.0.0.10", "10.0.0.10"}, []string{}),
+		Entry("every nameserver failing", []string{},
+			[2]DNSQuery{servfail, timeout}, [2]DNSQuery{timeout, found("192.0.2.3")},
+			"db.", []string{"", "10.0.0.11"}, []string{"192.0.2.3"}),
+		Entry("hosts file answers first", []string{"127.0.0.1"},
+			[2]DNSQuery{found("192.0.2.1"), found("192.0.2.2")}, [2]DNSQuery{nxdomain, nxdomain},
+			"db.svc.cluster.local.", []string{"10.0.0.10", "10.0.0.10"}, []string{"127.0.0.1"}),
+	)
+})
@@ -0,0 +1,384 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	netutils "k8s.io/utils/net"
+)
+
+// defaultFaultTTL is the lifetime of a fault rule that does not set "ttl", so
+// that a forgotten rule cannot break the server forever.
+const defaultFaultTTL = 10 * time.Minute
+
+// FaultRule, managed with /fault, injects errors, latency, dropped UDP
+// replies or closed connections into the responses it matches. Empty scope
+// fields match everything; rules scoped by path or header never match UDP, TCP
+// and SCTP commands.
+type FaultRule struct {
+	ID           int           `json:"id"`
+	Path         string        `json:"path,omitempty"`
+	ClientCIDR   string        `json:"clientCIDR,omitempty"`
+	HeaderName   string        `json:"headerName,omitempty"`
+	HeaderValue  string        `json:"headerValue,omitempty"`
+	ErrorPercent float64       `json:"errorPercent,omitempty"`
+	ErrorCode    int           `json:"errorCode,omitempty"`
+	Latency      *FaultLatency `json:"latency,omitempty"`
+	DropPercent  float64       `json:"dropPercent,omitempty"`
+	ClosePercent float64       `json:"closePercent,omitempty"`
+	TTL          string        `json:"ttl,omitempty"`
+	ExpiresAt    time.Time     `json:"expiresAt"`
+	Hits         uint64        `json:"hits"`
+
+	cidr *net.IPNet
+}
+
+// FaultLatency describes the latency added by a fault rule. "fixed" and
+// "exponential" use Mean, "uniform" uses Min and Max, "normal" uses Mean and
+// Stddev.
+type FaultLatency struct {
+	Percent      float64 `json:"percent,omitempty"`
+	Distribution string  `json:"distribution,omitempty"`
+	Mean         string  `json:"mean,omitempty"`
+	Min          string  `json:"min,omitempty"`
+	Max          string  `json:"max,omitempty"`
+	Stddev       string  `json:"stddev,omitempty"`
+
+	mean, min, max, stddev time.Duration
+}
+
+// faultAction is what a matching rule decided to do with one response.
+type faultAction struct {
+	rule      int
+	delay     time.Duration
+	errorCode int
+	drop      bool
+	close     bool
+}
+
+// faultStore holds the active fault rules, in the order they were added.
+type faultStore struct {
+	mu     sync.Mutex
+	nextID int
+	rules  []*FaultRule
+	rand   *rand.Rand
+}
+
+func newFaultStore() *faultStore {
+	return &faultStore{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func validPercent(name string, value float64) error {
+	if value < 0 || value > 100 {
+		return fmt.Errorf("%s must be between 0 and 100, got %v", name, value)
+	}
+	return nil
+}
+
+func parseOptionalDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative golang duration, got %q", name, value)
+	}
+	return d, nil
+}
+
+// validate checks the rule and fills in its parsed fields and defaults.
+func (f *FaultRule) validate() error {
+	var err error
+	if f.ClientCIDR != "" {
+		if _, f.cidr, err = netutils.ParseCIDRSloppy(f.ClientCIDR); err != nil {
+			return fmt.Errorf("clientCIDR is invalid: %v", err)
+		}
+	}
+	if f.HeaderName == "" && f.HeaderValue != "" {
+		return fmt.Errorf("headerValue requires headerName")
+	}
+	for name, value := range map[string]float64{"errorPercent": f.ErrorPercent, "dropPercent": f.DropPercent, "closePercent": f.ClosePercent} {
+		if err := validPercent(name, value); err != nil {
+			return err
+		}
+	}
+	if f.ErrorPercent > 0 && f.ErrorCode == 0 {
+		f.ErrorCode = http.StatusServiceUnavailable
+	}
+	if f.ErrorCode != 0 && (f.ErrorCode < 100 || f.ErrorCode > 599) {
+		return fmt.Errorf("errorCode must be a valid HTTP status code, got %d", f.ErrorCode)
+	}
+	if f.Latency != nil {
+		if err := f.Latency.validate(); err != nil {
+			return err
+		}
+	}
+	if f.ErrorPercent == 0 && f.DropPercent == 0 && f.ClosePercent == 0 && f.Latency == nil {
+		return fmt.Errorf("rule has no effect, set at least one of errorPercent, dropPercent, closePercent or latency")
+	}
+	ttl := defaultFaultTTL
+	if f.TTL != "" {
+		if ttl, err = time.ParseDuration(f.TTL); err != nil || ttl <= 0 {
+			return fmt.Errorf("ttl must be a positive golang duration, got %q", f.TTL)
+		}
+	}
+	f.ExpiresAt = time.Now().Add(ttl)
+	return nil
+}
+
+func (l *FaultLatency) validate() error {
+	var err error
+	if l.Percent == 0 {
+		l.Percent = 100
+	}
+	if err = validPercent("latency.percent", l.Percent); err != nil {
+		return err
+	}
+	if l.mean, err = parseOptionalDuration("latency.mean", l.Mean); err != nil {
+		return err
+	}
+	if l.min, err = parseOptionalDuration("latency.min", l.Min); err != nil {
+		return err
+	}
+	if l.max, err = parseOptionalDuration("latency.max", l.Max); err != nil {
+		return err
+	}
+	if l.stddev, err = parseOptionalDuration("latency.stddev", l.Stddev); err != nil {
+		return err
+	}
+	switch l.Distribution {
+	case "", "fixed", "exponential", "normal":
+		if l.mean == 0 {
+			return fmt.Errorf("latency.mean is required for the %q distribution", l.Distribution)
+		}
+	case "uniform":
+		if l.max == 0 || l.max < l.min {
+			return fmt.Errorf("latency.max must be set and not smaller than latency.min")
+		}
+	default:
+		return fmt.Errorf("unsupported latency distribution %q, acceptable values: fixed, uniform, normal, exponential", l.Distribution)
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to the given request. path and
+// header are empty for UDP, TCP and SCTP commands.
+func (f *FaultRule) matches(path string, ip net.IP, header http.Header) bool {
+	if f.Path != "" && !strings.HasPrefix(path, f.Path) {
+		return false
+	}
+	if f.cidr != nil && (ip == nil || !f.cidr.Contains(ip)) {
+		return false
+	}
+	if f.HeaderName != "" {
+		values, ok := header[http.CanonicalHeaderKey(f.HeaderName)]
+		if !ok {
+			return false
+		}
+		if f.HeaderValue != "" && !sets.NewString(values...).Has(f.HeaderValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// add numbers and stores rule, which then belongs to the store, and returns
+// a snapshot of it.
+func (s *faultStore) add(rule *FaultRule) FaultRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	rule.ID = s.nextID
+	s.rules = append(s.rules, rule)
+	return *rule
+}
+
+// list returns a snapshot of the rules that have not expired yet.
+func (s *faultStore) list() []FaultRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	res := make([]FaultRule, 0, len(s.rules))
+	for _, rule := range s.rules {
+		res = append(res, *rule)
+	}
+	return res
+}
+
+// clear removes the rule with the given id, or every rule if id is 0. It
+// returns the number of removed rules.
+func (s *faultStore) clear(id int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.rules[:0]
+	for _, rule := range s.rules {
+		if id != 0 && rule.ID != id {
+			kept = append(kept, rule)
+		}
+	}
+	removed := len(s.rules) - len(kept)
+	s.rules = kept
+	return removed
+}
+
+func (s *faultStore) pruneLocked() {
+	now := time.Now()
+	kept := s.rules[:0]
+	for _, rule := range s.rules {
+		if now.Before(rule.ExpiresAt) {
+			kept = append(kept, rule)
+		} else {
+			log.Printf("Fault rule %d expired", rule.ID)
+		}
+	}
+	s.rules = kept
+}
+
+// decide rolls the probabilities of the rules matching the request, in
+// order, until one of them fires. It returns false if none did and the
+// response should not be affected.
+func (s *faultStore) decide(protocol, path string, ip net.IP, header http.Header) (faultAction, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	for _, rule := range s.rules {
+		if (protocol != "http" && (rule.Path != "" || rule.HeaderName != "")) || !rule.matches(path, ip, header) {
+			continue
+		}
+		action := faultAction{rule: rule.ID}
+		if rule.Latency != nil && s.roll(rule.Latency.Percent) {
+			action.delay = s.sampleLatency(rule.Latency)
+		}
+		switch protocol {
+		case "http":
+			if s.roll(rule.ClosePercent) {
+				action.close = true
+			} else if s.roll(rule.ErrorPercent) {
+				action.errorCode = rule.ErrorCode
+			}
+		case "udp":
+			action.drop = s.roll(rule.DropPercent)
+		case "sctp":
+			action.close = s.roll(rule.ClosePercent) || s.roll(rule.DropPercent)
+		case "tcp":
+			action.close = s.roll(rule.ClosePercent)
+		}
+		if action.delay == 0 && action.errorCode == 0 && !action.drop && !action.close {
+			continue
+		}
+		rule.Hits++
+		return action, true
+	}
+	return faultAction{}, false
+}
+
+func (s *faultStore) roll(percent float64) bool {
+	return percent > 0 && s.rand.Float64()*100 < percent
+}
+
+func (s *faultStore) sampleLatency(l *FaultLatency) time.Duration {
+	var d time.Duration
+	switch l.Distribution {
+	case "", "fixed":
+		d = l.mean
+	case "uniform":
+		d = l.min + time.Duration(s.rand.Int63n(int64(l.max-l.min)+1))
+	case "normal":
+		d = l.mean + time.Duration(s.rand.NormFloat64()*float64(l.stddev))
+	case "exponential":
+		d = time.Duration(s.rand.ExpFloat64() * float64(l.mean))
+	}
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// faultMiddleware applies the fault rules to every HTTP request except the
+// ones managing the rules themselves.
+func (s *Server) faultMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fault" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		action, faulted := s.faults.decide("http", r.URL.Path, remoteIP(r.RemoteAddr), r.Header)
+		if !faulted {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rule := strconv.Itoa(action.rule)
+		w.Header().Set("X-Netexec-Fault", rule)
+		if action.delay > 0 {
+			log.Printf("Fault rule %s: delaying %s %s from %s by %v", rule, r.Method, r.URL.Path, r.RemoteAddr, action.delay)
+			s.faultsInjected.inc(rule, "http", "latency")
+			time.Sleep(action.delay)
+		}
+		if action.close {
+			log.Printf("Fault rule %s: closing connection of %s %s from %s", rule, r.Method, r.URL.Path, r.RemoteAddr)
+			s.faultsInjected.inc(rule, "http", "close")
+			// Aborting the handler makes the server drop the connection
+			// (or reset the stream for HTTP/2) without writing a response.
+			panic(http.ErrAbortHandler)
+		}
+		if action.errorCode != 0 {
+			log.Printf("Fault rule %s: answering %s %s from %s with %d", rule, r.Method, r.URL.Path, r.RemoteAddr, action.errorCode)
+			s.faultsInjected.inc(rule, "http", "error")
+			http.Error(w, fmt.Sprintf("fault injected by rule %s", rule), action.errorCode)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// faultHandler lists (GET), adds (POST) and clears (DELETE) fault rules.
+func (s *Server) faultHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s /fault", r.Method)
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.faults.list())
+	case http.MethodPost:
+		rule := &FaultRule{}
+		if err := json.NewDecoder(r.Body).Decode(rule); err != nil {
+			http.Error(w, fmt.Sprintf("fault rule could not be decoded. %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := rule.validate(); err != nil {
+			http.Error(w, fmt.Sprintf("fault rule is invalid. %v", err), http.StatusBadRequest)
+			return
+		}
+		added := s.faults.add(rule)
+		log.Printf("Added fault rule %d: %+v", added.ID, added)
+		writeJSON(w, http.StatusCreated, added)
+	case http.MethodDelete:
+		id := 0
+		if idString := r.FormValue("id"); idString != "" {
+			var err error
+			if id, err = strconv.Atoi(idString); err != nil || id <= 0 {
+				http.Error(w, fmt.Sprintf("argument 'id' must be a positive integer or empty, got %q", idString), http.StatusBadRequest)
+				return
+			}
+		}
+		removed := s.faults.clear(id)
+		log.Printf("Removed %d fault rules", removed)
+		if id != 0 && removed == 0 {
+			http.Error(w, fmt.Sprintf("fault rule %d not found", id), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+	default:
+		http.Error(w, fmt.Sprintf("method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// grpcEchoServiceName is the gRPC service started by --grpc-port.
+const grpcEchoServiceName = "netexec.Echo"
+
+// grpcEchoFile describes the netexec.Echo service and its messages. It is
+// built by hand instead of being generated by protoc, and registered globally
+// so that server reflection can describe the service to clients.
+var grpcEchoFile = func() protoreflect.FileDescriptor {
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	stringType := descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()
+	int32Type := descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum()
+	field := func(name string, number int32, t *descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{Name: proto.String(name), JsonName: proto.String(name), Number: proto.Int32(number), Label: optional, Type: t}
+	}
+	method := func(name string, clientStreaming, serverStreaming bool) *descriptorpb.MethodDescriptorProto {
+		return &descriptorpb.MethodDescriptorProto{
+			Name:            proto.String(name),
+			InputType:       proto.String(".netexec.EchoRequest"),
+			OutputType:      proto.String(".netexec.EchoResponse"),
+			ClientStreaming: proto.Bool(clientStreaming),
+			ServerStreaming: proto.Bool(serverStreaming),
+		}
+	}
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("netexec/echo.proto"),
+		Package: proto.String("netexec"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("EchoRequest"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("message", 1, stringType),
+				field("count", 2, int32Type),
+				field("interval_ms", 3, int32Type),
+			},
+		}, {
+			Name: proto.String("EchoResponse"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("message", 1, stringType),
+				field("hostname", 2, stringType),
+				field("peer", 3, stringType),
+				field("sequence", 4, int32Type),
+			},
+		}},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Echo"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				method("Echo", false, false),
+				method("ServerStream", false, true),
+				method("ClientStream", true, false),
+				method("BidiStream", true, true),
+			},
+		}},
+	}, protoregistry.GlobalFiles)
+	if err != nil {
+		panic(fmt.Sprintf("failed to build the gRPC echo descriptor: %v", err))
+	}
+	if err := protoregistry.GlobalFiles.RegisterFile(file); err != nil {
+		panic(fmt.Sprintf("failed to register the gRPC echo descriptor: %v", err))
+	}
+	return file
+}()
+
+var (
+	echoRequestDesc  = grpcEchoFile.Messages().ByName("EchoRequest")
+	echoResponseDesc = grpcEchoFile.Messages().ByName("EchoResponse")
+)
+
+var grpcEchoServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcEchoServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Echo", Handler: grpcEchoHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "ServerStream", Handler: grpcServerStreamHandler, ServerStreams: true},
+		{StreamName: "ClientStream", Handler: grpcClientStreamHandler, ClientStreams: true},
+		{StreamName: "BidiStream", Handler: grpcBidiStreamHandler, ServerStreams: true, ClientStreams: true},
+	},
+	Metadata: grpcEchoFile.Path(),
+}
+
+func newEchoResponse(srv interface{}, ctx context.Context, message string, sequence int32) *dynamicpb.Message {
+	clientAddress := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		clientAddress = p.Addr.String()
+	}
+	resp := dynamicpb.NewMessage(echoResponseDesc)
+	fields := echoResponseDesc.Fields()
+	resp.Set(fields.ByName("message"), protoreflect.ValueOfString(message))
+	resp.Set(fields.ByName("hostname"), protoreflect.ValueOfString(srv.(*Server).hostname))
+	resp.Set(fields.ByName("peer"), protoreflect.ValueOfString(clientAddress))
+	resp.Set(fields.ByName("sequence"), protoreflect.ValueOfInt32(sequence))
+	return resp
+}
+
+func echoRequestString(req *dynamicpb.Message, name protoreflect.Name) string {
+	return req.Get(echoRequestDesc.Fields().ByName(name)).String()
+}
+
+func echoRequestInt(req *dynamicpb.Message, name protoreflect.Name) int32 {
+	return int32(req.Get(echoRequestDesc.Fields().ByName(name)).Int())
+}
+
+func echoResponseString(resp *dynamicpb.Message, name protoreflect.Name) string {
+	return resp.Get(echoResponseDesc.Fields().ByName(name)).String()
+}
+
+// grpcEchoHandler answers Echo with the request's message.
+func grpcEchoHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	req := dynamicpb.NewMessage(echoRequestDesc)
+	if err := dec(req); err != nil {
+		return nil, err
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		message := echoRequestString(req.(*dynamicpb.Message), "message")
+		log.Printf("Echoing %v to gRPC client", message)
+		return newEchoResponse(srv, ctx, message, 1), nil
+	}
+	if interceptor == nil {
+		return handler(ctx, req)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcEchoServiceName + "/Echo"}
+	return interceptor(ctx, req, info, handler)
+}
+
+// grpcServerStreamHandler answers ServerStream with "count" echoes of the
+// request's message, "interval_ms" apart, until the client goes away.
+func grpcServerStreamHandler(srv interface{}, stream grpc.ServerStream) error {
+	req := dynamicpb.NewMessage(echoRequestDesc)
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	message := echoRequestString(req, "message")
+	count := echoRequestInt(req, "count")
+	if count <= 0 {
+		count = 1
+	}
+	interval := time.Duration(echoRequestInt(req, "interval_ms")) * time.Millisecond
+	log.Printf("Streaming %d echoes of %v to gRPC client", count, message)
+	for i := int32(1); i <= count; i++ {
+		if i > 1 && !sleepContext(stream.Context(), interval) {
+			return status.FromContextError(stream.Context().Err()).Err()
+		}
+		if err := stream.SendMsg(newEchoResponse(srv, stream.Context(), message, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grpcClientStreamHandler answers ClientStream with the messages of every
+// request, space separated, once the client closes its stream.
+func grpcClientStreamHandler(srv interface{}, stream grpc.ServerStream) error {
+	var messages []string
+	for {
+		req := dynamicpb.NewMessage(echoRequestDesc)
+		if err := stream.RecvMsg(req); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		messages = append(messages, echoRequestString(req, "message"))
+	}
+	log.Printf("Echoing %d collected messages to gRPC client", len(messages))
+	return stream.SendMsg(newEchoResponse(srv, stream.Context(), strings.Join(messages, " "), int32(len(messages))))
+}
+
+// grpcBidiStreamHandler answers every BidiStream request with its message.
+func grpcBidiStreamHandler(srv interface{}, stream grpc.ServerStream) error {
+	for sequence := int32(1); ; sequence++ {
+		req := dynamicpb.NewMessage(echoRequestDesc)
+		if err := stream.RecvMsg(req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(newEchoResponse(srv, stream.Context(), echoRequestString(req, "message"), sequence)); err != nil {
+			return err
+		}
+	}
+}
+
+// dialGRPC calls netexec.Echo/Echo with the request as message. Like the UDP
+// commands, "hostname" and "clientip" return the server's hostname and the
+// address it saw, and "echo <msg>" returns <msg>.
+func dialGRPC(ctx context.Context, request string, addr net.Addr) (string, error) {
+	policy := dialPolicyFromContext(ctx)
+	ctx, cancel := context.WithTimeout(injectGRPCMetadata(ctx), policy.connectTimeout+policy.readTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr.String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return "", fmt.Errorf("grpc dial failed. err:%w", err)
+	}
+	defer conn.Close()
+
+	req := dynamicpb.NewMessage(echoRequestDesc)
+	req.Set(echoRequestDesc.Fields().ByName("message"), protoreflect.ValueOfString(request))
+	resp := dynamicpb.NewMessage(echoResponseDesc)
+	if err := conn.Invoke(ctx, "/"+grpcEchoServiceName+"/Echo", req, resp); err != nil {
+		return "", fmt.Errorf("grpc call failed. err:%w", err)
+	}
+	switch {
+	case request == "hostname":
+		return echoResponseString(resp, "hostname"), nil
+	case request == "clientip":
+		return echoResponseString(resp, "peer"), nil
+	default:
+		return strings.TrimPrefix(echoResponseString(resp, "message"), "echo "), nil
+	}
+}
@@ -0,0 +1,351 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxHTTPBinBytes and maxHTTPBinDelay are the limits of httpbin.org.
+	maxHTTPBinBytes = 100 * 1024
+	maxHTTPBinDelay = 10 * time.Second
+	// hostnameHeader tells which server answered an httpbin request.
+	hostnameHeader = "X-Netexec-Hostname"
+)
+
+// httpbin serves the httpbin.org endpoints that test suites use the most,
+// with the same JSON answers, under prefix.
+type httpbin struct {
+	prefix   string
+	hostname string
+}
+
+// addHTTPBinRoutes mounts the httpbin endpoints under the configured prefix,
+// unless it is empty.
+func (s *Server) addHTTPBinRoutes(mux *http.ServeMux) {
+	if s.config.HTTP.HTTPBinPrefix == "" {
+		return
+	}
+	h := &httpbin{prefix: strings.TrimSuffix(s.config.HTTP.HTTPBinPrefix, "/"), hostname: s.hostname}
+	for pattern, handler := range map[string]http.HandlerFunc{
+		"/anything":         h.anything,
+		"/anything/":        h.anything,
+		"/basic-auth/":      h.basicAuth,
+		"/bytes/":           h.bytes,
+		"/cookies":          h.cookies,
+		"/cookies/delete":   h.deleteCookies,
+		"/cookies/set":      h.setCookies,
+		"/delay/":           h.delay,
+		"/gzip":             h.gzip,
+		"/headers":          h.headers,
+		"/ip":               h.ip,
+		"/response-headers": h.responseHeaders,
+		"/status/":          h.status,
+	} {
+		mux.Handle(h.prefix+pattern, http.StripPrefix(h.prefix, h.identify(handler)))
+	}
+}
+
+// identify logs the request and tells which server answered it.
+func (h *httpbin) identify(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s%s", r.Method, h.prefix, r.URL.Path)
+		w.Header().Set(hostnameHeader, h.hostname)
+		next(w, r)
+	}
+}
+
+// flatten turns single values into strings, the way httpbin.org answers
+// arguments, forms and headers.
+func flatten(values map[string][]string) map[string]interface{} {
+	res := map[string]interface{}{}
+	for key, v := range values {
+		if len(v) == 1 {
+			res[key] = v[0]
+		} else {
+			res[key] = v
+		}
+	}
+	return res
+}
+
+func (h *httpbin) requestHeaders(r *http.Request) map[string]string {
+	res := map[string]string{"Host": r.Host}
+	for key, values := range r.Header {
+		res[key] = strings.Join(values, ",")
+	}
+	return res
+}
+
+func (h *httpbin) origin(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return forwarded
+	}
+	if ip := remoteIP(r.RemoteAddr); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// url rebuilds the URL of the request, prefix included.
+func (h *httpbin) url(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	u := url.URL{Scheme: scheme, Host: r.Host, Path: h.prefix + r.URL.Path, RawQuery: r.URL.RawQuery}
+	return u.String()
+}
+
+// request describes r like /anything, reading its body as a form, files or
+// JSON depending on its content type.
+func (h *httpbin) request(r *http.Request) (map[string]interface{}, error) {
+	res := map[string]interface{}{
+		"args":    flatten(r.URL.Query()),
+		"data":    "",
+		"files":   map[string]interface{}{},
+		"form":    map[string]interface{}{},
+		"headers": h.requestHeaders(r),
+		"json":    nil,
+		"method":  r.Method,
+		"origin":  h.origin(r),
+		"url":     h.url(r),
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		res["form"] = flatten(r.PostForm)
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			return nil, err
+		}
+		res["form"] = flatten(r.MultipartForm.Value)
+		files := map[string][]string{}
+		for name, headers := range r.MultipartForm.File {
+			for _, header := range headers {
+				f, err := header.Open()
+				if err != nil {
+					return nil, err
+				}
+				data, err := ioutil.ReadAll(f)
+				f.Close()
+				if err != nil {
+					return nil, err
+				}
+				files[name] = append(files[name], string(data))
+			}
+		}
+		res["files"] = flatten(files)
+	default:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		res["data"] = string(data)
+		var v interface{}
+		if json.Unmarshal(data, &v) == nil {
+			res["json"] = v
+		}
+	}
+	return res, nil
+}
+
+// anything answers the description of any request.
+func (h *httpbin) anything(w http.ResponseWriter, r *http.Request) {
+	res, err := h.request(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("request body could not be read. %v", err), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// basicAuth checks the /basic-auth/<user>/<passwd> credentials.
+func (h *httpbin) basicAuth(w http.ResponseWriter, r *http.Request) {
+	expected := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/basic-auth/"), "/", 2)
+	if len(expected) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	user, passwd, ok := r.BasicAuth()
+	if !ok || user != expected[0] || passwd != expected[1] {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Fake Realm"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"authenticated": true, "user": user})
+}
+
+// bytes answers /bytes/<n> random bytes, reproducible with "seed".
+func (h *httpbin) bytes(w http.ResponseWriter, r *http.Request) {
+	value := strings.TrimPrefix(r.URL.Path, "/bytes/")
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		http.Error(w, fmt.Sprintf("number of bytes must be a non-negative integer, got %q", value), http.StatusBadRequest)
+		return
+	}
+	if n > maxHTTPBinBytes {
+		n = maxHTTPBinBytes
+	}
+	seed := time.Now().UnixNano()
+	if value := r.FormValue("seed"); value != "" {
+		if seed, err = strconv.ParseInt(value, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("seed parameter must be an integer, got %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(n))
+	_, _ = w.Write(data)
+}
+
+func (h *httpbin) cookies(w http.ResponseWriter, r *http.Request) {
+	cookies := map[string]string{}
+	for _, cookie := range r.Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"cookies": cookies})
+}
+
+// setCookies sets the cookies of the query and redirects to /cookies.
+func (h *httpbin) setCookies(w http.ResponseWriter, r *http.Request) {
+	for name, values := range r.URL.Query() {
+		http.SetCookie(w, &http.Cookie{Name: name, Value: values[len(values)-1], Path: "/"})
+	}
+	http.Redirect(w, r, h.prefix+"/cookies", http.StatusFound)
+}
+
+// deleteCookies expires the cookies of the query and redirects to /cookies.
+func (h *httpbin) deleteCookies(w http.ResponseWriter, r *http.Request) {
+	for name := range r.URL.Query() {
+		http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1, Expires: time.Unix(0, 0)})
+	}
+	http.Redirect(w, r, h.prefix+"/cookies", http.StatusFound)
+}
+
+// delay answers like /anything after /delay/<n> seconds, at most 10.
+func (h *httpbin) delay(w http.ResponseWriter, r *http.Request) {
+	value := strings.TrimPrefix(r.URL.Path, "/delay/")
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		http.Error(w, fmt.Sprintf("delay must be a non-negative number of seconds, got %q", value), http.StatusBadRequest)
+		return
+	}
+	delay := time.Duration(seconds * float64(time.Second))
+	if delay > maxHTTPBinDelay {
+		delay = maxHTTPBinDelay
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), delay)
+	defer cancel()
+	<-ctx.Done()
+	if r.Context().Err() != nil {
+		return
+	}
+	h.anything(w, r)
+}
+
+// gzip answers a gzip-encoded description of the request.
+func (h *httpbin) gzip(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(map[string]interface{}{
+		"gzipped": true,
+		"headers": h.requestHeaders(r),
+		"method":  r.Method,
+		"origin":  h.origin(r),
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("response could not be serialized. %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	_, _ = gz.Write(data)
+	_ = gz.Close()
+}
+
+func (h *httpbin) headers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"headers": h.requestHeaders(r)})
+}
+
+func (h *httpbin) ip(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"origin": h.origin(r)})
+}
+
+// responseHeaders sets the headers of the query on the response, and answers
+// them.
+func (h *httpbin) responseHeaders(w http.ResponseWriter, r *http.Request) {
+	for name, values := range r.URL.Query() {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	data, err := json.Marshal(flatten(w.Header()))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("response could not be serialized. %v", err), http.StatusInternalServerError)
+		return
+	}
+	_, _ = w.Write(data)
+}
+
+// status answers with the code of /status/<codes>, picked at random if
+// several comma separated codes are given, optionally weighted as in
+// "200:0.9,503:0.1".
+func (h *httpbin) status(w http.ResponseWriter, r *http.Request) {
+	value := strings.TrimPrefix(r.URL.Path, "/status/")
+	type choice struct {
+		code   int
+		weight float64
+	}
+	var choices []choice
+	total := 0.0
+	for _, item := range strings.Split(value, ",") {
+		codeString, weightString, weighted := strings.Cut(item, ":")
+		c := choice{weight: 1}
+		var err error
+		c.code, err = strconv.Atoi(codeString)
+		if err == nil && weighted {
+			c.weight, err = strconv.ParseFloat(weightString, 64)
+		}
+		if err != nil || c.code < 100 || c.code > 999 || c.weight < 0 {
+			http.Error(w, fmt.Sprintf("status codes must be comma separated codes with optional weights, got %q", value), http.StatusBadRequest)
+			return
+		}
+		choices = append(choices, c)
+		total += c.weight
+	}
+	code := choices[len(choices)-1].code
+	x := rand.Float64() * total
+	for _, c := range choices {
+		if x -= c.weight; x < 0 {
+			code = c.code
+			break
+		}
+	}
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Fake Realm"`)
+	}
+	w.WriteHeader(code)
+}
@@ -0,0 +1,208 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultIdleIntervals cover the usual conntrack and cloud NAT timeouts
+	// for UDP (30s to 3m) and idle TCP connections (4m to 6m).
+	defaultIdleIntervals = "30s,1m,2m,3m,4m,6m"
+	maxIdleInterval      = time.Hour
+	maxIdleSessions      = 32
+)
+
+// IdleResult is the JSON answer of /dial?mode=idle.
+type IdleResult struct {
+	Address  string        `json:"address"`
+	Protocol string        `json:"protocol"`
+	Sessions []IdleSession `json:"sessions"`
+	// MaxWorkingIdle is the longest idle duration a session survived, and
+	// MinFailingIdle the shortest one after which a session failed.
+	MaxWorkingIdle string `json:"maxWorkingIdle,omitempty"`
+	MinFailingIdle string `json:"minFailingIdle,omitempty"`
+}
+
+// IdleSession is the outcome of one session kept idle for Idle.
+type IdleSession struct {
+	Idle string `json:"idle"`
+	OK   bool   `json:"ok"`
+	RTT  string `json:"rtt,omitempty"`
+	// Failure is "rst" if the connection was reset, "drop" if the heartbeat
+	// was silently dropped, "timeout" if it was acknowledged but never
+	// answered, "eof" if the peer closed the connection, "refused" if an
+	// ICMP error rejected it, "setup" if the session could not start,
+	// "cancelled" if the request was cancelled while idle, or "error"
+	// otherwise.
+	Failure string `json:"failure,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// parseIdleIntervals parses a comma separated list of idle durations.
+func parseIdleIntervals(value string) ([]time.Duration, error) {
+	if value == "" {
+		value = defaultIdleIntervals
+	}
+	var intervals []time.Duration
+	for _, item := range strings.Split(value, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(item))
+		if err != nil || d <= 0 || d > maxIdleInterval {
+			return nil, fmt.Errorf("intervals parameter must be a comma separated list of positive golang durations up to %v, got %q", maxIdleInterval, item)
+		}
+		intervals = append(intervals, d)
+	}
+	if len(intervals) > maxIdleSessions {
+		return nil, fmt.Errorf("intervals parameter must have at most %d durations, got %d", maxIdleSessions, len(intervals))
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	return intervals, nil
+}
+
+// idleDialHandler serves /dial?mode=idle: it opens one session per idle
+// interval to the netexec TCP or UDP server at host and port, all at once.
+// Each session exchanges a heartbeat, stays idle for its interval, then
+// exchanges another one. It answers once the longest interval is over, and
+// closes the sessions if the request is cancelled before.
+func idleDialHandler(w http.ResponseWriter, r *http.Request, host, port, protocol string) {
+	intervals, err := parseIdleIntervals(r.FormValue("intervals"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timeout := 5 * time.Second
+	if timeoutParam := r.FormValue("timeout"); timeoutParam != "" {
+		if timeout, err = time.ParseDuration(timeoutParam); err != nil || timeout <= 0 {
+			http.Error(w, fmt.Sprintf("timeout parameter must be a positive golang duration, got %q", timeoutParam), http.StatusBadRequest)
+			return
+		}
+	}
+	protocol = strings.ToLower(protocol)
+	switch protocol {
+	case "":
+		protocol = "tcp"
+	case "tcp", "udp":
+	default:
+		http.Error(w, fmt.Sprintf("unsupported protocol for mode idle. %s", protocol), http.StatusBadRequest)
+		return
+	}
+	address := net.JoinHostPort(host, port)
+	log.Printf("Monitoring %d idle %s sessions to %s for up to %v", len(intervals), protocol, address, intervals[len(intervals)-1])
+
+	result := IdleResult{Address: address, Protocol: protocol, Sessions: make([]IdleSession, len(intervals))}
+	var wg sync.WaitGroup
+	for i, idle := range intervals {
+		wg.Add(1)
+		go func(i int, idle time.Duration) {
+			defer wg.Done()
+			result.Sessions[i] = runIdleSession(r.Context(), protocol, address, idle, timeout)
+		}(i, idle)
+	}
+	wg.Wait()
+
+	for _, session := range result.Sessions {
+		if session.OK {
+			result.MaxWorkingIdle = session.Idle
+		} else if session.Failure != "setup" && session.Failure != "cancelled" && result.MinFailingIdle == "" {
+			result.MinFailingIdle = session.Idle
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// runIdleSession connects to address, checks that a heartbeat makes a round
+// trip, stays idle for idle and checks it again, unless ctx is cancelled.
+func runIdleSession(ctx context.Context, protocol, address string, idle, timeout time.Duration) IdleSession {
+	session := IdleSession{Idle: idle.String()}
+	conn, err := (&net.Dialer{Timeout: timeout}).DialContext(ctx, protocol, address)
+	if err != nil {
+		session.Failure = "setup"
+		session.Error = fmt.Sprintf("dial failed. err:%v", err)
+		return session
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	heartbeat := func(sequence int) (time.Duration, error) {
+		msg := fmt.Sprintf("heartbeat-%d", sequence)
+		request := "echo " + msg
+		if protocol == "tcp" {
+			request += "\n"
+		}
+		start := time.Now()
+		_ = conn.SetDeadline(start.Add(timeout))
+		if _, err := conn.Write([]byte(request)); err != nil {
+			return 0, err
+		}
+		var reply string
+		if protocol == "tcp" {
+			reply, err = reader.ReadString('\n')
+		} else {
+			buf := make([]byte, 1024)
+			var n int
+			n, err = conn.Read(buf)
+			reply = string(buf[:n])
+		}
+		if err != nil {
+			return 0, err
+		}
+		if strings.TrimSpace(reply) != msg {
+			return 0, fmt.Errorf("unexpected reply %q", reply)
+		}
+		return time.Since(start), nil
+	}
+	if _, err := heartbeat(1); err != nil {
+		session.Failure = "setup"
+		session.Error = fmt.Sprintf("first heartbeat failed. err:%v", err)
+		return session
+	}
+	if !sleepContext(ctx, idle) {
+		session.Failure = "cancelled"
+		session.Error = ctx.Err().Error()
+		return session
+	}
+	rtt, err := heartbeat(2)
+	if err != nil {
+		session.Failure = classifyIdleError(conn, err)
+		session.Error = err.Error()
+		log.Printf("%s session to %s failed after %v idle: %s", protocol, address, idle, session.Failure)
+		return session
+	}
+	session.OK = true
+	session.RTT = rtt.String()
+	return session
+}
+
+// classifyIdleError tells how a heartbeat failed on conn.
+func classifyIdleError(conn net.Conn, err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "rst"
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "refused"
+	case errors.Is(err, io.EOF):
+		return "eof"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		// A TCP heartbeat the peer acknowledged reached it, only the reply
+		// went missing.
+		if info, ok := tcpInfo(conn); ok && info.Unacked == 0 {
+			return "timeout"
+		}
+		return "drop"
+	}
+	return "error"
+}
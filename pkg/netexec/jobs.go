@@ -0,0 +1,434 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJobInterval = time.Second
+	minJobInterval     = 10 * time.Millisecond
+	maxJobDuration     = 7 * 24 * time.Hour
+	maxJobTargets      = 64
+	maxRunningJobs     = 32
+	// maxJobResults is the number of results kept per job, beyond which the
+	// oldest half is dropped.
+	maxJobResults = 100000
+)
+
+// JobSpec, submitted to /jobs, describes dials repeated every Interval to
+// each target for Duration.
+type JobSpec struct {
+	// Targets are "host:port" addresses.
+	Targets  []string `json:"targets"`
+	Protocol string   `json:"protocol,omitempty"`
+	// Request is the path for HTTP, or the command for the other protocols,
+	// "hostname" by default.
+	Request  string `json:"request,omitempty"`
+	Interval string `json:"interval,omitempty"`
+	Duration string `json:"duration"`
+
+	interval, duration time.Duration
+}
+
+// Job is the JSON state of a job. Results only holds the results after the
+// "since" sequence number requested, and is omitted from the job list.
+type Job struct {
+	ID       int         `json:"id"`
+	Spec     JobSpec     `json:"spec"`
+	State    string      `json:"state"`
+	Started  time.Time   `json:"started"`
+	Finished *time.Time  `json:"finished,omitempty"`
+	Targets  []JobTarget `json:"targets"`
+	Results  []JobResult `json:"results,omitempty"`
+	// Dropped counts the oldest results no longer kept.
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// Job states.
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobCancelled = "cancelled"
+)
+
+// JobTarget sums up the dials of a job to one target.
+type JobTarget struct {
+	Target    string `json:"target"`
+	Attempts  int    `json:"attempts"`
+	Successes int    `json:"successes"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+// JobResult is the outcome of one dial of a job. Seq numbers the results of
+// the job from 1.
+type JobResult struct {
+	Seq          int       `json:"seq"`
+	Time         time.Time `json:"time"`
+	Target       string    `json:"target"`
+	Response     string    `json:"response,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Latency      string    `json:"latency"`
+	LatencyNanos int64     `json:"latencyNanos"`
+}
+
+// validate checks the spec and fills in its parsed fields and defaults.
+func (j *JobSpec) validate() error {
+	if len(j.Targets) == 0 || len(j.Targets) > maxJobTargets {
+		return fmt.Errorf("targets must list 1 to %d host:port addresses, got %d", maxJobTargets, len(j.Targets))
+	}
+	for _, target := range j.Targets {
+		if _, _, err := resolveDialer(j.Protocol, target); err != nil {
+			return fmt.Errorf("target %q: %v", target, err)
+		}
+	}
+	if j.Request == "" {
+		j.Request = "hostname"
+	}
+	j.interval = defaultJobInterval
+	if j.Interval != "" {
+		var err error
+		if j.interval, err = time.ParseDuration(j.Interval); err != nil || j.interval < minJobInterval {
+			return fmt.Errorf("interval must be a golang duration of at least %v, got %q", minJobInterval, j.Interval)
+		}
+	}
+	var err error
+	if j.duration, err = time.ParseDuration(j.Duration); err != nil || j.duration <= 0 || j.duration > maxJobDuration {
+		return fmt.Errorf("duration must be a positive golang duration of at most %v, got %q", maxJobDuration, j.Duration)
+	}
+	return nil
+}
+
+// job is a Job and what its runner and followers synchronize with.
+type job struct {
+	Job
+	cancel context.CancelFunc
+	// changed is closed, and replaced, whenever results are added or the
+	// job finishes.
+	changed chan struct{}
+}
+
+// snapshot copies the job with the results after since, if withResults.
+func (j *job) snapshot(since int, withResults bool) Job {
+	res := j.Job
+	res.Targets = append([]JobTarget(nil), j.Targets...)
+	res.Results = nil
+	if withResults {
+		for i := range j.Results {
+			if j.Results[i].Seq > since {
+				res.Results = append(res.Results, j.Results[i:]...)
+				break
+			}
+		}
+	}
+	return res
+}
+
+// jobStore runs the jobs of a Server and keeps them for retention once
+// finished.
+type jobStore struct {
+	retention time.Duration
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	mu      sync.Mutex
+	nextID  int
+	jobs    []*job
+	running int
+	wg      sync.WaitGroup
+}
+
+func newJobStore(retention time.Duration) *jobStore {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobStore{retention: retention, ctx: ctx, cancel: cancel}
+}
+
+// submit starts a job running spec, which must be valid.
+func (s *jobStore) submit(spec JobSpec) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return Job{}, fmt.Errorf("server is shutting down")
+	}
+	if s.running >= maxRunningJobs {
+		return Job{}, fmt.Errorf("%d jobs are already running", s.running)
+	}
+	s.pruneLocked()
+	s.nextID++
+	ctx, cancel := context.WithCancel(s.ctx)
+	j := &job{
+		Job:     Job{ID: s.nextID, Spec: spec, State: JobRunning, Started: time.Now()},
+		cancel:  cancel,
+		changed: make(chan struct{}),
+	}
+	for _, target := range spec.Targets {
+		j.Targets = append(j.Targets, JobTarget{Target: target})
+	}
+	s.jobs = append(s.jobs, j)
+	s.running++
+	s.wg.Add(1)
+	go s.run(ctx, j)
+	return j.snapshot(0, false), nil
+}
+
+// run dials the targets of j every interval for the duration of the job,
+// unless ctx is done first.
+func (s *jobStore) run(ctx context.Context, j *job) {
+	defer s.wg.Done()
+	defer j.cancel()
+	spec := j.Spec
+	protocol := strings.ToLower(spec.Protocol)
+	if protocol == "" {
+		protocol = "http"
+	}
+	ticker := time.NewTicker(spec.interval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(spec.duration)
+	defer deadline.Stop()
+	state := JobRunning
+	for try := 1; state == JobRunning; try++ {
+		var wg sync.WaitGroup
+		for i, target := range spec.Targets {
+			wg.Add(1)
+			go func(i int, target string) {
+				defer wg.Done()
+				s.add(j, i, dialJobTarget(ctx, protocol, spec.Request, target, try))
+			}(i, target)
+		}
+		wg.Wait()
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			state = JobCompleted
+		case <-ctx.Done():
+			state = JobCancelled
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := time.Now()
+	j.Finished = &finished
+	j.State = state
+	s.running--
+	close(j.changed)
+	j.changed = make(chan struct{})
+	log.Printf("Job %d %s after %v", j.ID, j.State, finished.Sub(j.Started).Round(time.Millisecond))
+}
+
+// dialJobTarget sends request to target once, resolving it again so that
+// the job follows DNS changes.
+func dialJobTarget(ctx context.Context, protocol, request, target string, try int) JobResult {
+	result := JobResult{Time: time.Now(), Target: target}
+	response, err := func() (string, error) {
+		dialer, addr, err := resolveDialer(protocol, target)
+		if err != nil {
+			return "", err
+		}
+		host, port, _ := net.SplitHostPort(target)
+		return dialTry(ctx, dialer, protocol, host, port, request, addr, try)
+	}()
+	latency := time.Since(result.Time)
+	result.Latency = latency.String()
+	result.LatencyNanos = latency.Nanoseconds()
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Response = response
+	}
+	return result
+}
+
+// add appends the result of the target i of j.
+func (s *jobStore) add(j *job, i int, result JobResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result.Seq = j.Dropped + len(j.Results) + 1
+	if len(j.Results) >= maxJobResults {
+		kept := append([]JobResult(nil), j.Results[len(j.Results)/2:]...)
+		j.Dropped += len(j.Results) - len(kept)
+		j.Results = kept
+	}
+	j.Results = append(j.Results, result)
+	target := &j.Targets[i]
+	target.Attempts++
+	if result.Error == "" {
+		target.Successes++
+	} else {
+		target.LastError = result.Error
+	}
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// getLocked returns the job with the given id, or nil.
+func (s *jobStore) getLocked(id int) *job {
+	s.pruneLocked()
+	for _, j := range s.jobs {
+		if j.ID == id {
+			return j
+		}
+	}
+	return nil
+}
+
+func (s *jobStore) list() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	res := make([]Job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		res = append(res, j.snapshot(0, false))
+	}
+	return res
+}
+
+// pruneLocked forgets the jobs finished for longer than the retention.
+func (s *jobStore) pruneLocked() {
+	now := time.Now()
+	kept := s.jobs[:0]
+	for _, j := range s.jobs {
+		if j.Finished == nil || now.Sub(*j.Finished) < s.retention {
+			kept = append(kept, j)
+		}
+	}
+	for i := len(kept); i < len(s.jobs); i++ {
+		s.jobs[i] = nil
+	}
+	s.jobs = kept
+}
+
+// close cancels the running jobs and waits for them to finish.
+func (s *jobStore) close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+// jobsHandler lists (GET /jobs) and submits (POST /jobs) jobs, returns the
+// state and results of one (GET /jobs/<id>), or cancels it (DELETE
+// /jobs/<id>).
+func (s *Server) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s %s", r.Method, r.URL.Path)
+	idString := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	if idString == "" {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, s.jobs.list())
+		case http.MethodPost:
+			spec := JobSpec{}
+			if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+				http.Error(w, fmt.Sprintf("job could not be decoded. %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := spec.validate(); err != nil {
+				http.Error(w, fmt.Sprintf("job is invalid. %v", err), http.StatusBadRequest)
+				return
+			}
+			job, err := s.jobs.submit(spec)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("job could not be started. %v", err), http.StatusServiceUnavailable)
+				return
+			}
+			log.Printf("Started job %d: %+v", job.ID, spec)
+			writeJSON(w, http.StatusCreated, job)
+		default:
+			http.Error(w, fmt.Sprintf("method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	id, err := strconv.Atoi(idString)
+	if err != nil || id <= 0 {
+		http.Error(w, fmt.Sprintf("job id must be a positive integer, got %q", idString), http.StatusBadRequest)
+		return
+	}
+	s.jobs.mu.Lock()
+	j := s.jobs.getLocked(id)
+	s.jobs.mu.Unlock()
+	if j == nil {
+		http.Error(w, fmt.Sprintf("job %d not found", id), http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		since := 0
+		if value := r.FormValue("since"); value != "" {
+			if since, err = strconv.Atoi(value); err != nil || since < 0 {
+				http.Error(w, fmt.Sprintf("since parameter must be a non-negative integer, got %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+		follow := false
+		if value := r.FormValue("follow"); value != "" {
+			if follow, err = strconv.ParseBool(value); err != nil {
+				http.Error(w, fmt.Sprintf("follow parameter must be a boolean, got %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+		if follow {
+			s.followJob(w, r, j, since)
+			return
+		}
+		s.jobs.mu.Lock()
+		job := j.snapshot(since, true)
+		s.jobs.mu.Unlock()
+		writeJSON(w, http.StatusOK, job)
+	case http.MethodDelete:
+		j.cancel()
+		s.jobs.mu.Lock()
+		for j.State == JobRunning {
+			changed := j.changed
+			s.jobs.mu.Unlock()
+			<-changed
+			s.jobs.mu.Lock()
+		}
+		job := j.snapshot(0, false)
+		s.jobs.mu.Unlock()
+		writeJSON(w, http.StatusOK, job)
+	default:
+		http.Error(w, fmt.Sprintf("method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+// followJob streams the results of j after since as newline-delimited JSON,
+// until the job finishes or the client goes away.
+func (s *Server) followJob(w http.ResponseWriter, r *http.Request, j *job, since int) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	for {
+		s.jobs.mu.Lock()
+		job := j.snapshot(since, true)
+		changed := j.changed
+		s.jobs.mu.Unlock()
+		for _, result := range job.Results {
+			if err := encoder.Encode(result); err != nil {
+				return
+			}
+			since = result.Seq
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if job.State != JobRunning {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// termination tracks the requests a Server receives once it is terminating,
+// which tell how long the removal of its endpoints takes to propagate.
+type termination struct {
+	mu      sync.Mutex
+	started time.Time
+	counts  map[string]int
+	last    time.Time
+}
+
+// record counts a request of protocol received while terminating.
+func (t *termination) record(protocol string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.started.IsZero() {
+		return
+	}
+	t.counts[protocol]++
+	t.last = time.Now()
+}
+
+// summary describes the requests received since the termination started.
+func (t *termination) summary() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	total := 0
+	var protocols []string
+	for protocol, count := range t.counts {
+		total += count
+		protocols = append(protocols, fmt.Sprintf("%s %d", protocol, count))
+	}
+	if total == 0 {
+		return "no request received since SIGTERM"
+	}
+	sort.Strings(protocols)
+	return fmt.Sprintf("%d requests received since SIGTERM (%s), the last one %v after it",
+		total, strings.Join(protocols, ", "), t.last.Sub(t.started).Round(time.Millisecond))
+}
+
+// Terminate shuts the server down the way Kubernetes expects on SIGTERM: it
+// marks the server not ready at once, keeps serving for the DelayShutdown
+// grace period while the endpoint removal propagates, then shuts it down,
+// draining in-flight requests for up to DrainTimeout, and exits with 0. Each
+// phase is logged with the requests received since it was called.
+func (s *Server) Terminate() {
+	s.terminateOnce.Do(func() {
+		s.termination.mu.Lock()
+		s.termination.started = time.Now()
+		s.termination.counts = map[string]int{}
+		s.termination.mu.Unlock()
+		s.terminating.set(true)
+
+		grace := time.Duration(s.config.DelayShutdown) * time.Second
+		log.Printf("Terminating: marked not ready, serving for a grace period of %v", grace)
+		time.Sleep(grace)
+		drainTimeout := time.Duration(s.config.DrainTimeout) * time.Second
+		log.Printf("Grace period over: %s. Draining %d in-flight HTTP requests for up to %v",
+			s.termination.summary(), atomic.LoadInt64(&s.inFlight), drainTimeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		start := time.Now()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("Drain timed out after %v with %d HTTP requests in flight: %v", time.Since(start).Round(time.Millisecond), atomic.LoadInt64(&s.inFlight), err)
+		} else {
+			log.Printf("Drained in %v", time.Since(start).Round(time.Millisecond))
+		}
+		log.Printf("Terminated: %s", s.termination.summary())
+		s.exit(0)
+	})
+}
+
+// trackRequests counts the in-flight HTTP requests, and those received while
+// terminating.
+func (s *Server) trackRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&s.inFlight, 1)
+		defer atomic.AddInt64(&s.inFlight, -1)
+		if s.terminating.get() {
+			s.termination.record("http")
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// connTracker holds the connections served outside of the HTTP and gRPC
+// servers, the TCP command ones and the hijacked ones, so that Shutdown can
+// close them.
+type connTracker struct {
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// add tracks conn, unless the tracker is closed already and conn must be
+// closed at once.
+func (t *connTracker) add(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	if t.conns == nil {
+		t.conns = map[net.Conn]struct{}{}
+	}
+	t.conns[conn] = struct{}{}
+	return true
+}
+
+func (t *connTracker) remove(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, conn)
+}
+
+// closeAll closes the tracked connections, and the ones added later.
+func (t *connTracker) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.conns = nil
+}
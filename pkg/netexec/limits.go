@@ -0,0 +1,317 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxIdleBuckets is the number of per-client token buckets kept before the
+// full ones are forgotten.
+const maxIdleBuckets = 4096
+
+// LimitsConfig makes the server behave like a saturated service. A zero
+// limit is disabled.
+type LimitsConfig struct {
+	// RequestsPerSecond limits the HTTP requests and UDP commands, with
+	// bursts of up to Burst, which defaults to RequestsPerSecond.
+	RequestsPerSecond float64 `json:"requestsPerSecond" yaml:"requestsPerSecond"`
+	Burst             int     `json:"burst" yaml:"burst"`
+	// ConcurrentRequests limits the HTTP requests served at once.
+	ConcurrentRequests int `json:"concurrentRequests" yaml:"concurrentRequests"`
+	// ConcurrentConnections limits the HTTP, TCP and gRPC connections open
+	// at once.
+	ConcurrentConnections int `json:"concurrentConnections" yaml:"concurrentConnections"`
+	// PerClient applies the limits to each client IP instead of globally,
+	// the one of the PROXY protocol header if any.
+	PerClient bool `json:"perClient" yaml:"perClient"`
+}
+
+// LimitsUsage is the JSON answer of /healthz when limits are configured.
+type LimitsUsage struct {
+	Limits           LimitsConfig `json:"limits"`
+	RequestsInFlight int          `json:"requestsInFlight"`
+	Connections      int          `json:"connections"`
+	// Limited counts the requests, commands and connections refused since
+	// the server started.
+	Limited uint64 `json:"limited"`
+}
+
+// tokenBucket refills at the configured rate up to the burst size.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter enforces a LimitsConfig, globally or per client IP.
+type limiter struct {
+	config  LimitsConfig
+	limited *counterVec
+
+	mu          sync.Mutex
+	buckets     map[string]*tokenBucket
+	requests    map[string]int
+	connections map[string]int
+	total       struct{ requests, connections int }
+	refused     uint64
+}
+
+func newLimiter(cfg LimitsConfig, limited *counterVec) *limiter {
+	if cfg.Burst == 0 {
+		cfg.Burst = int(math.Ceil(cfg.RequestsPerSecond))
+	}
+	return &limiter{
+		config:      cfg,
+		limited:     limited,
+		buckets:     map[string]*tokenBucket{},
+		requests:    map[string]int{},
+		connections: map[string]int{},
+	}
+}
+
+func (c *LimitsConfig) enabled() bool {
+	return c.RequestsPerSecond > 0 || c.ConcurrentRequests > 0 || c.ConcurrentConnections > 0
+}
+
+// key returns the client the limits of ip are counted for.
+func (l *limiter) key(ip net.IP) string {
+	if l.config.PerClient && ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// refuse counts a request, command or connection refused by limit.
+func (l *limiter) refuse(protocol, limit string) {
+	l.mu.Lock()
+	l.refused++
+	l.mu.Unlock()
+	l.limited.inc(protocol, limit)
+}
+
+// allowRate takes a token from the bucket of key. If there is none, it
+// returns how long until the next one.
+func (l *limiter) allowRate(key string) (bool, time.Duration) {
+	rate := l.config.RequestsPerSecond
+	if rate <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	burst := float64(l.config.Burst)
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			for k, b := range l.buckets {
+				if b.tokens+now.Sub(b.last).Seconds()*rate >= burst {
+					delete(l.buckets, k)
+				}
+			}
+		}
+		bucket = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+}
+
+// acquire counts one more request or connection of key in counts, unless it
+// would go over limit. Every acquired one must be released.
+func (l *limiter) acquire(counts map[string]int, total *int, key string, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit > 0 && counts[key] >= limit {
+		return false
+	}
+	counts[key]++
+	*total++
+	return true
+}
+
+func (l *limiter) release(counts map[string]int, total *int, key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if counts[key]--; counts[key] <= 0 {
+		delete(counts, key)
+	}
+	*total--
+}
+
+func (l *limiter) usage() LimitsUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return LimitsUsage{
+		Limits:           l.config,
+		RequestsInFlight: l.total.requests,
+		Connections:      l.total.connections,
+		Limited:          l.refused,
+	}
+}
+
+// retryAfter formats d as the whole seconds of a Retry-After header.
+func retryAfter(d time.Duration) string {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
+
+// limitMiddleware answers 429 to the HTTP requests over the rate limit and
+// 503 to those over the concurrency limit. /healthz and /metrics are exempt,
+// so that a saturated server is not restarted and can be observed.
+func (s *Server) limitMiddleware(next http.Handler) http.Handler {
+	l := s.limiter
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := l.key(remoteIP(r.RemoteAddr))
+		if ok, wait := l.allowRate(key); !ok {
+			l.refuse("http", "rate")
+			w.Header().Set("Retry-After", retryAfter(wait))
+			http.Error(w, "request rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		if !l.acquire(l.requests, &l.total.requests, key, l.config.ConcurrentRequests) {
+			l.refuse("http", "requests")
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "concurrent requests limit exceeded", http.StatusServiceUnavailable)
+			return
+		}
+		defer l.release(l.requests, &l.total.requests, key)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowCommand tells whether a UDP command from ip is within the rate limit.
+func (s *Server) allowCommand(protocol string, ip net.IP) bool {
+	if ok, _ := s.limiter.allowRate(s.limiter.key(ip)); !ok {
+		s.limiter.refuse(protocol, "rate")
+		return false
+	}
+	return true
+}
+
+// limitListener closes the connections over the concurrent connections
+// limit as soon as they are accepted. Clients are told apart by the address
+// of their PROXY protocol header, if any, so the limiter of a connection
+// with one, which must not block the accept loop, waits for its first read
+// or write.
+type limitListener struct {
+	net.Listener
+	limiter  *limiter
+	protocol string
+	// rejection is written to the refused connections, if any.
+	rejection []byte
+}
+
+func (s *Server) newLimitListener(ln net.Listener, protocol string, rejection string) net.Listener {
+	return &limitListener{Listener: ln, limiter: s.limiter, protocol: protocol, rejection: []byte(rejection)}
+}
+
+func (ln *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		c := &limitedConn{Conn: conn, listener: ln}
+		if _, ok := underlyingProxyConn(conn); ok && ln.limiter.config.PerClient {
+			return c, nil
+		}
+		if c.admit() == nil {
+			return c, nil
+		}
+	}
+}
+
+// limitedConn holds a connection slot from the time it is admitted until it
+// is closed.
+type limitedConn struct {
+	net.Conn
+	listener *limitListener
+
+	admitOnce sync.Once
+	err       error
+	release   func()
+
+	releaseOnce sync.Once
+}
+
+// admit takes a connection slot for the client of c, or closes c.
+func (c *limitedConn) admit() error {
+	c.admitOnce.Do(func() {
+		ln, l := c.listener, c.listener.limiter
+		remoteAddr := c.Conn.RemoteAddr()
+		key := l.key(remoteIP(remoteAddr.String()))
+		if l.acquire(l.connections, &l.total.connections, key, l.config.ConcurrentConnections) {
+			c.release = func() { l.release(l.connections, &l.total.connections, key) }
+			return
+		}
+		l.refuse(ln.protocol, "connections")
+		log.Printf("Refusing %s connection from %s: concurrent connections limit exceeded", ln.protocol, remoteAddr)
+		c.err = &net.OpError{Op: "read", Net: "tcp", Source: c.Conn.LocalAddr(), Addr: remoteAddr, Err: errConnectionsLimit}
+		// The rejection is sent aside, for a slow client not to hold up the
+		// accept loop, and closes the connection once sent.
+		go func(conn net.Conn, rejection []byte) {
+			if len(rejection) > 0 {
+				_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+				_, _ = conn.Write(rejection)
+			}
+			conn.Close()
+		}(c.Conn, ln.rejection)
+	})
+	return c.err
+}
+
+var errConnectionsLimit = errors.New("concurrent connections limit exceeded")
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	if err := c.admit(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	if err := c.admit(); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *limitedConn) Close() error {
+	// A connection closed before being admitted never takes a slot.
+	c.admitOnce.Do(func() { c.err = net.ErrClosed })
+	c.releaseOnce.Do(func() {
+		if c.release != nil {
+			c.release()
+		}
+	})
+	if errors.Is(c.err, errConnectionsLimit) {
+		// Closed once the rejection is sent.
+		return nil
+	}
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection.
+func (c *limitedConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metric is rendered by /metrics in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// metricsRegistry holds the metrics of a Server, in /metrics order.
+type metricsRegistry []metric
+
+// counterVec is a minimal Prometheus counter partitioned by label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func (r *metricsRegistry) newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]uint64{}}
+	*r = append(*r, c)
+	return c
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(labelValues, "\x00")]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", c.name, formatLabels(c.labels, strings.Split(key, "\x00")), c.values[key])
+	}
+}
+
+// gaugeFunc is a Prometheus gauge whose value is read when rendered.
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func (r *metricsRegistry) newGaugeFunc(name, help string, value func() float64) {
+	*r = append(*r, &gaugeFunc{name: name, help: help, value: value})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", g.name, g.help, g.name, g.name, g.value())
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range s.metrics {
+		m.write(w)
+	}
+}
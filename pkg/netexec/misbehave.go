@@ -0,0 +1,196 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// misbehavior is a connection-level failure requested by a client, either with
+// the "misbehave" HTTP parameter or the "misbehave" TCP command prefix.
+type misbehavior struct {
+	mode  string
+	bytes int
+	delay time.Duration
+}
+
+func parseMisbehavior(spec string) (*misbehavior, error) {
+	mode, arg, hasArg := strings.Cut(spec, ":")
+	m := &misbehavior{mode: mode}
+	var err error
+	switch mode {
+	case "rst", "hang":
+		if hasArg {
+			return nil, fmt.Errorf("misbehave mode %q takes no argument", mode)
+		}
+	case "halfclose", "partial":
+		if m.bytes, err = strconv.Atoi(arg); err != nil || m.bytes < 0 {
+			return nil, fmt.Errorf("misbehave mode %q requires a non-negative number of bytes, got %q", mode, arg)
+		}
+	case "delay-accept":
+		if m.delay, err = time.ParseDuration(arg); err != nil || m.delay <= 0 {
+			return nil, fmt.Errorf("misbehave mode %q requires a positive golang duration, got %q", mode, arg)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported misbehave mode %q, acceptable values: rst, hang, halfclose:<bytes>, partial:<bytes>, delay-accept:<duration>", mode)
+	}
+	return m, nil
+}
+
+// apply sends reply over conn the way m asks for. It returns true if conn must
+// not be used anymore.
+func (m *misbehavior) apply(ln *misbehavingListener, conn net.Conn, reply []byte) bool {
+	clientAddress := conn.RemoteAddr()
+	log.Printf("Misbehaving with %q towards %s", m.mode, clientAddress)
+	if (m.mode == "halfclose" || m.mode == "partial") && m.bytes < len(reply) {
+		reply = reply[:m.bytes]
+	}
+	switch m.mode {
+	case "rst":
+		if tcpConn, ok := underlyingTCPConn(conn); ok {
+			// A zero linger makes close() send a RST instead of a FIN.
+			_ = tcpConn.SetLinger(0)
+		}
+		conn.Close()
+		return true
+	case "hang":
+		// Keep reading so that the client sees its data acknowledged, until
+		// it gives up.
+		_, _ = io.Copy(io.Discard, conn)
+		return true
+	case "halfclose":
+		_, _ = conn.Write(reply)
+		if tcpConn, ok := underlyingTCPConn(conn); ok {
+			_ = tcpConn.CloseWrite()
+		}
+		_, _ = io.Copy(io.Discard, conn)
+		return true
+	case "partial":
+		_, _ = conn.Write(reply)
+		_, _ = io.Copy(io.Discard, conn)
+		return true
+	case "delay-accept":
+		ln.delayNextAccept(m.delay)
+		if _, err := conn.Write(reply); err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// misbehavingListener delays accepting connections after a client asked for
+// it with the "delay-accept" misbehave mode. The kernel still completes the
+// handshake, so the client sees a connection nobody serves yet.
+type misbehavingListener struct {
+	net.Listener
+	acceptDelay int64
+}
+
+func newMisbehavingListener(ln net.Listener) *misbehavingListener {
+	return &misbehavingListener{Listener: ln}
+}
+
+func (l *misbehavingListener) delayNextAccept(d time.Duration) {
+	log.Printf("Delaying the next accept on %s by %v", l.Addr(), d)
+	atomic.StoreInt64(&l.acceptDelay, int64(d))
+}
+
+func (l *misbehavingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if d := time.Duration(atomic.SwapInt64(&l.acceptDelay, 0)); d > 0 {
+		time.Sleep(d)
+	}
+	return conn, nil
+}
+
+// bufferedResponse records a handler's response so that it can be written to
+// a hijacked connection in whatever broken way the client asked for.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	if b.code == 0 {
+		b.code = http.StatusOK
+	}
+	return b.body.Write(data)
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.code == 0 {
+		b.code = code
+	}
+}
+
+// misbehaviorMiddleware honours the "misbehave" parameter of any HTTP request.
+func (s *Server) misbehaviorMiddleware(next http.Handler) http.Handler {
+	ln := s.httpListener
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spec := r.URL.Query().Get("misbehave")
+		if spec == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m, err := parseMisbehavior(strings.ToLower(spec))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("misbehave parameter is invalid. %v", err), http.StatusBadRequest)
+			return
+		}
+		if m.mode == "delay-accept" {
+			ln.delayNextAccept(m.delay)
+			next.ServeHTTP(w, r)
+			return
+		}
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, fmt.Sprintf("misbehave mode %q requires HTTP/1.x", m.mode), http.StatusBadRequest)
+			return
+		}
+		recorder := &bufferedResponse{header: http.Header{}}
+		next.ServeHTTP(recorder, r)
+		if recorder.code == 0 {
+			recorder.code = http.StatusOK
+		}
+		resp := &http.Response{
+			StatusCode:    recorder.code,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        recorder.header,
+			ContentLength: int64(recorder.body.Len()),
+			Body:          io.NopCloser(&recorder.body),
+		}
+		var raw bytes.Buffer
+		if err := resp.Write(&raw); err != nil {
+			http.Error(w, fmt.Sprintf("response could not be serialized. %v", err), http.StatusInternalServerError)
+			return
+		}
+		conn, _, err := hijacker.Hijack()
+		if err != nil {
+			log.Printf("Failed to hijack connection from %s: %v", r.RemoteAddr, err)
+			return
+		}
+		defer conn.Close()
+		if !s.conns.add(conn) {
+			return
+		}
+		defer s.conns.remove(conn)
+		m.apply(ln, conn, raw.Bytes())
+	})
+}
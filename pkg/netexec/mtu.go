@@ -0,0 +1,263 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// MTUResult is the outcome of a path MTU probe towards one address.
+type MTUResult struct {
+	Family         string `json:"family"`
+	Address        string `json:"address"`
+	Protocol       string `json:"protocol"`
+	MaxPayload     int    `json:"maxPayload,omitempty"`
+	MaxSegmentSize int    `json:"maxSegmentSize,omitempty"`
+	PathMTU        int    `json:"pathMTU,omitempty"`
+	KernelPathMTU  int    `json:"kernelPathMTU,omitempty"`
+	Probes         int    `json:"probes"`
+	Error          string `json:"error,omitempty"`
+}
+
+// mtuDialHandler serves /dial?mode=mtu: for each address family the host
+// resolves to, it binary-searches the largest packet that makes a round trip.
+func mtuDialHandler(w http.ResponseWriter, host, port, protocol, maxMTUParam string) {
+	maxMTU := 9000
+	if maxMTUParam != "" {
+		var err error
+		if maxMTU, err = strconv.Atoi(maxMTUParam); err != nil || maxMTU < 1280 || maxMTU > 65535 {
+			http.Error(w, fmt.Sprintf("maxMTU parameter must be an integer between 1280 and 65535, got %q", maxMTUParam), http.StatusBadRequest)
+			return
+		}
+	}
+	protocol = strings.ToLower(protocol)
+	switch protocol {
+	case "":
+		protocol = "http"
+	case "http", "tcp", "udp":
+	default:
+		http.Error(w, fmt.Sprintf("unsupported protocol for mode mtu. %s", protocol), http.StatusBadRequest)
+		return
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("host param is invalid. %v", err), http.StatusBadRequest)
+		return
+	}
+	// Probe the first address of each family.
+	var targets []net.IP
+	var seenV4, seenV6 bool
+	for _, ip := range ips {
+		if ip.To4() != nil && !seenV4 {
+			seenV4 = true
+			targets = append(targets, ip)
+		} else if ip.To4() == nil && !seenV6 {
+			seenV6 = true
+			targets = append(targets, ip)
+		}
+	}
+	results := make([]MTUResult, 0, len(targets))
+	for _, ip := range targets {
+		address := net.JoinHostPort(ip.String(), port)
+		if protocol == "udp" {
+			results = append(results, probeUDPPathMTU(ip, address, maxMTU))
+		} else {
+			results = append(results, probeTCPPathMTU(ip, address, protocol, maxMTU))
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string][]MTUResult{"results": results})
+}
+
+// ipFamily returns the address family name of ip and the size of its header.
+func ipFamily(ip net.IP) (string, int) {
+	if ip.To4() != nil {
+		return "ipv4", 20
+	}
+	return "ipv6", 40
+}
+
+// searchLargest returns the largest size in [lo, hi] for which probe succeeds,
+// assuming that it succeeds up to some size and fails above it. It returns
+// false if probe fails even for lo.
+func searchLargest(lo, hi int, probe func(int) bool) (int, bool) {
+	if probe(hi) {
+		return hi, true
+	}
+	if !probe(lo) {
+		return 0, false
+	}
+	// probe(lo) succeeded and probe(hi) failed.
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if probe(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, true
+}
+
+// probeUDPPathMTU sends "echo" commands of increasing size with the DF bit
+// set to the netexec UDP server at address.
+func probeUDPPathMTU(ip net.IP, address string, maxMTU int) MTUResult {
+	family, ipHeader := ipFamily(ip)
+	result := MTUResult{Family: family, Address: address, Protocol: "udp"}
+	dialer := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if family == "ipv4" {
+				sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+			} else {
+				sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}}
+	conn, err := dialer.Dial("udp", address)
+	if err != nil {
+		result.Error = fmt.Sprintf("udp dial failed. err:%v", err)
+		return result
+	}
+	defer conn.Close()
+
+	overhead := ipHeader + 8
+	buf := make([]byte, 65535)
+	probe := func(size int) bool {
+		result.Probes++
+		request := "echo " + strings.Repeat("x", size-len("echo "))
+		expected := size - len("echo ")
+		for attempt := 0; attempt < 2; attempt++ {
+			if _, err := conn.Write([]byte(request)); err != nil {
+				// EMSGSIZE: larger than the MTU the kernel already knows.
+				return false
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			for {
+				n, err := conn.Read(buf)
+				if err != nil {
+					break
+				}
+				// Ignore late replies to earlier probes.
+				if n == expected {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	payload, ok := searchLargest(64, maxMTU-overhead, probe)
+	if !ok {
+		result.Error = "no reply even for a 64 bytes payload"
+		return result
+	}
+	result.MaxPayload = payload
+	result.PathMTU = payload + overhead
+	result.KernelPathMTU = kernelPathMTU(conn, family)
+	return result
+}
+
+// probeTCPPathMTU clamps the MSS of new connections to the netexec TCP or
+// HTTP server at address, and checks that echoing several full segments
+// completes. Without working PMTU discovery, too large segments are black
+// holed and the echo times out.
+func probeTCPPathMTU(ip net.IP, address, protocol string, maxMTU int) MTUResult {
+	family, ipHeader := ipFamily(ip)
+	result := MTUResult{Family: family, Address: address, Protocol: protocol}
+	overhead := ipHeader + 20
+	minMSS := 536
+	if family == "ipv6" {
+		minMSS = 1220
+	}
+	kernelMTU := 0
+	probe := func(mss int) bool {
+		result.Probes++
+		dialer := net.Dialer{
+			Timeout: 2 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				var sockErr error
+				err := c.Control(func(fd uintptr) {
+					sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG, mss)
+				})
+				if err != nil {
+					return err
+				}
+				return sockErr
+			},
+		}
+		conn, err := dialer.Dial("tcp", address)
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+		msg := strings.Repeat("x", 4*mss)
+		var reply []byte
+		if protocol == "tcp" {
+			if _, err = fmt.Fprintf(conn, "echo %s\n", msg); err == nil {
+				reply, err = bufio.NewReader(conn).ReadBytes('\n')
+			}
+		} else {
+			body := "msg=" + msg
+			if _, err = fmt.Fprintf(conn, "POST /echo HTTP/1.1\r\nHost: %s\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", address, len(body), body); err == nil {
+				reply, err = io.ReadAll(conn)
+			}
+		}
+		if err != nil || !bytes.Contains(reply, []byte(msg)) {
+			return false
+		}
+		kernelMTU = kernelPathMTU(conn, family)
+		return true
+	}
+	mss, ok := searchLargest(minMSS, maxMTU-overhead, probe)
+	if !ok {
+		result.Error = fmt.Sprintf("echo failed even with a %d bytes MSS", minMSS)
+		return result
+	}
+	result.MaxSegmentSize = mss
+	result.PathMTU = mss + overhead
+	result.KernelPathMTU = kernelMTU
+	// The kernel never sends segments larger than the path MTU it knows of,
+	// whatever MSS the connection negotiated.
+	if kernelMTU > 0 && kernelMTU < result.PathMTU {
+		result.PathMTU = kernelMTU
+	}
+	return result
+}
+
+// kernelPathMTU returns the path MTU the kernel cached for a connected socket,
+// or 0 if it is unknown.
+func kernelPathMTU(conn net.Conn, family string) int {
+	syscallConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0
+	}
+	raw, err := syscallConn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	mtu := 0
+	_ = raw.Control(func(fd uintptr) {
+		if family == "ipv4" {
+			mtu, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU)
+		} else {
+			mtu, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU)
+		}
+	})
+	return mtu
+}
@@ -0,0 +1,251 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	netutils "k8s.io/utils/net"
+)
+
+// MulticastResult is the JSON answer of /dial?mode=multicast.
+type MulticastResult struct {
+	Group string `json:"group"`
+	// Responders lists every address that answered within the window.
+	Responders []MulticastResponder `json:"responders"`
+	Errors     []string             `json:"errors,omitempty"`
+}
+
+// MulticastResponder is a member of a multicast group that answered.
+type MulticastResponder struct {
+	From     string `json:"from"`
+	Response string `json:"response"`
+	// Replies counts the identical replies, more than one if "tries" is.
+	Replies int `json:"replies"`
+}
+
+// parseMulticastGroups parses a comma separated list of multicast addresses.
+func parseMulticastGroups(groups string) ([]net.IP, error) {
+	var res []net.IP
+	for _, group := range strings.Split(groups, ",") {
+		ip := netutils.ParseIPSloppy(strings.TrimSpace(group))
+		if ip == nil || !ip.IsMulticast() {
+			return nil, fmt.Errorf("invalid multicast group %q", group)
+		}
+		res = append(res, ip)
+	}
+	return res, nil
+}
+
+// parseInterfaces parses a comma separated list of interface names. An empty
+// list returns a nil interface, which lets the kernel choose.
+func parseInterfaces(names string) ([]*net.Interface, error) {
+	if names == "" {
+		return []*net.Interface{nil}, nil
+	}
+	var res []*net.Interface
+	for _, name := range strings.Split(names, ",") {
+		ifi, err := net.InterfaceByName(strings.TrimSpace(name))
+		if err != nil {
+			return nil, fmt.Errorf("invalid interface %q: %v", name, err)
+		}
+		res = append(res, ifi)
+	}
+	return res, nil
+}
+
+func udpNetwork(ip net.IP) string {
+	if ip.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// listenMulticast joins every configured group on every configured interface.
+func (s *Server) listenMulticast() error {
+	c := &s.config.Multicast
+	groups, err := parseMulticastGroups(c.Groups)
+	if err != nil {
+		return err
+	}
+	interfaces, err := parseInterfaces(c.Interfaces)
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		for _, ifi := range interfaces {
+			conn, err := net.ListenMulticastUDP(udpNetwork(group), ifi, &net.UDPAddr{IP: group, Port: c.Port})
+			if err != nil {
+				return fmt.Errorf("failed to join multicast group %s on interface %s: %v", group, interfaceName(ifi), err)
+			}
+			log.Printf("Joined multicast group %s port %d on interface %s", group, c.Port, interfaceName(ifi))
+			s.multicastConns = append(s.multicastConns, conn)
+		}
+	}
+	return nil
+}
+
+func interfaceName(ifi *net.Interface) string {
+	if ifi == nil {
+		return "default"
+	}
+	return ifi.Name
+}
+
+// serveMulticast answers the hostName, echo and clientIP commands sent to a
+// multicast group, with unicast replies.
+func (s *Server) serveMulticast(conn *net.UDPConn) {
+	defer conn.Close()
+	buf := make([]byte, 65535)
+	for {
+		n, clientAddress, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			s.serveFailed("multicast", err)
+			return
+		}
+		receivedText := strings.ToLower(strings.TrimSpace(string(buf[0:n])))
+		resp, ok := s.commandResponse("multicast", receivedText, clientAddress.String(), nil)
+		if !ok {
+			continue
+		}
+		if _, err := conn.WriteToUDP([]byte(resp), clientAddress); err != nil {
+			log.Printf("Failed to write to multicast client %s: %v", clientAddress, err)
+		}
+	}
+}
+
+// multicastDialHandler serves /dial?mode=multicast: it sends the request to
+// the multicast group host "tries" times, and collects the replies of every
+// member for "window".
+func multicastDialHandler(w http.ResponseWriter, r *http.Request, host, port, request string) {
+	group := netutils.ParseIPSloppy(host)
+	if group == nil || !group.IsMulticast() {
+		http.Error(w, fmt.Sprintf("host parameter must be a multicast group, got %q", host), http.StatusBadRequest)
+		return
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil || portNumber <= 0 || portNumber > 65535 {
+		http.Error(w, fmt.Sprintf("port parameter must be a port number, got %q", port), http.StatusBadRequest)
+		return
+	}
+	if len(request) == 0 {
+		http.Error(w, "request parameter not specified.", http.StatusBadRequest)
+		return
+	}
+	window := 2 * time.Second
+	if windowParam := r.FormValue("window"); windowParam != "" {
+		if window, err = time.ParseDuration(windowParam); err != nil || window <= 0 || window > time.Minute {
+			http.Error(w, fmt.Sprintf("window parameter must be a positive golang duration up to 1m, got %q", windowParam), http.StatusBadRequest)
+			return
+		}
+	}
+	tries := 1
+	if triesParam := r.FormValue("tries"); triesParam != "" {
+		if tries, err = strconv.Atoi(triesParam); err != nil || tries < 1 {
+			http.Error(w, fmt.Sprintf("tries parameter is invalid. %q", triesParam), http.StatusBadRequest)
+			return
+		}
+	}
+	ttl := 1
+	if ttlParam := r.FormValue("ttl"); ttlParam != "" {
+		if ttl, err = strconv.Atoi(ttlParam); err != nil || ttl < 1 || ttl > 255 {
+			http.Error(w, fmt.Sprintf("ttl parameter must be an integer between 1 and 255, got %q", ttlParam), http.StatusBadRequest)
+			return
+		}
+	}
+	var ifi *net.Interface
+	if name := r.FormValue("interface"); name != "" {
+		if ifi, err = net.InterfaceByName(name); err != nil {
+			http.Error(w, fmt.Sprintf("interface parameter is invalid. %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Printf("Sending %q to multicast group %s port %d on interface %s, collecting replies for %v", request, group, portNumber, interfaceName(ifi), window)
+	result := MulticastResult{Group: net.JoinHostPort(group.String(), port), Responders: []MulticastResponder{}}
+	conn, err := net.ListenUDP(udpNetwork(group), nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to create the multicast socket. %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	if err := setMulticastOptions(conn, group, ifi, ttl); err != nil {
+		http.Error(w, fmt.Sprintf("failed to set the multicast socket options. %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	destination := &net.UDPAddr{IP: group, Port: portNumber}
+	if ifi != nil && group.To4() == nil {
+		destination.Zone = ifi.Name
+	}
+	for i := 0; i < tries; i++ {
+		if _, err := conn.WriteToUDP([]byte(request), destination); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%v", err))
+		}
+	}
+
+	responders := map[string]*MulticastResponder{}
+	_ = conn.SetReadDeadline(time.Now().Add(window))
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+				result.Errors = append(result.Errors, fmt.Sprintf("%v", err))
+			}
+			break
+		}
+		// Several members may share an address, e.g. with host networking.
+		key := from.String() + "\x00" + string(buf[:n])
+		responder, ok := responders[key]
+		if !ok {
+			responder = &MulticastResponder{From: from.String(), Response: string(buf[:n])}
+			responders[key] = responder
+		}
+		responder.Replies++
+	}
+	for _, responder := range responders {
+		result.Responders = append(result.Responders, *responder)
+	}
+	sort.Slice(result.Responders, func(i, j int) bool {
+		if result.Responders[i].From != result.Responders[j].From {
+			return result.Responders[i].From < result.Responders[j].From
+		}
+		return result.Responders[i].Response < result.Responders[j].Response
+	})
+	writeJSON(w, http.StatusOK, result)
+}
+
+// setMulticastOptions sets the outgoing interface and TTL (or hop limit) of
+// the multicast packets sent on conn.
+func setMulticastOptions(conn *net.UDPConn, group net.IP, ifi *net.Interface, ttl int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if group.To4() != nil {
+			if sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_TTL, ttl); sockErr == nil && ifi != nil {
+				sockErr = unix.SetsockoptIPMreqn(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_IF, &unix.IPMreqn{Ifindex: int32(ifi.Index)})
+			}
+			return
+		}
+		if sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, ttl); sockErr == nil && ifi != nil {
+			sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_IF, ifi.Index)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
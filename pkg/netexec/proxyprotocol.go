@@ -0,0 +1,332 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyV1Signature and proxyV2Signature start the v1 (text) and v2 (binary)
+// HAProxy PROXY protocol headers.
+var (
+	proxyV1Signature = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyHeaderTimeout bounds the wait for the PROXY protocol header of a
+// connection.
+var proxyHeaderTimeout = 5 * time.Second
+
+// proxyTLVNames names the well-known PROXY protocol v2 TLV types.
+var proxyTLVNames = map[byte]string{
+	0x01: "ALPN",
+	0x02: "AUTHORITY",
+	0x03: "CRC32C",
+	0x04: "NOOP",
+	0x05: "UNIQUE_ID",
+	0x20: "SSL",
+	0x30: "NETNS",
+	0xE0: "GCP",
+	0xEA: "AWS",
+	0xEE: "AZURE",
+}
+
+// ProxyHeader is a parsed PROXY protocol header.
+type ProxyHeader struct {
+	Version     int        `json:"version"`
+	Command     string     `json:"command"`
+	Source      string     `json:"source,omitempty"`
+	Destination string     `json:"destination,omitempty"`
+	TLVs        []ProxyTLV `json:"tlvs,omitempty"`
+
+	sourceAddr net.Addr
+}
+
+// ProxyTLV is a PROXY protocol v2 TLV. Value is hex encoded unless printable.
+type ProxyTLV struct {
+	Type  byte   `json:"type"`
+	Name  string `json:"name,omitempty"`
+	Value string `json:"value"`
+}
+
+// proxyProtocolListener accepts (or, if required, demands) a PROXY protocol
+// header at the start of every connection.
+type proxyProtocolListener struct {
+	net.Listener
+	required bool
+}
+
+// newProxyProtocolListener wraps ln according to the --proxy-protocol mode.
+func newProxyProtocolListener(ln net.Listener, mode string) net.Listener {
+	if mode == "" {
+		return ln
+	}
+	return &proxyProtocolListener{Listener: ln, required: mode == "require"}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), required: l.required}, nil
+}
+
+// proxyConn parses the PROXY protocol header lazily, on the first call that
+// needs it, so that a slow client does not block the accept loop.
+type proxyConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	required bool
+
+	once   sync.Once
+	header *ProxyHeader
+	err    error
+}
+
+// NetConn returns the connection wrapped by c, like tls.Conn does.
+func (c *proxyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.header, c.err = readProxyHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if c.err == nil && c.header == nil && c.required {
+			c.err = fmt.Errorf("PROXY protocol header required")
+		}
+		if c.err != nil {
+			log.Printf("Rejecting connection from %s: %v", c.Conn.RemoteAddr(), c.err)
+			// Look like a failed read so that servers drop the connection
+			// instead of answering it.
+			c.err = &net.OpError{Op: "read", Net: "tcp", Source: c.Conn.LocalAddr(), Addr: c.Conn.RemoteAddr(), Err: c.err}
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address carried by the PROXY header, if any.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.header != nil && c.header.sourceAddr != nil {
+		return c.header.sourceAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// proxyHeader returns the parsed PROXY header, or nil if the client sent none.
+func (c *proxyConn) proxyHeader() *ProxyHeader {
+	c.init()
+	return c.header
+}
+
+// readProxyHeader consumes a v1 or v2 PROXY header from r. It returns a nil
+// header if the connection does not start with one.
+func readProxyHeader(r *bufio.Reader) (*ProxyHeader, error) {
+	// Peek one more byte at a time: the client may legitimately send less
+	// than a full signature and wait for an answer.
+	for n := 1; ; n++ {
+		peeked, err := r.Peek(n)
+		if err != nil {
+			if err == io.EOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+		switch {
+		case bytes.HasPrefix(peeked, proxyV1Signature):
+			return readProxyV1Header(r)
+		case bytes.HasPrefix(peeked, proxyV2Signature):
+			return readProxyV2Header(r)
+		case !bytes.HasPrefix(proxyV1Signature, peeked) && !bytes.HasPrefix(proxyV2Signature, peeked):
+			return nil, nil
+		}
+	}
+}
+
+func readProxyV1Header(r *bufio.Reader) (*ProxyHeader, error) {
+	// A v1 header is at most 107 bytes long, CRLF included.
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY v1 header: %v", err)
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY v1 header is too long")
+	}
+	fields := strings.Fields(string(line))
+	header := &ProxyHeader{Version: 1, Command: "PROXY"}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY v1 header %q", strings.TrimSpace(string(line)))
+	}
+	src, err := parseProxyV1Address(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 source address: %v", err)
+	}
+	dst, err := parseProxyV1Address(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 destination address: %v", err)
+	}
+	header.sourceAddr = src
+	header.Source = src.String()
+	header.Destination = dst.String()
+	return header, nil
+}
+
+// parseProxyV1Address parses the literal IP address of family, "TCP4" or
+// "TCP6", and the port of a v1 header.
+func parseProxyV1Address(family, ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (family == "TCP6") != strings.Contains(ip, ":") {
+		return nil, fmt.Errorf("invalid %s address %q", family, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readProxyV2Header(r *bufio.Reader) (*ProxyHeader, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 header: %v", err)
+	}
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", fixed[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY v2 addresses: %v", err)
+	}
+	header := &ProxyHeader{Version: 2}
+	switch fixed[12] & 0x0F {
+	case 0:
+		header.Command = "LOCAL"
+	case 1:
+		header.Command = "PROXY"
+	default:
+		return nil, fmt.Errorf("unsupported PROXY v2 command 0x%x", fixed[12]&0x0F)
+	}
+	// The addresses of LOCAL connections are ignored, whatever their
+	// transport; the proxied ones must be streams, like the listeners.
+	if header.Command == "PROXY" && fixed[13]&0x0F != 1 {
+		return nil, fmt.Errorf("unsupported PROXY v2 transport 0x%x", fixed[13]&0x0F)
+	}
+	var addressLen int
+	switch fixed[13] >> 4 {
+	case 1: // AF_INET
+		addressLen = 12
+	case 2: // AF_INET6
+		addressLen = 36
+	case 3: // AF_UNIX
+		addressLen = 216
+	}
+	if len(payload) < addressLen {
+		return nil, fmt.Errorf("PROXY v2 header is too short for its address family")
+	}
+	if header.Command == "PROXY" && (addressLen == 12 || addressLen == 36) {
+		ipLen := (addressLen - 4) / 2
+		src := &net.TCPAddr{IP: net.IP(payload[:ipLen]), Port: int(binary.BigEndian.Uint16(payload[2*ipLen:]))}
+		dst := &net.TCPAddr{IP: net.IP(payload[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))}
+		header.sourceAddr = src
+		header.Source = src.String()
+		header.Destination = dst.String()
+	}
+	tlvs := payload[addressLen:]
+	for len(tlvs) >= 3 {
+		length := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return nil, fmt.Errorf("PROXY v2 TLV 0x%02x is truncated", tlvs[0])
+		}
+		header.TLVs = append(header.TLVs, newProxyTLV(tlvs[0], tlvs[3:3+length]))
+		tlvs = tlvs[3+length:]
+	}
+	return header, nil
+}
+
+func newProxyTLV(t byte, value []byte) ProxyTLV {
+	tlv := ProxyTLV{Type: t, Name: proxyTLVNames[t], Value: hex.EncodeToString(value)}
+	printable := len(value) > 0
+	for _, b := range value {
+		if b < 0x20 || b > 0x7E {
+			printable = false
+			break
+		}
+	}
+	if printable {
+		tlv.Value = string(value)
+	}
+	return tlv
+}
+
+// connContextKey stores the accepted net.Conn in each HTTP request's context.
+type connContextKey struct{}
+
+func saveConnInContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// requestConn returns the connection a request arrived on, or nil.
+func requestConn(r *http.Request) net.Conn {
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	return conn
+}
+
+// innerConn returns the connection wrapped by conn, or nil.
+func innerConn(conn net.Conn) net.Conn {
+	if wrapper, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		return wrapper.NetConn()
+	}
+	return nil
+}
+
+func underlyingTCPConn(conn net.Conn) (*net.TCPConn, bool) {
+	for ; conn != nil; conn = innerConn(conn) {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			return tcpConn, true
+		}
+	}
+	return nil, false
+}
+
+func underlyingProxyConn(conn net.Conn) (*proxyConn, bool) {
+	for ; conn != nil; conn = innerConn(conn) {
+		if pc, ok := conn.(*proxyConn); ok {
+			return pc, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// proxyV2Header builds a PROXY protocol v2 header.
+func proxyV2Header(versionCommand, family byte, addresses []byte, tlvs ...[]byte) []byte {
+	payload := append([]byte{}, addresses...)
+	for _, tlv := range tlvs {
+		payload = append(payload, tlv...)
+	}
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, versionCommand, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func proxyV2TLV(t byte, value string) []byte {
+	return append([]byte{t, 0, byte(len(value))}, value...)
+}
+
+var (
+	proxyV2IPv4 = []byte{192, 0, 2, 1, 127, 0, 0, 1, 0x9c, 0x40, 0, 80}
+	proxyV2IPv6 = append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("::1").To16()...), 0x9c, 0x40, 0, 80)
+)
+
+type proxyProtocolCase struct {
+	mode string
+	sent string
+	// closeWrite ends the connection after what was sent.
+	closeWrite bool
+	// remoteAddr is the expected address of the client, its own one if
+	// empty, and err the expected error instead.
+	remoteAddr string
+	command    string
+	tlvs       []ProxyTLV
+	err        string
+}
+
+var _ = Describe("PROXY protocol listener", Label("netexec"), func() {
+	// accept sends sent to a proxyProtocolListener of mode, and returns the
+	// accepted connection and the client side.
+	accept := func(mode, sent string, closeWrite bool) (net.Conn, net.Conn) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(listener.Close)
+		client, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(client.Close)
+		_, err = client.Write([]byte(sent))
+		Expect(err).NotTo(HaveOccurred())
+		if closeWrite {
+			Expect(client.(*net.TCPConn).CloseWrite()).To(Succeed())
+		}
+		conn, err := newProxyProtocolListener(listener, mode).Accept()
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(conn.Close)
+		return conn, client
+	}
+
+	DescribeTable("parses the headers of the connections",
+		func(c proxyProtocolCase) {
+			conn, client := accept(c.mode, c.sent, c.closeWrite)
+			received := make([]byte, len("hello"))
+			_, err := io.ReadFull(conn, received)
+			if c.err != "" {
+				Expect(err).To(MatchError(ContainSubstring(c.err)))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(received)).To(Equal("hello"))
+			if c.remoteAddr == "" {
+				c.remoteAddr = client.LocalAddr().String()
+			}
+			Expect(conn.RemoteAddr().String()).To(Equal(c.remoteAddr))
+			header := conn.(*proxyConn).proxyHeader()
+			if c.command == "" {
+				Expect(header).To(BeNil())
+				return
+			}
+			Expect(header.Command).To(Equal(c.command))
+			Expect(header.TLVs).To(Equal(c.tlvs))
+		},
+		Entry("v1 TCP4", proxyProtocolCase{mode: "accept", sent: "PROXY TCP4 192.0.2.1 127.0.0.1 40000 80\r\nhello",
+			remoteAddr: "192.0.2.1:40000", command: "PROXY"}),
+		Entry("v1 TCP6", proxyProtocolCase{mode: "accept", sent: "PROXY TCP6 2001:db8::1 ::1 40000 80\r\nhello",
+			remoteAddr: "[2001:db8::1]:40000", command: "PROXY"}),
+		Entry("v1 UNKNOWN", proxyProtocolCase{mode: "require", sent: "PROXY UNKNOWN\r\nhello", command: "PROXY"}),
+		Entry("v2 TCP4 with TLVs", proxyProtocolCase{mode: "accept",
+			sent:       string(proxyV2Header(0x21, 0x11, proxyV2IPv4, proxyV2TLV(0x02, "example.com"), proxyV2TLV(0x05, "\x00\x01"))) + "hello",
+			remoteAddr: "192.0.2.1:40000", command: "PROXY",
+			tlvs: []ProxyTLV{{Type: 0x02, Name: "AUTHORITY", Value: "example.com"}, {Type: 0x05, Name: "UNIQUE_ID", Value: "0001"}}}),
+		Entry("v2 TCP6", proxyProtocolCase{mode: "accept", sent: string(proxyV2Header(0x21, 0x21, proxyV2IPv6)) + "hello",
+			remoteAddr: "[2001:db8::1]:40000", command: "PROXY"}),
+		Entry("v2 LOCAL", proxyProtocolCase{mode: "require", sent: string(proxyV2Header(0x20, 0x11, proxyV2IPv4)) + "hello", command: "LOCAL"}),
+		Entry("no header", proxyProtocolCase{mode: "accept", sent: "hello"}),
+		Entry("no header when required", proxyProtocolCase{mode: "require", sent: "hello", err: "PROXY protocol header required"}),
+		Entry("truncated v1", proxyProtocolCase{mode: "accept", sent: "PROXY TCP4 192.0.2.1", closeWrite: true,
+			err: "failed to read PROXY v1 header"}),
+		Entry("malformed v1", proxyProtocolCase{mode: "accept", sent: "PROXY TCP4 192.0.2.1\r\nhello", err: "malformed PROXY v1 header"}),
+		Entry("malformed v1 address", proxyProtocolCase{mode: "accept", sent: "PROXY TCP4 192.0.2.x 127.0.0.1 40000 80\r\nhello",
+			err: "malformed PROXY v1 source address"}),
+		Entry("v1 host name", proxyProtocolCase{mode: "accept", sent: "PROXY TCP4 localhost 127.0.0.1 40000 80\r\nhello",
+			err: `malformed PROXY v1 source address: invalid TCP4 address "localhost"`}),
+		Entry("v1 address of the other family", proxyProtocolCase{mode: "accept", sent: "PROXY TCP4 192.0.2.1 ::1 40000 80\r\nhello",
+			err: `malformed PROXY v1 destination address: invalid TCP4 address "::1"`}),
+		Entry("v1 IPv4 address as TCP6", proxyProtocolCase{mode: "accept", sent: "PROXY TCP6 192.0.2.1 ::1 40000 80\r\nhello",
+			err: `malformed PROXY v1 source address: invalid TCP6 address "192.0.2.1"`}),
+		Entry("v1 port out of range", proxyProtocolCase{mode: "accept", sent: "PROXY TCP4 192.0.2.1 127.0.0.1 70000 80\r\nhello",
+			err: `malformed PROXY v1 source address: invalid port "70000"`}),
+		Entry("v1 service name", proxyProtocolCase{mode: "accept", sent: "PROXY TCP4 192.0.2.1 127.0.0.1 40000 http\r\nhello",
+			err: `malformed PROXY v1 destination address: invalid port "http"`}),
+		Entry("too long v1", proxyProtocolCase{mode: "accept", sent: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\nhello",
+			err: "PROXY v1 header is too long"}),
+		Entry("truncated v2", proxyProtocolCase{mode: "accept", sent: string(proxyV2Header(0x21, 0x11, proxyV2IPv4)[:20]), closeWrite: true,
+			err: "failed to read PROXY v2 addresses"}),
+		Entry("v2 of another version", proxyProtocolCase{mode: "accept", sent: string(proxyV2Header(0x31, 0x11, proxyV2IPv4)) + "hello",
+			err: "unsupported PROXY protocol version 3"}),
+		Entry("v2 LOCAL of an unspecified family", proxyProtocolCase{mode: "require", sent: string(proxyV2Header(0x20, 0x00, nil)) + "hello",
+			command: "LOCAL"}),
+		Entry("v2 of an unknown command", proxyProtocolCase{mode: "accept", sent: string(proxyV2Header(0x22, 0x11, proxyV2IPv4)) + "hello",
+			err: "unsupported PROXY v2 command 0x2"}),
+		Entry("v2 datagram", proxyProtocolCase{mode: "accept", sent: string(proxyV2Header(0x21, 0x12, proxyV2IPv4)) + "hello",
+			err: "unsupported PROXY v2 transport 0x2"}),
+		Entry("v2 of an unspecified transport", proxyProtocolCase{mode: "accept", sent: string(proxyV2Header(0x21, 0x10, proxyV2IPv4)) + "hello",
+			err: "unsupported PROXY v2 transport 0x0"}),
+		Entry("v2 too short for its family", proxyProtocolCase{mode: "accept", sent: string(proxyV2Header(0x21, 0x11, proxyV2IPv4[:4])) + "hello",
+			err: "too short for its address family"}),
+		Entry("v2 with a truncated TLV", proxyProtocolCase{mode: "accept", sent: string(proxyV2Header(0x21, 0x11, proxyV2IPv4, []byte{0x02, 0, 9, 'x'})) + "hello",
+			err: "PROXY v2 TLV 0x02 is truncated"}),
+	)
+
+	It("gives up on the headers that do not arrive in time", func() {
+		defer func(timeout time.Duration) { proxyHeaderTimeout = timeout }(proxyHeaderTimeout)
+		proxyHeaderTimeout = 100 * time.Millisecond
+		conn, _ := accept("accept", "PROXY TCP4 192.0.2.1", false)
+		start := time.Now()
+		_, err := conn.Read(make([]byte, 1))
+		Expect(err).To(MatchError(ContainSubstring("i/o timeout")))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(conn.RemoteAddr().String()).NotTo(HavePrefix("192.0.2.1"))
+	})
+})
@@ -0,0 +1,781 @@
+// Copyright Authors of Kubernetes.
+// SPDX-License-Identifier: Apache-2.0
+
+/*
+Copyright 2014 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package netexec implements the netexec test servers: an HTTP(S) server with
+// endpoints to inspect and break the traffic it receives, plus optional UDP,
+// SCTP, TCP and gRPC servers answering simple commands.
+package netexec
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ishidawataru/sctp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+	netutils "k8s.io/utils/net"
+)
+
+// atomicBool uses load/store operations on an int32 to simulate an atomic boolean.
+type atomicBool struct {
+	v int32
+}
+
+// set sets the int32 to the given boolean.
+func (a *atomicBool) set(value bool) {
+	if value {
+		atomic.StoreInt32(&a.v, 1)
+		return
+	}
+	atomic.StoreInt32(&a.v, 0)
+}
+
+// get returns true if the int32 == 1
+func (a *atomicBool) get() bool {
+	return atomic.LoadInt32(&a.v) == 1
+}
+
+// shellPath is the shell running the /shell commands.
+var shellPath = "/bin/sh"
+
+// Server is a netexec instance: an HTTP(S) server, plus the UDP, SCTP, TCP
+// and gRPC servers its Config enables. Servers are independent from each
+// other, so that tests can run several of them in one process.
+type Server struct {
+	// inFlight counts the HTTP requests being served. It comes first to be
+	// 64-bit aligned for atomic operations.
+	inFlight int64
+	config   Config
+	hostname string
+	// ready is set while a UDP or SCTP server runs, see /healthz.
+	ready   atomicBool
+	closing atomicBool
+	// terminating is set by Terminate, which makes /healthz fail.
+	terminating    atomicBool
+	terminateOnce  sync.Once
+	termination    termination
+	faults         *faultStore
+	metrics        metricsRegistry
+	faultsInjected *counterVec
+	limiter        *limiter
+	tracer         *tracer
+	jobs           *jobStore
+	vhosts         virtualHosts
+
+	// conns are the TCP command and hijacked HTTP connections.
+	conns connTracker
+
+	mu      sync.Mutex
+	started bool
+	done    chan struct{}
+	// stopped is closed once Shutdown returns.
+	stopped      chan struct{}
+	httpServer   *http.Server
+	httpListener *misbehavingListener
+	udpConns     []*net.UDPConn
+	sctpListener *sctp.SCTPListener
+	tcpListener  *misbehavingListener
+	grpcServer   *grpc.Server
+	grpcListener net.Listener
+	// multicastConns joined the multicast groups.
+	multicastConns []*net.UDPConn
+
+	exitOnce sync.Once
+	exitCh   chan int
+}
+
+// NewServer validates cfg and returns a Server that is not started yet.
+func NewServer(cfg Config) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	s := &Server{
+		config:   cfg,
+		hostname: cfg.Hostname,
+		faults:   newFaultStore(),
+		jobs:     newJobStore(time.Duration(cfg.JobRetention) * time.Second),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		exitCh:   make(chan int, 1),
+	}
+	if s.hostname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get hostname: %v", err)
+		}
+		s.hostname = hostname
+	}
+	s.faultsInjected = s.metrics.newCounterVec("netexec_faults_injected_total",
+		"Number of responses affected by fault rules.", "rule", "protocol", "action")
+	vhosts, err := newVirtualHosts(cfg.HTTP.VirtualHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the virtual hosts: %v", err)
+	}
+	s.vhosts = vhosts
+	tracer, err := newTracer(cfg.Tracing, s.hostname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the tracer: %v", err)
+	}
+	s.tracer = tracer
+	s.limiter = newLimiter(cfg.Limits, s.metrics.newCounterVec("netexec_limited_total",
+		"Number of requests, commands and connections refused by the limits.", "protocol", "limit"))
+	s.metrics.newGaugeFunc("netexec_requests_in_flight", "Number of HTTP requests being served.",
+		func() float64 { return float64(s.limiter.usage().RequestsInFlight) })
+	s.metrics.newGaugeFunc("netexec_connections", "Number of open HTTP, TCP and gRPC connections.",
+		func() float64 { return float64(s.limiter.usage().Connections) })
+	return s, nil
+}
+
+// Start creates the listeners of every enabled server, so that their
+// addresses are known once it returns, then serves them in the background.
+// Cancelling ctx shuts the server down.
+func (s *Server) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return fmt.Errorf("server already started")
+	}
+	s.started = true
+	if err := s.listen(); err != nil {
+		s.closeListeners()
+		return err
+	}
+
+	for _, conn := range s.udpConns {
+		go s.serveUDP(conn)
+	}
+	for _, conn := range s.multicastConns {
+		go s.serveMulticast(conn)
+	}
+	if s.sctpListener != nil {
+		go s.serveSCTP(s.sctpListener)
+	}
+	if s.tcpListener != nil {
+		go s.serveTCP(s.tcpListener)
+	}
+	if s.grpcServer != nil {
+		go func() {
+			log.Printf("Started gRPC server on %s", s.grpcListener.Addr())
+			if err := s.grpcServer.Serve(s.grpcListener); err != nil {
+				s.serveFailed("gRPC", err)
+			}
+		}()
+	}
+	go func() {
+		log.Printf("Started HTTP server on %s", s.httpListener.Addr())
+		var err error
+		if len(s.config.HTTP.TLSCertFile) > 0 {
+			err = s.httpServer.ServeTLS(s.httpListener, s.config.HTTP.TLSCertFile, s.config.HTTP.TLSPrivateKeyFile)
+		} else {
+			err = s.httpServer.Serve(s.httpListener)
+		}
+		if err != http.ErrServerClosed {
+			s.serveFailed("HTTP", err)
+		}
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := s.Shutdown(context.Background()); err != nil {
+				log.Printf("Shutdown completed with: %v", err)
+			}
+		case <-s.done:
+		}
+	}()
+	return nil
+}
+
+// listen creates the listeners and servers Start serves.
+func (s *Server) listen() error {
+	c := &s.config
+	if c.UDP.Port != -1 {
+		udpBindTo, err := parseAddresses(c.UDP.ListenAddresses)
+		if err != nil {
+			return err
+		}
+		for _, address := range udpBindTo {
+			serverAddress, err := net.ResolveUDPAddr("udp", listenAddress(address, c.UDP.Port))
+			if err != nil {
+				return fmt.Errorf("failed to resolve UDP address for port %d: %v", c.UDP.Port, err)
+			}
+			conn, err := net.ListenUDP("udp", serverAddress)
+			if err != nil {
+				return fmt.Errorf("failed to create listener for UDP address %v: %v", serverAddress, err)
+			}
+			receiveHeaders(conn)
+			s.udpConns = append(s.udpConns, conn)
+		}
+	}
+
+	if c.Multicast.Groups != "" {
+		if err := s.listenMulticast(); err != nil {
+			return err
+		}
+	}
+
+	if c.SCTP.Port != -1 {
+		serverAddress, err := sctp.ResolveSCTPAddr("sctp", listenAddress(c.SCTP.Address, c.SCTP.Port))
+		if err != nil {
+			return fmt.Errorf("failed to resolve SCTP address for port %d: %v", c.SCTP.Port, err)
+		}
+		if s.sctpListener, err = sctp.ListenSCTP("sctp", serverAddress); err != nil {
+			return fmt.Errorf("failed to create listener for SCTP address %v: %v", serverAddress, err)
+		}
+	}
+
+	if c.TCP.Port != -1 {
+		listener, err := net.Listen("tcp", listenAddress(c.TCP.Address, c.TCP.Port))
+		if err != nil {
+			return fmt.Errorf("failed to create listener for TCP port %d: %v", c.TCP.Port, err)
+		}
+		receiveHeaders(listener.(*net.TCPListener))
+		listener = s.newLimitListener(newProxyProtocolListener(listener, c.proxyProtocolMode(c.TCP.ProxyProtocol)), "tcp", "")
+		s.tcpListener = newMisbehavingListener(listener)
+	}
+
+	if c.GRPC.Port != -1 {
+		listener, err := net.Listen("tcp", listenAddress(c.GRPC.Address, c.GRPC.Port))
+		if err != nil {
+			return fmt.Errorf("failed to create listener for gRPC port %d: %v", c.GRPC.Port, err)
+		}
+		s.grpcListener = s.newLimitListener(listener, "grpc", "")
+		s.grpcServer = grpc.NewServer(grpc.UnaryInterceptor(s.traceUnaryInterceptor), grpc.StreamInterceptor(s.traceStreamInterceptor))
+		s.grpcServer.RegisterService(&grpcEchoServiceDesc, s)
+		reflection.Register(s.grpcServer)
+	}
+
+	listener, err := net.Listen("tcp", listenAddress(c.HTTP.Address, c.HTTP.Port))
+	if err != nil {
+		return fmt.Errorf("failed to create listener for HTTP port %d: %v", c.HTTP.Port, err)
+	}
+	receiveHeaders(listener.(*net.TCPListener))
+	// A 503 would not be understood by HTTPS clients.
+	rejection := ""
+	if c.HTTP.TLSCertFile == "" {
+		rejection = "HTTP/1.1 503 Service Unavailable\r\nRetry-After: 1\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"
+	}
+	listener = s.newLimitListener(newProxyProtocolListener(listener, c.proxyProtocolMode(c.HTTP.ProxyProtocol)), "http", rejection)
+	s.httpListener = newMisbehavingListener(listener)
+	tcpStats := newTCPStatsLogger()
+	s.httpServer = &http.Server{
+		Handler:     s.trackRequests(tcpStats.middleware(s.virtualHostMiddleware(s.traceMiddleware(s.limitMiddleware(s.faultMiddleware(s.misbehaviorMiddleware(s.routes()))))))),
+		ConnContext: saveConnInContext,
+		ConnState:   tcpStats.connState,
+	}
+	if s.vhosts.hasCertificates() {
+		s.httpServer.TLSConfig = &tls.Config{GetCertificate: s.vhosts.getCertificate}
+	}
+	return nil
+}
+
+func (s *Server) closeListeners() {
+	for _, conn := range s.udpConns {
+		conn.Close()
+	}
+	for _, conn := range s.multicastConns {
+		conn.Close()
+	}
+	if s.sctpListener != nil {
+		s.sctpListener.Close()
+	}
+	if s.tcpListener != nil {
+		s.tcpListener.Close()
+	}
+	if s.grpcListener != nil {
+		s.grpcListener.Close()
+	}
+	if s.httpListener != nil {
+		s.httpListener.Close()
+	}
+}
+
+// Shutdown cancels the running jobs, gracefully stops the HTTP and gRPC
+// servers, waiting for their requests to complete until ctx expires, closes
+// the other servers and their connections, and exports the remaining spans.
+// Concurrent calls wait for the first one to complete.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.started {
+		s.mu.Unlock()
+		return nil
+	}
+	if s.closing.get() {
+		s.mu.Unlock()
+		select {
+		case <-s.stopped:
+		case <-ctx.Done():
+		}
+		return nil
+	}
+	s.closing.set(true)
+	close(s.done)
+	s.mu.Unlock()
+	defer close(s.stopped)
+
+	// The servers are only set by Start, so they are read without the lock
+	// while draining, for the accessors not to wait for it.
+	s.jobs.close()
+	err := s.httpServer.Shutdown(ctx)
+	if s.grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			s.grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			s.grpcServer.Stop()
+		}
+	}
+	s.closeListeners()
+	s.conns.closeAll()
+	s.tracer.close(ctx)
+	return err
+}
+
+// Exited receives the exit code requested with /exit or /shutdown, or 1 if a
+// server failed. netexec exits with it; /exit has already shut the server
+// down gracefully when its timeout is not zero.
+func (s *Server) Exited() <-chan int {
+	return s.exitCh
+}
+
+func (s *Server) exit(code int) {
+	s.exitOnce.Do(func() {
+		s.exitCh <- code
+	})
+}
+
+// serveFailed handles the error that stopped one of the servers, which is
+// expected while shutting down.
+func (s *Server) serveFailed(name string, err error) {
+	if s.closing.get() {
+		return
+	}
+	log.Printf("Error occurred: failed serving %s:%v", name, err)
+	s.exit(1)
+}
+
+// HTTPAddr returns the address of the HTTP server, once started.
+func (s *Server) HTTPAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.httpListener == nil {
+		return nil
+	}
+	return s.httpListener.Addr()
+}
+
+// UDPAddrs returns the addresses of the UDP servers, once started.
+func (s *Server) UDPAddrs() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]net.Addr, 0, len(s.udpConns))
+	for _, conn := range s.udpConns {
+		addrs = append(addrs, conn.LocalAddr())
+	}
+	return addrs
+}
+
+// SCTPAddr returns the address of the SCTP server, or nil if it is disabled.
+func (s *Server) SCTPAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sctpListener == nil {
+		return nil
+	}
+	return s.sctpListener.Addr()
+}
+
+// TCPAddr returns the address of the TCP server, or nil if it is disabled.
+func (s *Server) TCPAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tcpListener == nil {
+		return nil
+	}
+	return s.tcpListener.Addr()
+}
+
+// GRPCAddr returns the address of the gRPC server, or nil if it is disabled.
+func (s *Server) GRPCAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.grpcListener == nil {
+		return nil
+	}
+	return s.grpcListener.Addr()
+}
+
+// routes returns the handler of every endpoint, or the --http-override one.
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	s.addRoutes(mux)
+	if s.config.HTTP.Override == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		overrideReq, err := http.NewRequestWithContext(r.Context(), "GET", s.config.HTTP.Override, nil)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("override request failed: %v", err), http.StatusInternalServerError)
+			return
+		}
+		mux.ServeHTTP(w, overrideReq)
+	})
+}
+
+func (s *Server) addRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/", rootHandler)
+	mux.HandleFunc("/clientinfo", s.clientInfoHandler)
+	mux.HandleFunc("/clientip", clientIPHandler)
+	mux.HandleFunc("/config", s.configHandler)
+	mux.HandleFunc("/header", headerHandler)
+	mux.HandleFunc("/dial", dialHandler)
+	mux.HandleFunc("/dns", dnsHandler)
+	mux.HandleFunc("/echo", echoHandler)
+	mux.HandleFunc("/exit", s.exitHandler)
+	mux.HandleFunc("/fault", s.faultHandler)
+	mux.HandleFunc("/healthz", s.healthzHandler)
+	mux.HandleFunc("/hostname", s.hostnameHandler)
+	mux.HandleFunc("/jobs", s.jobsHandler)
+	mux.HandleFunc("/jobs/", s.jobsHandler)
+	mux.HandleFunc("/metrics", s.metricsHandler)
+	mux.HandleFunc("/redirect", redirectHandler)
+	mux.HandleFunc("/shell", shellHandler)
+	mux.HandleFunc("/sink", sinkHandler)
+	mux.HandleFunc("/source", sourceHandler)
+	mux.HandleFunc("/sysinfo", s.sysinfoHandler)
+	mux.HandleFunc("/timestamp", timestampHandler)
+	mux.HandleFunc("/upload", uploadHandler)
+	// older handlers
+	mux.HandleFunc("/hostName", s.hostNameHandler)
+	mux.HandleFunc("/shutdown", s.shutdownHandler)
+	s.addHTTPBinRoutes(mux)
+}
+
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET /")
+	printRequest(r)
+	fmt.Fprintf(w, "NOW: %v", time.Now())
+}
+
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	printRequest(r)
+	msg := r.FormValue("msg")
+	codeString := r.FormValue("code")
+	log.Printf("GET /echo?msg=%s&code=%s", msg, codeString)
+	if codeString != "" {
+		code, err := strconv.Atoi(codeString)
+		if err != nil && codeString != "" {
+			fmt.Fprintf(w, "argument 'code' must be an integer or empty, got %q\n", codeString)
+			return
+		}
+		w.WriteHeader(code)
+	}
+	fmt.Fprintf(w, "%s", msg)
+}
+
+func headerHandler(w http.ResponseWriter, r *http.Request) {
+	printRequest(r)
+	key := r.FormValue("key")
+	if key != "" {
+		log.Printf("GET /header?key=%s", key)
+		fmt.Fprintf(w, "%s", r.Header.Get(key))
+	} else {
+		log.Printf("GET /header")
+		data, err := json.Marshal(r.Header)
+		if err != nil {
+			fmt.Fprintf(w, "error marshalling header, err: %v", err)
+			return
+		}
+		fmt.Fprintf(w, "%s", string(data))
+	}
+}
+
+func printRequest(r *http.Request) {
+	fmt.Printf("request(%s): %+v \n", r.RemoteAddr, r)
+}
+
+func (s *Server) exitHandler(w http.ResponseWriter, r *http.Request) {
+	waitString := r.FormValue("wait")
+	timeoutString := r.FormValue("timeout")
+	codeString := r.FormValue("code")
+	log.Printf("GET /exit?code=%s&timeout=%s&wait=%s", codeString, timeoutString, waitString)
+	timeout, err := time.ParseDuration(timeoutString)
+	if err != nil && timeoutString != "" {
+		fmt.Fprintf(w, "argument 'timeout' must be a valid golang duration or empty, got %q\n", timeoutString)
+		return
+	}
+	wait, err := time.ParseDuration(waitString)
+	if err != nil && waitString != "" {
+		fmt.Fprintf(w, "argument 'wait' must be a valid golang duration or empty, got %q\n", waitString)
+		return
+	}
+	code, err := strconv.Atoi(codeString)
+	if err != nil && codeString != "" {
+		fmt.Fprintf(w, "argument 'code' must be an integer [0-127] or empty, got %q\n", codeString)
+		return
+	}
+	log.Printf("Will begin shutdown in %s, allowing %s for connections to close, then will exit with %d", wait, timeout, code)
+	time.Sleep(wait)
+	if timeout == 0 {
+		s.exit(code)
+		return
+	}
+	// Shutdown waits for this request too, so it cannot run in the handler.
+	go func() {
+		ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
+		defer cancelFn()
+		err := s.Shutdown(ctx)
+		log.Printf("Graceful shutdown completed with: %v", err)
+		s.exit(code)
+	}()
+}
+
+func (s *Server) hostnameHandler(w http.ResponseWriter, r *http.Request) {
+	printRequest(r)
+	log.Printf("GET /hostname")
+	fmt.Fprint(w, s.identity(r))
+}
+
+// healthHandler response with a 200 if the UDP server is ready. It also serves
+// as a health check of the HTTP server by virtue of being a HTTP handler. It
+// responds with a 503 once the server is terminating. If limits are
+// configured, the body is the JSON of their current usage.
+func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET /healthz")
+	code := http.StatusPreconditionFailed
+	if s.terminating.get() {
+		code = http.StatusServiceUnavailable
+	} else if s.ready.get() {
+		code = http.StatusOK
+	}
+	if s.config.Limits.enabled() {
+		writeJSON(w, code, s.limiter.usage())
+		return
+	}
+	w.WriteHeader(code)
+}
+
+func (s *Server) shutdownHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET /shutdown")
+	s.exit(0)
+}
+
+func shellHandler(w http.ResponseWriter, r *http.Request) {
+	printRequest(r)
+	cmd := r.FormValue("shellCommand")
+	if cmd == "" {
+		cmd = r.FormValue("cmd")
+	}
+	log.Printf("GET /shell?cmd=%s", cmd)
+	cmdOut, err := exec.Command(shellPath, "-c", cmd).CombinedOutput()
+	output := map[string]string{}
+	if len(cmdOut) > 0 {
+		output["output"] = string(cmdOut)
+	}
+	if err != nil {
+		output["error"] = fmt.Sprintf("%v", err)
+	}
+	log.Printf("Output: %s", output)
+	bytes, err := json.Marshal(output)
+	if err == nil {
+		fmt.Fprint(w, string(bytes))
+	} else {
+		http.Error(w, fmt.Sprintf("response could not be serialized. %v", err), http.StatusExpectationFailed)
+	}
+}
+
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET /upload")
+	result := map[string]string{}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		result["error"] = "Unable to upload file."
+		bytes, err := json.Marshal(result)
+		if err == nil {
+			fmt.Fprint(w, string(bytes))
+		} else {
+			http.Error(w, fmt.Sprintf("%s. Also unable to serialize output. %v", result["error"], err), http.StatusInternalServerError)
+		}
+		log.Printf("Unable to upload file: %s", err)
+		return
+	}
+	defer file.Close()
+
+	f, err := ioutil.TempFile("/uploads", "upload")
+	if err != nil {
+		result["error"] = "Unable to open file for write"
+		bytes, err := json.Marshal(result)
+		if err == nil {
+			fmt.Fprint(w, string(bytes))
+		} else {
+			http.Error(w, fmt.Sprintf("%s. Also unable to serialize output. %v", result["error"], err), http.StatusInternalServerError)
+		}
+		log.Printf("Unable to open file for write: %s", err)
+		return
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, file); err != nil {
+		result["error"] = "Unable to write file."
+		bytes, err := json.Marshal(result)
+		if err == nil {
+			fmt.Fprint(w, string(bytes))
+		} else {
+			http.Error(w, fmt.Sprintf("%s. Also unable to serialize output. %v", result["error"], err), http.StatusInternalServerError)
+		}
+		log.Printf("Unable to write file: %s", err)
+		return
+	}
+
+	UploadFile := f.Name()
+	if err := os.Chmod(UploadFile, 0700); err != nil {
+		result["error"] = "Unable to chmod file."
+		bytes, err := json.Marshal(result)
+		if err == nil {
+			fmt.Fprint(w, string(bytes))
+		} else {
+			http.Error(w, fmt.Sprintf("%s. Also unable to serialize output. %v", result["error"], err), http.StatusInternalServerError)
+		}
+		log.Printf("Unable to chmod file: %s", err)
+		return
+	}
+	log.Printf("Wrote upload to %s", UploadFile)
+	result["output"] = UploadFile
+	w.WriteHeader(http.StatusCreated)
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s. Also unable to serialize output. %v", result["error"], err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, string(bytes))
+}
+
+func (s *Server) hostNameHandler(w http.ResponseWriter, r *http.Request) {
+	printRequest(r)
+	log.Printf("GET /hostName")
+	fmt.Fprint(w, s.identity(r))
+}
+
+func redirectHandler(w http.ResponseWriter, r *http.Request) {
+	printRequest(r)
+	location := r.FormValue("location")
+	codeString := r.FormValue("code")
+	log.Printf("%s /redirect?msg=%s&code=%s", r.Method, location, codeString)
+	code := http.StatusFound
+	if codeString != "" {
+		var err error
+		code, err = strconv.Atoi(codeString)
+		if err != nil && codeString != "" {
+			fmt.Fprintf(w, "argument 'code' must be an integer or empty, got %q\n", codeString)
+			return
+		}
+	}
+	http.Redirect(w, r, location, code)
+}
+
+// responseWriter is the ResponseWriter the middlewares wrap around the one of
+// a request, to see or change its status code and hijacks. It keeps the
+// wrapped one flushable and hijackable.
+type responseWriter struct {
+	http.ResponseWriter
+	// onWriteHeader, if set, is called with the first status code written,
+	// and returns the one to send instead.
+	onWriteHeader func(code int) int
+	// onHijack, if set, is called before the connection is hijacked.
+	onHijack    func()
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.wroteHeader && w.onWriteHeader != nil {
+		code = w.onWriteHeader(code)
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer cannot be hijacked")
+	}
+	if w.onHijack != nil {
+		w.onHijack()
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the wrapped ResponseWriter.
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("response could not be serialized. %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprint(w, string(bytes))
+}
+
+// remoteIP extracts the IP of a "host:port", "host" or "[host]" address,
+// returning nil if it cannot be parsed.
+func remoteIP(address string) net.IP {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = strings.Trim(address, "[]")
+	}
+	return netutils.ParseIPSloppy(host)
+}
@@ -0,0 +1,1127 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	"smartdocter/pkg/netexec"
+)
+
+// startServer starts a netexec server on free loopback ports, with the
+// configuration changes of configure.
+func startServer(ctx context.Context, hostname string, configure ...func(*netexec.Config)) (*netexec.Server, *netexec.Client) {
+	cfg := netexec.DefaultConfig()
+	cfg.Hostname = hostname
+	cfg.HTTP.Address = "127.0.0.1"
+	cfg.HTTP.Port = 0
+	cfg.UDP.Port = 0
+	cfg.UDP.ListenAddresses = "127.0.0.1"
+	cfg.TCP.Address = "127.0.0.1"
+	cfg.TCP.Port = 0
+	for _, f := range configure {
+		f(&cfg)
+	}
+	server, err := netexec.NewServer(cfg)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(server.Start(ctx)).To(Succeed())
+	DeferCleanup(server.Shutdown, context.Background())
+	return server, netexec.NewClient("http://" + server.HTTPAddr().String())
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// writeCertificate writes a self-signed certificate for commonName in dir.
+func writeCertificate(dir, commonName string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+	certFile = filepath.Join(dir, commonName+".crt")
+	keyFile = filepath.Join(dir, commonName+".key")
+	Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)).To(Succeed())
+	return certFile, keyFile
+}
+
+func port(addr net.Addr) int {
+	_, p, err := net.SplitHostPort(addr.String())
+	Expect(err).NotTo(HaveOccurred())
+	n, err := strconv.Atoi(p)
+	Expect(err).NotTo(HaveOccurred())
+	return n
+}
+
+var _ = Describe("Server", Label("netexec"), func() {
+	var (
+		ctx          context.Context
+		server       *netexec.Server
+		client, peer *netexec.Client
+		peerServer   *netexec.Server
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		server, client = startServer(ctx, "netexec-a")
+		peerServer, peer = startServer(ctx, "netexec-b")
+	})
+
+	It("runs independent servers in one process", func() {
+		Expect(client.Hostname(ctx)).To(Equal("netexec-a"))
+		Expect(peer.Hostname(ctx)).To(Equal("netexec-b"))
+		Expect(server.HTTPAddr()).NotTo(Equal(peerServer.HTTPAddr()))
+		Eventually(func() error { return client.Healthz(ctx) }).Should(Succeed())
+	})
+
+	It("dials another server over every protocol", func() {
+		for protocol, addr := range map[string]net.Addr{
+			"http": peerServer.HTTPAddr(),
+			"tcp":  peerServer.TCPAddr(),
+			"udp":  peerServer.UDPAddrs()[0],
+		} {
+			result, err := client.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(addr), Request: "hostname", Protocol: protocol})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Errors).To(BeEmpty(), protocol)
+			Expect(result.Responses).To(Equal([]string{"netexec-b"}), protocol)
+		}
+	})
+
+	It("applies socket options to the dials and reads them back", func() {
+		intPtr := func(n int) *int { return &n }
+		noDelay := false
+		options := &netexec.SocketOptions{TOS: intPtr(0x20), TTL: intPtr(7), NoDelay: &noDelay, KeepAliveIdle: intPtr(30), MSS: intPtr(1000), SendBuffer: intPtr(65536)}
+		for protocol, addr := range map[string]net.Addr{"http": peerServer.HTTPAddr(), "tcp": peerServer.TCPAddr()} {
+			result, err := client.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(addr), Request: "hostname", Protocol: protocol, SocketOptions: options})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Responses).To(Equal([]string{"netexec-b"}), protocol)
+			effective := result.SocketOptions
+			Expect(*effective.TOS).To(Equal(0x20), protocol)
+			Expect(*effective.TTL).To(Equal(7), protocol)
+			Expect(*effective.NoDelay).To(BeFalse(), protocol)
+			Expect(*effective.KeepAlive).To(BeTrue(), protocol)
+			Expect(*effective.KeepAliveIdle).To(Equal(30), protocol)
+			Expect(*effective.MSS).To(BeNumerically("<=", 1000), protocol)
+			// The kernel doubles the buffer sizes it is given.
+			Expect(*effective.SendBuffer).To(Equal(2*65536), protocol)
+		}
+
+		result, err := client.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(peerServer.UDPAddrs()[0]), Request: "hostname", Protocol: "udp",
+			SocketOptions: &netexec.SocketOptions{TOS: intPtr(0xb8)}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Responses).To(Equal([]string{"netexec-b"}))
+		Expect(*result.SocketOptions.TOS).To(Equal(0xb8))
+		Expect(result.SocketOptions.MSS).To(BeNil())
+
+		_, err = client.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(peerServer.UDPAddrs()[0]), Request: "hostname", Protocol: "udp",
+			SocketOptions: &netexec.SocketOptions{MSS: intPtr(1000)}})
+		Expect(err).To(MatchError(ContainSubstring("do not apply to udp")))
+	})
+
+	It("reports the forwarding chain of the client IP", func() {
+		report, err := client.ClientIPReport(ctx, "127.0.0.1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Chain).To(Equal([]string{report.Peer}))
+		Expect(report.OriginalClient).To(Equal(report.Peer))
+		Expect(report.Verdict).To(Equal("preserved"))
+		Expect(report.LocalAddr).To(Equal(server.HTTPAddr().String()))
+
+		forwarded := netexec.NewClient(client.BaseURL)
+		headers := http.Header{}
+		forwarded.HTTPClient = &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			for name, values := range headers {
+				r.Header[name] = values
+			}
+			return http.DefaultTransport.RoundTrip(r)
+		})}
+		headers.Set("X-Real-IP", "203.0.113.1")
+		headers.Set("X-Forwarded-For", "192.0.2.1, 198.51.100.1")
+		report, err = forwarded.ClientIPReport(ctx, "192.0.2.1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.XForwardedFor).To(Equal([]string{"192.0.2.1", "198.51.100.1"}))
+		Expect(report.Chain).To(Equal([]string{"192.0.2.1", "198.51.100.1", report.Peer}))
+		Expect(report.OriginalClient).To(Equal("192.0.2.1"))
+		Expect(report.Verdict).To(Equal("headers"))
+
+		// Forwarded supersedes X-Forwarded-For.
+		headers.Set("Forwarded", `for=192.0.2.7;proto=https, for="[2001:db8::1]:4711"`)
+		report, err = forwarded.ClientIPReport(ctx, "192.0.2.7")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Forwarded).To(Equal([]netexec.ForwardedElement{{For: "192.0.2.7", Proto: "https"}, {For: "[2001:db8::1]:4711"}}))
+		Expect(report.Chain).To(Equal([]string{"192.0.2.7", "[2001:db8::1]:4711", report.Peer}))
+		Expect(report.Verdict).To(Equal("headers"))
+
+		report, err = forwarded.ClientIPReport(ctx, "203.0.113.9")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Verdict).To(Equal("lost"))
+
+		_, err = client.ClientIPReport(ctx, "not-an-ip")
+		Expect(err).To(MatchError(ContainSubstring("400")))
+
+		proxied, _ := startServer(ctx, "netexec-c", func(cfg *netexec.Config) { cfg.ProxyProtocol = "accept" })
+		conn, err := net.Dial("tcp", proxied.HTTPAddr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 40000 80\r\n" +
+			"GET /clientip?format=json&expected=192.0.2.1 HTTP/1.1\r\nHost: netexec-c\r\n\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		report = &netexec.ClientIPReport{}
+		Expect(json.NewDecoder(resp.Body).Decode(report)).To(Succeed())
+		Expect(report.Peer).To(Equal(conn.LocalAddr().String()))
+		Expect(report.ProxyProtocol.Source).To(Equal("192.0.2.1:40000"))
+		Expect(report.Chain).To(Equal([]string{"192.0.2.1:40000", report.Peer}))
+		Expect(report.OriginalClient).To(Equal("192.0.2.1:40000"))
+		Expect(report.Verdict).To(Equal("proxy-protocol"))
+	})
+
+	It("reports the TTL and TOS the servers received", func() {
+		intPtr := func(n int) *int { return &n }
+		result, err := client.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(peerServer.UDPAddrs()[0]), Request: "clientinfo", Protocol: "udp",
+			SocketOptions: &netexec.SocketOptions{TOS: intPtr(0xb8), TTL: intPtr(60)}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Responses).To(HaveLen(1))
+		info := &netexec.ClientInfo{}
+		Expect(json.Unmarshal([]byte(result.Responses[0]), info)).To(Succeed())
+		Expect(info.Protocol).To(Equal("udp"))
+		Expect(*info.TTL).To(Equal(60))
+		Expect(*info.Hops).To(Equal(4))
+		Expect(*info.DSCP).To(Equal(46))
+
+		// Linux keeps only the TOS of the SYN of IPv4 connections.
+		result, err = client.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(peerServer.TCPAddr()), Request: "clientinfo", Protocol: "tcp",
+			SocketOptions: &netexec.SocketOptions{TOS: intPtr(0x20)}})
+		Expect(err).NotTo(HaveOccurred())
+		info = &netexec.ClientInfo{}
+		Expect(json.Unmarshal([]byte(result.Responses[0]), info)).To(Succeed())
+		Expect(info.TTL).To(BeNil())
+		Expect(*info.TOS).To(Equal(0x20))
+
+		info, err = client.ClientInfo(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Protocol).To(Equal("http"))
+		Expect(*info.TOS).To(Equal(0))
+	})
+
+	It("reports the TCP_INFO of the connections on both ends", func() {
+		for protocol, addr := range map[string]net.Addr{"http": peerServer.HTTPAddr(), "tcp": peerServer.TCPAddr()} {
+			result, err := client.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(addr), Request: "hostname", Protocol: protocol, Tries: 2})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.TCPInfo).To(HaveLen(2), protocol)
+			for _, stats := range result.TCPInfo {
+				Expect(stats.State).NotTo(BeEmpty(), protocol)
+				Expect(stats.RTT).To(BeNumerically(">", 0), protocol)
+				Expect(stats.BytesReceived).To(BeNumerically(">", 0), protocol)
+			}
+		}
+
+		result, err := client.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(peerServer.UDPAddrs()[0]), Request: "hostname", Protocol: "udp"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.TCPInfo).To(BeEmpty())
+
+		info, err := client.ClientInfo(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.TCPInfo.State).To(Equal("ESTABLISHED"))
+		Expect(info.TCPInfo.BytesReceived).To(BeNumerically(">", 0))
+
+		// Logging the statistics does not make the responses chunked, so
+		// HTTP/1.0 clients can keep their connection alive.
+		conn, err := net.Dial("tcp", server.HTTPAddr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for i := 0; i < 2; i++ {
+			_, err = conn.Write([]byte("GET /hostname HTTP/1.0\r\nConnection: keep-alive\r\n\r\n"))
+			Expect(err).NotTo(HaveOccurred())
+			resp, err := http.ReadResponse(reader, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.ContentLength).To(BeEquivalentTo(len("netexec-a")))
+			Expect(resp.TransferEncoding).To(BeEmpty())
+			Expect(io.ReadAll(resp.Body)).To(BeEquivalentTo("netexec-a"))
+		}
+	})
+
+	It("classifies the errors of the dials and retries them", func() {
+		closed, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		closed.Close()
+		result, err := client.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(closed.Addr()), Request: "hostname", Protocol: "tcp",
+			Retries: 2, Backoff: 10 * time.Millisecond, Jitter: 0.5})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Retries).To(Equal(2))
+		Expect(result.Errors).To(ConsistOf(HavePrefix("refused: ")))
+
+		result, err = client.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(closed.Addr()), Request: "hostname", Protocol: "tcp",
+			Retries: 2, RetryOn: []string{"timeout"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Retries).To(BeZero())
+
+		result, err = client.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(peerServer.TCPAddr()), Request: "misbehave rst hostname", Protocol: "tcp"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Errors).To(ConsistOf(HavePrefix("reset: ")))
+
+		result, err = client.Dial(ctx, netexec.DialRequest{Host: "does-not-exist.invalid", Port: 80, Request: "hostname"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Errors).To(ConsistOf(HavePrefix("dns: ")))
+
+		// A server that never answers.
+		silent, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer silent.Close()
+		go func() {
+			for {
+				conn, err := silent.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+		for _, protocol := range []string{"http", "tcp", "grpc"} {
+			result, err = client.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(silent.Addr()), Request: "hostname", Protocol: protocol,
+				ConnectTimeout: 100 * time.Millisecond, ReadTimeout: 100 * time.Millisecond})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Errors).To(ConsistOf(HavePrefix("timeout: ")), protocol)
+		}
+		start := time.Now()
+		result, err = client.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(silent.Addr()), Request: "hostname", Protocol: "tcp", Tries: 3,
+			ReadTimeout: time.Second, Timeout: 200 * time.Millisecond})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Errors).To(HaveLen(3))
+		Expect(result.Errors).To(HaveEach(HavePrefix("timeout: ")))
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+
+		_, err = client.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(silent.Addr()), Request: "hostname", Jitter: 2})
+		Expect(err).To(MatchError(ContainSubstring("jitter parameter")))
+	})
+
+	It("echoes over gRPC streams and describes its service", func() {
+		grpcServer, _ := startServer(ctx, "netexec-c", func(cfg *netexec.Config) {
+			cfg.GRPC.Address = "127.0.0.1"
+			cfg.GRPC.Port = 0
+		})
+		conn, err := grpc.DialContext(ctx, grpcServer.GRPCAddr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(conn.Close)
+
+		// A client without the generated code finds the messages in the
+		// descriptors registered by the package.
+		findMessage := func(name protoreflect.FullName) protoreflect.MessageDescriptor {
+			desc, err := protoregistry.GlobalFiles.FindDescriptorByName(name)
+			Expect(err).NotTo(HaveOccurred())
+			return desc.(protoreflect.MessageDescriptor)
+		}
+		requestDesc, responseDesc := findMessage("netexec.EchoRequest"), findMessage("netexec.EchoResponse")
+		newRequest := func(message string, count, intervalMs int32) *dynamicpb.Message {
+			req := dynamicpb.NewMessage(requestDesc)
+			req.Set(requestDesc.Fields().ByName("message"), protoreflect.ValueOfString(message))
+			req.Set(requestDesc.Fields().ByName("count"), protoreflect.ValueOfInt32(count))
+			req.Set(requestDesc.Fields().ByName("interval_ms"), protoreflect.ValueOfInt32(intervalMs))
+			return req
+		}
+		type echo struct {
+			Message, Hostname string
+			Sequence          int64
+		}
+		recv := func(stream grpc.ClientStream) (echo, error) {
+			resp := dynamicpb.NewMessage(responseDesc)
+			if err := stream.RecvMsg(resp); err != nil {
+				return echo{}, err
+			}
+			fields := responseDesc.Fields()
+			return echo{
+				Message:  resp.Get(fields.ByName("message")).String(),
+				Hostname: resp.Get(fields.ByName("hostname")).String(),
+				Sequence: resp.Get(fields.ByName("sequence")).Int(),
+			}, nil
+		}
+		newStream := func(ctx context.Context, method string, clientStreams, serverStreams bool) grpc.ClientStream {
+			stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: clientStreams, ServerStreams: serverStreams}, "/netexec.Echo/"+method)
+			Expect(err).NotTo(HaveOccurred())
+			return stream
+		}
+
+		stream := newStream(ctx, "ServerStream", false, true)
+		Expect(stream.SendMsg(newRequest("hello", 3, 10))).To(Succeed())
+		Expect(stream.CloseSend()).To(Succeed())
+		for sequence := int64(1); sequence <= 3; sequence++ {
+			Expect(recv(stream)).To(Equal(echo{Message: "hello", Hostname: "netexec-c", Sequence: sequence}))
+		}
+		_, err = recv(stream)
+		Expect(err).To(Equal(io.EOF))
+
+		stream = newStream(ctx, "ClientStream", true, false)
+		for _, message := range []string{"a", "b", "c"} {
+			Expect(stream.SendMsg(newRequest(message, 0, 0))).To(Succeed())
+		}
+		Expect(stream.CloseSend()).To(Succeed())
+		Expect(recv(stream)).To(Equal(echo{Message: "a b c", Hostname: "netexec-c", Sequence: 3}))
+
+		stream = newStream(ctx, "BidiStream", true, true)
+		for sequence, message := range []string{"a", "b"} {
+			Expect(stream.SendMsg(newRequest(message, 0, 0))).To(Succeed())
+			Expect(recv(stream)).To(Equal(echo{Message: message, Hostname: "netexec-c", Sequence: int64(sequence + 1)}))
+		}
+		Expect(stream.CloseSend()).To(Succeed())
+		_, err = recv(stream)
+		Expect(err).To(Equal(io.EOF))
+
+		reflection, err := grpc_reflection_v1alpha.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reflection.Send(&grpc_reflection_v1alpha.ServerReflectionRequest{
+			MessageRequest: &grpc_reflection_v1alpha.ServerReflectionRequest_ListServices{},
+		})).To(Succeed())
+		services, err := reflection.Recv()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(services.GetListServicesResponse().GetService()).To(ContainElement(HaveField("Name", "netexec.Echo")))
+		Expect(reflection.CloseSend()).To(Succeed())
+
+		// A stream the client gives up on does not delay the shutdown.
+		streamCtx, cancel := context.WithCancel(ctx)
+		stream = newStream(streamCtx, "ServerStream", false, true)
+		Expect(stream.SendMsg(newRequest("hello", 2, int32(time.Hour/time.Millisecond)))).To(Succeed())
+		Expect(recv(stream)).To(HaveField("Sequence", int64(1)))
+		cancel()
+		shutdownCtx, cancelShutdown := context.WithTimeout(ctx, 5*time.Second)
+		defer cancelShutdown()
+		start := time.Now()
+		Expect(grpcServer.Shutdown(shutdownCtx)).To(Succeed())
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+	})
+
+	It("collects the replies of the members of a multicast group", func() {
+		for query, message := range map[string]string{
+			"host=192.0.2.1&port=8084&request=hostname":                      "host parameter must be a multicast group",
+			"host=239.255.0.42&port=0&request=hostname":                      "port parameter must be a port number",
+			"host=239.255.0.42&port=8084":                                    "request parameter not specified",
+			"host=239.255.0.42&port=8084&request=hostname&window=2m":         "window parameter must be a positive golang duration",
+			"host=239.255.0.42&port=8084&request=hostname&tries=0":           "tries parameter is invalid",
+			"host=239.255.0.42&port=8084&request=hostname&ttl=256":           "ttl parameter must be an integer between 1 and 255",
+			"host=239.255.0.42&port=8084&request=hostname&interface=nosuch0": "interface parameter is invalid",
+		} {
+			resp, err := http.Get(client.BaseURL + "/dial?mode=multicast&" + query)
+			Expect(err).NotTo(HaveOccurred())
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusBadRequest), query)
+			Expect(string(body)).To(ContainSubstring(message), query)
+		}
+
+		group := net.ParseIP("239.255.0.42")
+		lo, err := net.InterfaceByName("lo")
+		Expect(err).NotTo(HaveOccurred())
+		free, err := net.ListenMulticastUDP("udp4", lo, &net.UDPAddr{IP: group})
+		if err != nil {
+			Skip("cannot join a multicast group on lo: " + err.Error())
+		}
+		multicastPort := port(free.LocalAddr())
+		free.Close()
+		startServer(ctx, "netexec-c", func(cfg *netexec.Config) {
+			cfg.Multicast.Groups = group.String()
+			cfg.Multicast.Interfaces = "lo"
+			cfg.Multicast.Port = multicastPort
+		})
+		resp, err := http.Get(client.BaseURL + "/dial?mode=multicast&host=239.255.0.42&port=" + strconv.Itoa(multicastPort) +
+			"&request=hostname&interface=lo&tries=2&window=300ms")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		result := &netexec.MulticastResult{}
+		Expect(json.NewDecoder(resp.Body).Decode(result)).To(Succeed())
+		Expect(result.Errors).To(BeEmpty())
+		Expect(result.Group).To(Equal(net.JoinHostPort("239.255.0.42", strconv.Itoa(multicastPort))))
+		Expect(result.Responders).To(ConsistOf(And(HaveField("Response", "netexec-c"), HaveField("Replies", 2))))
+	})
+
+	It("analyzes the distribution of the backends that answered", func() {
+		result, err := client.Dial(ctx, netexec.DialRequest{
+			Host: "127.0.0.1", Port: port(peerServer.UDPAddrs()[0]), Request: "hostname", Protocol: "udp", Tries: 5,
+			ExpectAffinity: true, ExpectBackends: 2,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Distribution.Backends).To(Equal([]netexec.BackendCount{{Backend: "netexec-b", Count: 5, Share: 1}}))
+		Expect(result.Distribution.LongestRun).To(Equal(netexec.BackendCount{Backend: "netexec-b", Count: 5}))
+		Expect(result.Distribution.Checks).To(ConsistOf(
+			HaveField("Pass", true),
+			And(HaveField("Name", "backends"), HaveField("Pass", false)),
+		))
+		Expect(result.Distribution.Pass).To(BeFalse())
+	})
+
+	It("serves httpbin endpoints under a prefix", func() {
+		base := client.BaseURL + "/httpbin"
+		resp, err := http.Post(base+"/anything/path?a=1&a=2&b=3", "application/json", strings.NewReader(`{"k":"v"}`))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.Header.Get("X-Netexec-Hostname")).To(Equal("netexec-a"))
+		var anything map[string]interface{}
+		Expect(json.NewDecoder(resp.Body).Decode(&anything)).To(Succeed())
+		Expect(anything).To(HaveKeyWithValue("method", "POST"))
+		Expect(anything).To(HaveKeyWithValue("origin", "127.0.0.1"))
+		Expect(anything).To(HaveKeyWithValue("url", base+"/anything/path?a=1&a=2&b=3"))
+		Expect(anything).To(HaveKeyWithValue("args", map[string]interface{}{"a": []interface{}{"1", "2"}, "b": "3"}))
+		Expect(anything).To(HaveKeyWithValue("json", map[string]interface{}{"k": "v"}))
+
+		resp, err = http.Get(base + "/status/418")
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusTeapot))
+
+		req, err := http.NewRequest(http.MethodGet, base+"/basic-auth/user/passwd", nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.SetBasicAuth("user", "wrong")
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+
+		resp, err = http.Get(base + "/gzip")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		var gzipped map[string]interface{}
+		Expect(json.NewDecoder(resp.Body).Decode(&gzipped)).To(Succeed())
+		Expect(gzipped).To(HaveKeyWithValue("gzipped", true))
+
+		_, rootClient := startServer(ctx, "netexec-c", func(cfg *netexec.Config) { cfg.HTTP.HTTPBinPrefix = "/" })
+		resp, err = http.Get(rootClient.BaseURL + "/ip")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		var ip map[string]interface{}
+		Expect(json.NewDecoder(resp.Body).Decode(&ip)).To(Succeed())
+		Expect(ip).To(Equal(map[string]interface{}{"origin": "127.0.0.1"}))
+	})
+
+	It("answers as the virtual host of the Host header and SNI", func() {
+		dir := GinkgoT().TempDir()
+		defaultCert, defaultKey := writeCertificate(dir, "netexec")
+		vhostCert, vhostKey := writeCertificate(dir, "a.example.com")
+		vhostServer, _ := startServer(ctx, "netexec-c", func(cfg *netexec.Config) {
+			cfg.HTTP.TLSCertFile, cfg.HTTP.TLSPrivateKeyFile = defaultCert, defaultKey
+			cfg.HTTP.VirtualHosts = []netexec.VirtualHostConfig{
+				{Hostname: "a.example.com", Identity: "app-a", TLSCertFile: vhostCert, TLSPrivateKeyFile: vhostKey},
+				{Hostname: "*.example.org", Status: http.StatusServiceUnavailable},
+			}
+		})
+		get := func(host string) (*http.Response, string) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{ServerName: host, InsecureSkipVerify: true}}}
+			req, err := http.NewRequest(http.MethodGet, "https://"+vhostServer.HTTPAddr().String()+"/hostname", nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Host = host
+			resp, err := client.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			return resp, string(body)
+		}
+
+		resp, body := get("a.example.com")
+		Expect(body).To(Equal("app-a"))
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("X-Netexec-Virtual-Host")).To(Equal("a.example.com"))
+		Expect(resp.Header.Get("X-Netexec-SNI")).To(Equal("a.example.com"))
+		Expect(resp.TLS.PeerCertificates[0].Subject.CommonName).To(Equal("a.example.com"))
+
+		resp, body = get("b.example.org")
+		Expect(body).To(Equal("*.example.org"))
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+		Expect(resp.Header.Get("X-Netexec-Virtual-Host")).To(Equal("*.example.org"))
+		Expect(resp.TLS.PeerCertificates[0].Subject.CommonName).To(Equal("netexec"))
+
+		resp, body = get("other.example.com")
+		Expect(body).To(Equal("netexec-c"))
+		Expect(resp.Header.Get("X-Netexec-Virtual-Host")).To(BeEmpty())
+		Expect(resp.Header.Get("X-Netexec-Identity")).To(Equal("netexec-c"))
+	})
+
+	It("runs dial jobs in the background", func() {
+		job, err := client.SubmitJob(ctx, netexec.JobSpec{Targets: []string{peerServer.HTTPAddr().String()}})
+		Expect(err).To(MatchError(ContainSubstring("duration must be")))
+		job, err = client.SubmitJob(ctx, netexec.JobSpec{Targets: []string{peerServer.HTTPAddr().String()}, Interval: "10ms", Duration: "1h"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(job.State).To(Equal(netexec.JobRunning))
+
+		var followed []netexec.JobResult
+		errEnough := errors.New("enough")
+		Expect(client.FollowJob(ctx, job.ID, 0, func(result netexec.JobResult) error {
+			followed = append(followed, result)
+			if len(followed) == 3 {
+				return errEnough
+			}
+			return nil
+		})).To(MatchError(errEnough))
+		for i, result := range followed {
+			Expect(result.Seq).To(Equal(i + 1))
+			Expect(result.Response).To(Equal("netexec-b"))
+		}
+
+		polled, err := client.Job(ctx, job.ID, 2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(polled.Results[0].Seq).To(Equal(3))
+		Expect(client.Jobs(ctx)).To(ConsistOf(HaveField("ID", job.ID)))
+
+		cancelled, err := client.CancelJob(ctx, job.ID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cancelled.State).To(Equal(netexec.JobCancelled))
+		Expect(cancelled.Targets[0].Attempts).To(Equal(cancelled.Targets[0].Successes))
+		Expect(client.FollowJob(ctx, job.ID, cancelled.Targets[0].Attempts, func(netexec.JobResult) error {
+			return errEnough
+		})).To(Succeed())
+	})
+
+	It("probes the path MTU towards another server", func() {
+		for protocol, addr := range map[string]net.Addr{
+			"http": peerServer.HTTPAddr(),
+			"tcp":  peerServer.TCPAddr(),
+			"udp":  peerServer.UDPAddrs()[0],
+		} {
+			results, err := client.DialMTU(ctx, "127.0.0.1", port(addr), protocol, 1500)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(HaveLen(1), protocol)
+			result := results[0]
+			Expect(result.Error).To(BeEmpty(), protocol)
+			Expect(result.Family).To(Equal("ipv4"), protocol)
+			Expect(result.PathMTU).To(And(BeNumerically(">=", 1280), BeNumerically("<=", 1500)), protocol)
+			Expect(result.KernelPathMTU).To(BeNumerically(">=", result.PathMTU), protocol)
+			Expect(result.Probes).To(BeNumerically(">", 0), protocol)
+			if protocol == "udp" {
+				Expect(result.MaxPayload).To(Equal(result.PathMTU-28), protocol)
+			} else {
+				Expect(result.MaxSegmentSize).To(Equal(result.PathMTU-40), protocol)
+			}
+		}
+
+		for _, maxMTU := range []int{1279, 65536} {
+			_, err := client.DialMTU(ctx, "127.0.0.1", port(peerServer.UDPAddrs()[0]), "udp", maxMTU)
+			Expect(err).To(MatchError(ContainSubstring("maxMTU parameter must be an integer between 1280 and 65535")))
+		}
+		_, err := client.DialMTU(ctx, "127.0.0.1", port(peerServer.UDPAddrs()[0]), "sctp", 1500)
+		Expect(err).To(MatchError(ContainSubstring("unsupported protocol for mode mtu")))
+	})
+
+	It("measures the throughput towards another server", func() {
+		for _, direction := range []string{"upload", "download"} {
+			result, err := client.DialThroughput(ctx, "127.0.0.1", port(peerServer.HTTPAddr()), direction, 2, 200*time.Millisecond)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Streams).To(HaveLen(2))
+			for _, stream := range result.Streams {
+				Expect(stream.Error).To(BeEmpty(), direction)
+				Expect(stream.Bytes).To(BeNumerically(">", 0), direction)
+			}
+			Expect(result.TotalGbps).To(BeNumerically(">", 0), direction)
+		}
+	})
+
+	It("keeps idle sessions to another server", func() {
+		for protocol, addr := range map[string]net.Addr{
+			"tcp": peerServer.TCPAddr(),
+			"udp": peerServer.UDPAddrs()[0],
+		} {
+			result, err := client.DialIdle(ctx, "127.0.0.1", port(addr), protocol, []time.Duration{50 * time.Millisecond, 100 * time.Millisecond})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Sessions).To(HaveLen(2))
+			Expect(result.MaxWorkingIdle).To(Equal("100ms"), protocol)
+			Expect(result.MinFailingIdle).To(BeEmpty(), protocol)
+		}
+	})
+
+	It("closes the idle sessions of cancelled requests", func() {
+		idleCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		defer cancel()
+		_, err := client.DialIdle(idleCtx, "127.0.0.1", port(peerServer.TCPAddr()), "tcp", []time.Duration{time.Hour})
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		// The metrics connection is the only one left.
+		Eventually(func() (string, error) { return peer.Metrics(ctx) }).Should(ContainSubstring("netexec_connections 1\n"))
+	})
+
+	It("estimates the clock offset of another server", func() {
+		for protocol, addr := range map[string]net.Addr{
+			"http": peerServer.HTTPAddr(),
+			"tcp":  peerServer.TCPAddr(),
+			"udp":  peerServer.UDPAddrs()[0],
+		} {
+			result, err := client.DialClock(ctx, "127.0.0.1", port(addr), protocol, 3)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Rounds).To(HaveLen(3))
+			Expect(result.Delay).NotTo(BeEmpty(), protocol)
+			// Both servers share a clock.
+			Expect(result.OffsetNanos).To(BeNumerically("~", 0, int64(time.Second)), protocol)
+		}
+	})
+
+	It("stops estimating the clock offset of cancelled requests", func() {
+		clockCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		defer cancel()
+		_, err := client.DialClock(clockCtx, "127.0.0.1", port(peerServer.TCPAddr()), "tcp", 100)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		// The metrics connection is the only one left.
+		Eventually(func() (string, error) { return peer.Metrics(ctx) }).Should(ContainSubstring("netexec_connections 1\n"))
+	})
+
+	It("injects faults into one server only", func() {
+		rule, err := client.AddFault(ctx, netexec.FaultRule{Path: "/echo", ErrorPercent: 100, ErrorCode: 418})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rule.ID).To(Equal(1))
+
+		_, err = client.Echo(ctx, "hello")
+		Expect(err).To(MatchError(ContainSubstring("418")))
+		Expect(peer.Echo(ctx, "hello")).To(Equal("hello"))
+		Expect(client.Metrics(ctx)).To(ContainSubstring(`netexec_faults_injected_total{rule="1",protocol="http",action="error"} 1`))
+
+		Expect(client.ClearFaults(ctx, 0)).To(Equal(1))
+		Expect(client.Echo(ctx, "hello")).To(Equal("hello"))
+	})
+
+	Context("with fault rules", func() {
+		// tcpCommand sends command to the TCP server of server, and returns
+		// its answer, empty if the connection was closed without one.
+		tcpCommand := func(command string) string {
+			conn, err := net.Dial("tcp", server.TCPAddr().String())
+			Expect(err).NotTo(HaveOccurred())
+			defer conn.Close()
+			Expect(conn.SetDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+			_, err = conn.Write([]byte(command + "\n"))
+			Expect(err).NotTo(HaveOccurred())
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				Expect(err).To(Equal(io.EOF))
+			}
+			return strings.TrimSpace(line)
+		}
+		addFault := func(rule netexec.FaultRule) int {
+			added, err := client.AddFault(ctx, rule)
+			Expect(err).NotTo(HaveOccurred())
+			return added.ID
+		}
+		// faultOf returns the X-Netexec-Fault header of the answer to a GET of
+		// path with the given headers.
+		faultOf := func(path string, header http.Header) string {
+			req, err := http.NewRequest(http.MethodGet, client.BaseURL+path, nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header = header
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+			return resp.Header.Get("X-Netexec-Fault")
+		}
+
+		It("delays the responses over HTTP, UDP and TCP", func() {
+			addFault(netexec.FaultRule{Latency: &netexec.FaultLatency{Mean: "200ms"}})
+			start := time.Now()
+			Expect(client.Echo(ctx, "hello")).To(Equal("hello"))
+			Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+			start = time.Now()
+			result, err := peer.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(server.UDPAddrs()[0]), Request: "hostname", Protocol: "udp"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Responses).To(ConsistOf("netexec-a"))
+			Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+			start = time.Now()
+			Expect(tcpCommand("hostname")).To(Equal("netexec-a"))
+			Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+			metrics, err := client.Metrics(ctx)
+			Expect(err).NotTo(HaveOccurred())
+			for _, protocol := range []string{"http", "udp", "tcp"} {
+				Expect(metrics).To(ContainSubstring(`netexec_faults_injected_total{rule="1",protocol="` + protocol + `",action="latency"}`))
+			}
+		})
+
+		It("drops UDP replies and closes connections", func() {
+			id := addFault(netexec.FaultRule{DropPercent: 100})
+			result, err := peer.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(server.UDPAddrs()[0]), Request: "hostname", Protocol: "udp",
+				ReadTimeout: 200 * time.Millisecond})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Errors).To(ConsistOf(HavePrefix("timeout: ")))
+			// Only UDP replies are dropped.
+			Expect(client.Echo(ctx, "hello")).To(Equal("hello"))
+			Expect(tcpCommand("hostname")).To(Equal("netexec-a"))
+			Expect(client.ClearFaults(ctx, id)).To(Equal(1))
+
+			addFault(netexec.FaultRule{ClosePercent: 100})
+			_, err = client.Echo(ctx, "hello")
+			Expect(err).To(MatchError(ContainSubstring("EOF")))
+			Expect(tcpCommand("hostname")).To(BeEmpty())
+			Expect(client.Metrics(ctx)).To(ContainSubstring(`netexec_faults_injected_total{rule="2",protocol="tcp",action="close"} 1`))
+		})
+
+		It("applies the first matching rule that fires", func() {
+			addFault(netexec.FaultRule{ClientCIDR: "192.0.2.0/24", ErrorPercent: 100})
+			addFault(netexec.FaultRule{HeaderName: "X-Fault", HeaderValue: "on", ErrorPercent: 100})
+			// Matches HTTP requests, but only ever drops UDP replies.
+			addFault(netexec.FaultRule{Path: "/echo", DropPercent: 100})
+			Expect(faultOf("/echo?msg=hello", http.Header{})).To(BeEmpty())
+			Expect(faultOf("/echo?msg=hello", http.Header{"X-Fault": {"off"}})).To(BeEmpty())
+			Expect(faultOf("/echo?msg=hello", http.Header{"X-Fault": {"on"}})).To(Equal("2"))
+			// Header scoped rules never match commands.
+			Expect(tcpCommand("hostname")).To(Equal("netexec-a"))
+
+			addFault(netexec.FaultRule{ClientCIDR: "127.0.0.0/8", ErrorPercent: 100})
+			Expect(faultOf("/echo?msg=hello", http.Header{})).To(Equal("4"))
+			Expect(faultOf("/hostname", http.Header{})).To(Equal("4"))
+			Expect(faultOf("/echo?msg=hello", http.Header{"X-Fault": {"on"}})).To(Equal("2"))
+		})
+
+		It("expires rules and removes them by id", func() {
+			first := addFault(netexec.FaultRule{Path: "/echo", ErrorPercent: 100, TTL: "200ms"})
+			second := addFault(netexec.FaultRule{Path: "/hostname", ErrorPercent: 100})
+			Expect(client.Faults(ctx)).To(HaveLen(2))
+			Eventually(func() ([]netexec.FaultRule, error) { return client.Faults(ctx) }).Should(ConsistOf(HaveField("ID", second)))
+			Expect(client.Echo(ctx, "hello")).To(Equal("hello"))
+
+			third := addFault(netexec.FaultRule{Path: "/echo", ErrorPercent: 100})
+			Expect(client.ClearFaults(ctx, second)).To(Equal(1))
+			Expect(client.Faults(ctx)).To(ConsistOf(HaveField("ID", third)))
+			Expect(client.Hostname(ctx)).To(Equal("netexec-a"))
+			_, err := client.ClearFaults(ctx, first)
+			Expect(err).To(MatchError(ContainSubstring("404")))
+		})
+	})
+
+	It("reports its configuration", func() {
+		cfg, err := client.Config(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Hostname).To(Equal("netexec-a"))
+		Expect(cfg.SCTP.Port).To(Equal(-1))
+
+		dir := GinkgoT().TempDir()
+		defaultCert, defaultKey := writeCertificate(dir, "netexec")
+		vhostCert, vhostKey := writeCertificate(dir, "a.example.com")
+		tlsServer, _ := startServer(ctx, "netexec-c", func(cfg *netexec.Config) {
+			cfg.HTTP.TLSCertFile, cfg.HTTP.TLSPrivateKeyFile = defaultCert, defaultKey
+			cfg.HTTP.VirtualHosts = []netexec.VirtualHostConfig{
+				{Hostname: "a.example.com", TLSCertFile: vhostCert, TLSPrivateKeyFile: vhostKey},
+				{Hostname: "b.example.com"},
+			}
+		})
+		tlsClient := netexec.NewClient("https://" + tlsServer.HTTPAddr().String())
+		tlsClient.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+		cfg, err = tlsClient.Config(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.HTTP.TLSCertFile).To(Equal(defaultCert))
+		Expect(cfg.HTTP.TLSPrivateKeyFile).To(Equal("<redacted>"))
+		Expect(cfg.HTTP.VirtualHosts).To(Equal([]netexec.VirtualHostConfig{
+			{Hostname: "a.example.com", TLSCertFile: vhostCert, TLSPrivateKeyFile: "<redacted>"},
+			{Hostname: "b.example.com"},
+		}))
+	})
+
+	It("describes its network namespace", func() {
+		info, err := client.SysInfo(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Errors).NotTo(HaveKey("interfaces"))
+		Expect(info.Interfaces).To(ContainElement(HaveField("Name", "lo")))
+		Expect(info.Sockets).To(ContainElement(HaveField("LocalAddress", strings.TrimPrefix(client.BaseURL, "http://"))))
+	})
+
+	It("explains how a name resolves", func() {
+		result, err := client.DNS(ctx, "localhost", "A", 100*time.Millisecond)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Hosts).To(ContainElement("127.0.0.1"))
+		Expect(result.Answers).To(Equal(result.Hosts))
+		Expect(result.Candidates).NotTo(BeEmpty())
+		Expect(result.Candidates[len(result.Candidates)-1].Name).To(Equal("localhost."))
+	})
+
+	It("keeps serving while not ready when terminating", func() {
+		terminating, terminatingClient := startServer(ctx, "netexec-c", func(cfg *netexec.Config) {
+			cfg.DelayShutdown = 1
+			cfg.DrainTimeout = 1
+		})
+		Expect(terminatingClient.Healthz(ctx)).To(Succeed())
+		go terminating.Terminate()
+		Eventually(func() error { return terminatingClient.Healthz(ctx) }).Should(MatchError(ContainSubstring("503")))
+		Expect(terminatingClient.Echo(ctx, "still serving")).To(Equal("still serving"))
+		Eventually(terminating.Exited(), 3*time.Second).Should(Receive(Equal(0)))
+		Expect(terminatingClient.Healthz(ctx)).NotTo(Succeed())
+	})
+
+	It("closes its connections on shutdown without blocking its accessors", func() {
+		closing, closingClient := startServer(ctx, "netexec-c")
+		_, err := closingClient.AddFault(ctx, netexec.FaultRule{Path: "/echo", Latency: &netexec.FaultLatency{Percent: 100, Mean: "1s"}})
+		Expect(err).NotTo(HaveOccurred())
+		tcpConn, err := net.Dial("tcp", closing.TCPAddr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer tcpConn.Close()
+		_, err = tcpConn.Write([]byte("hostname\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bufio.NewReader(tcpConn).ReadString('\n')).To(Equal("netexec-c\n"))
+		hijacked, err := net.Dial("tcp", closing.HTTPAddr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer hijacked.Close()
+		_, err = hijacked.Write([]byte("GET /hostname?misbehave=hang HTTP/1.1\r\nHost: netexec-c\r\n\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+		echoed := make(chan error, 1)
+		go func() {
+			_, err := closingClient.Echo(ctx, "slow")
+			echoed <- err
+		}()
+		// The TCP, hanging, echo and metrics connections.
+		Eventually(func() (string, error) { return closingClient.Metrics(ctx) }).Should(And(
+			ContainSubstring(`netexec_connections 4`), ContainSubstring(`action="latency"} 1`)))
+
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- closing.Shutdown(ctx) }()
+		Eventually(func() error { return closingClient.Healthz(ctx) }).ShouldNot(Succeed())
+		Consistently(shutdown, 200*time.Millisecond).ShouldNot(Receive())
+		accessed := make(chan net.Addr, 1)
+		go func() { accessed <- closing.HTTPAddr() }()
+		Eventually(accessed, 200*time.Millisecond).Should(Receive())
+		Eventually(shutdown, 3*time.Second).Should(Receive(BeNil()))
+		Expect(<-echoed).To(Succeed())
+
+		for _, conn := range []net.Conn{tcpConn, hijacked} {
+			Expect(conn.SetReadDeadline(time.Now().Add(3 * time.Second))).To(Succeed())
+			_, err := io.ReadAll(conn)
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+
+	Context("misbehaving", func() {
+		// misbehave sends request over a new connection to addr, and returns
+		// what it received until the connection was closed, reset or idle for
+		// 500ms.
+		misbehave := func(addr net.Addr, request string) (net.Conn, string, error) {
+			conn, err := net.Dial("tcp", addr.String())
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+			_, err = conn.Write([]byte(request))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))).To(Succeed())
+			received, err := io.ReadAll(conn)
+			return conn, string(received), err
+		}
+		get := func(spec string) string {
+			return "GET /hostname?misbehave=" + spec + " HTTP/1.1\r\nHost: netexec-a\r\n\r\n"
+		}
+		timeout := func(err error) bool {
+			var netErr net.Error
+			return errors.As(err, &netErr) && netErr.Timeout()
+		}
+
+		It("sends the first bytes of the response then a FIN on halfclose", func() {
+			conn, received, err := misbehave(server.HTTPAddr(), get("halfclose:12"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(received).To(Equal("HTTP/1.1 200"))
+			// The server still reads.
+			_, err = conn.Write([]byte("more"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, received, err = misbehave(server.TCPAddr(), "misbehave halfclose:3 hostname\n")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(received).To(Equal("net"))
+		})
+
+		It("sends the first bytes of the response then stalls on partial", func() {
+			_, received, err := misbehave(server.HTTPAddr(), get("partial:12"))
+			Expect(timeout(err)).To(BeTrue(), "%v", err)
+			Expect(received).To(Equal("HTTP/1.1 200"))
+
+			_, received, err = misbehave(server.TCPAddr(), "misbehave partial:3 hostname\n")
+			Expect(timeout(err)).To(BeTrue(), "%v", err)
+			Expect(received).To(Equal("net"))
+		})
+
+		It("resets the connection on rst", func() {
+			_, received, err := misbehave(server.HTTPAddr(), get("rst"))
+			Expect(err).To(MatchError(syscall.ECONNRESET))
+			Expect(received).To(BeEmpty())
+		})
+
+		It("never answers on hang", func() {
+			_, received, err := misbehave(server.HTTPAddr(), get("hang"))
+			Expect(timeout(err)).To(BeTrue(), "%v", err)
+			Expect(received).To(BeEmpty())
+		})
+
+		It("delays accepting the next connection on delay-accept", func() {
+			_, received, err := misbehave(server.HTTPAddr(), "GET /hostname?misbehave=delay-accept:1s HTTP/1.1\r\nHost: netexec-a\r\nConnection: close\r\n\r\n")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(received).To(HaveSuffix("\r\n\r\nnetexec-a"))
+
+			start := time.Now()
+			Expect(client.Hostname(ctx)).To(Equal("netexec-a"))
+			Expect(time.Since(start)).To(BeNumerically(">=", 900*time.Millisecond))
+		})
+	})
+
+	It("releases misbehaving connections once the client is gone", func() {
+		conn, err := net.Dial("tcp", server.HTTPAddr().String())
+		Expect(err).NotTo(HaveOccurred())
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET /hostname?misbehave=hang HTTP/1.1\r\nHost: netexec-a\r\n\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(conn.(*net.TCPConn).CloseWrite()).To(Succeed())
+		Expect(conn.SetReadDeadline(time.Now().Add(3 * time.Second))).To(Succeed())
+		Expect(io.ReadAll(conn)).To(BeEmpty())
+	})
+
+	It("refuses requests over its limits", func() {
+		_, limitedClient := startServer(ctx, "netexec-c", func(cfg *netexec.Config) {
+			cfg.Limits.RequestsPerSecond = 1
+		})
+		Expect(limitedClient.Echo(ctx, "first")).To(Equal("first"))
+		_, err := limitedClient.Echo(ctx, "second")
+		Expect(err).To(MatchError(ContainSubstring("429")))
+		usage, err := limitedClient.LimitsUsage(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(usage.Limited).To(BeEquivalentTo(1))
+		Expect(limitedClient.Metrics(ctx)).To(ContainSubstring(`netexec_limited_total{protocol="http",limit="rate"} 1`))
+	})
+
+	It("frees the connection slots of misbehaving and proxied clients", func() {
+		limited, _ := startServer(ctx, "netexec-c", func(cfg *netexec.Config) {
+			cfg.Limits.ConcurrentConnections = 1
+		})
+		conn, err := net.Dial("tcp", limited.HTTPAddr().String())
+		Expect(err).NotTo(HaveOccurred())
+		_, err = conn.Write([]byte("GET /hostname?misbehave=hang HTTP/1.1\r\nHost: netexec-c\r\n\r\n"))
+		Expect(err).NotTo(HaveOccurred())
+		conn.Close()
+		limitedClient := netexec.NewClient("http://" + limited.HTTPAddr().String())
+		limitedClient.HTTPClient = &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		Eventually(func() (string, error) { return limitedClient.Hostname(ctx) }).Should(Equal("netexec-c"))
+
+		// Behind a proxy, the clients are the ones of the PROXY headers.
+		proxied, _ := startServer(ctx, "netexec-d", func(cfg *netexec.Config) {
+			cfg.ProxyProtocol = "require"
+			cfg.Limits.ConcurrentConnections = 1
+			cfg.Limits.PerClient = true
+		})
+		request := func(source string) (*http.Response, error) {
+			conn, err := net.Dial("tcp", proxied.HTTPAddr().String())
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(conn.Close)
+			_, err = conn.Write([]byte("PROXY TCP4 " + source + " 127.0.0.1 40000 80\r\nGET /hostname HTTP/1.1\r\nHost: netexec-d\r\n\r\n"))
+			Expect(err).NotTo(HaveOccurred())
+			return http.ReadResponse(bufio.NewReader(conn), nil)
+		}
+		for _, source := range []string{"192.0.2.1", "192.0.2.2"} {
+			resp, err := request(source)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusOK), source)
+		}
+		resp, err := request("192.0.2.1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusServiceUnavailable))
+	})
+
+	It("continues the traces of requests and dials", func() {
+		type export struct {
+			path string
+			body []byte
+		}
+		// The exports are checked by the spec: assertions must not fail in the
+		// goroutine of the receiver.
+		exports := make(chan export, 100)
+		receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			exports <- export{path: r.URL.Path, body: body}
+		}))
+		DeferCleanup(receiver.Close)
+		traced, tracedClient := startServer(ctx, "netexec-c", func(cfg *netexec.Config) { cfg.Tracing.Endpoint = receiver.URL })
+		tracedPeer, _ := startServer(ctx, "netexec-d", func(cfg *netexec.Config) { cfg.Tracing.Endpoint = receiver.URL })
+		tracedClient.HTTPClient = &http.Client{Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+			return http.DefaultTransport.RoundTrip(r)
+		})}
+		_, err := tracedClient.Dial(ctx, netexec.DialRequest{Host: "127.0.0.1", Port: port(tracedPeer.HTTPAddr()), Request: "hostname"})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = tracedClient.AddFault(ctx, netexec.FaultRule{Path: "/echo", ClosePercent: 100})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = tracedClient.Echo(ctx, "aborted")
+		Expect(err).To(HaveOccurred())
+		Expect(traced.Shutdown(ctx)).To(Succeed())
+		Expect(tracedPeer.Shutdown(ctx)).To(Succeed())
+
+		spans := map[string]map[string]interface{}{}
+		receivedSpans := func() map[string]map[string]interface{} {
+			for {
+				select {
+				case e := <-exports:
+					var traces struct {
+						ResourceSpans []struct {
+							ScopeSpans []struct {
+								Spans []map[string]interface{}
+							}
+						}
+					}
+					Expect(e.path).To(Equal("/v1/traces"))
+					Expect(json.Unmarshal(e.body, &traces)).To(Succeed())
+					for _, resourceSpans := range traces.ResourceSpans {
+						for _, scopeSpans := range resourceSpans.ScopeSpans {
+							for _, span := range scopeSpans.Spans {
+								spans[span["name"].(string)] = span
+							}
+						}
+					}
+				default:
+					return spans
+				}
+			}
+		}
+		Eventually(receivedSpans).Should(And(HaveKey("GET /dial"), HaveKey("dial http"), HaveKey("GET /hostname"), HaveKey("GET /echo")))
+		for _, span := range spans {
+			Expect(span["traceId"]).To(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+		}
+		Expect(spans["GET /dial"]["parentSpanId"]).To(Equal("00f067aa0ba902b7"))
+		Expect(spans["dial http"]["parentSpanId"]).To(Equal(spans["GET /dial"]["spanId"]))
+		Expect(spans["GET /hostname"]["parentSpanId"]).To(Equal(spans["dial http"]["spanId"]))
+		Expect(spans["GET /echo"]["status"]).To(Equal(map[string]interface{}{"code": 2.0, "message": "handler aborted: net/http: abort Handler"}))
+	})
+
+	It("rejects invalid configurations", func() {
+		cfg := netexec.DefaultConfig()
+		cfg.HTTP.Port = 70000
+		_, err := netexec.NewServer(cfg)
+		Expect(err).To(MatchError(ContainSubstring("http.port")))
+	})
+})
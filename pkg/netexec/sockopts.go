@@ -0,0 +1,378 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ishidawataru/sctp"
+	"golang.org/x/sys/unix"
+)
+
+// SocketOptions are the socket options of the /dial connections, as
+// requested, in which case unset ones keep the kernel's defaults, or as read
+// back from the socket, in which case unset ones do not apply to it.
+type SocketOptions struct {
+	// TOS is the IPv4 TOS or IPv6 traffic class, the DSCP in its upper 6
+	// bits, and TTL the IPv4 TTL or IPv6 hop limit.
+	TOS *int `json:"tos,omitempty"`
+	TTL *int `json:"ttl,omitempty"`
+	// NoDelay disables Nagle's algorithm of TCP and SCTP.
+	NoDelay *bool `json:"noDelay,omitempty"`
+	// KeepAlive enables the TCP keepalives, sent after KeepAliveIdle seconds
+	// without traffic then every KeepAliveInterval seconds, the connection
+	// being dropped after KeepAliveCount unanswered ones.
+	KeepAlive         *bool `json:"keepAlive,omitempty"`
+	KeepAliveIdle     *int  `json:"keepAliveIdle,omitempty"`
+	KeepAliveInterval *int  `json:"keepAliveInterval,omitempty"`
+	KeepAliveCount    *int  `json:"keepAliveCount,omitempty"`
+	// Linger is the SO_LINGER timeout in seconds, -1 if disabled.
+	Linger *int `json:"linger,omitempty"`
+	// MSS is the TCP maximum segment size.
+	MSS           *int `json:"mss,omitempty"`
+	SendBuffer    *int `json:"sendBuffer,omitempty"`
+	ReceiveBuffer *int `json:"receiveBuffer,omitempty"`
+}
+
+// parseSocketOptions reads the socket options of the /dial parameters, and
+// checks they apply to protocol. It returns nil if none is set.
+func parseSocketOptions(query url.Values, protocol string) (*SocketOptions, error) {
+	o := &SocketOptions{}
+	set := false
+	intParam := func(name string, min, max int) (*int, error) {
+		value := query.Get(name)
+		if value == "" {
+			return nil, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min || n > max {
+			return nil, fmt.Errorf("%s parameter must be an integer between %d and %d, got %q", name, min, max, value)
+		}
+		set = true
+		return &n, nil
+	}
+	boolParam := func(name string) (*bool, error) {
+		value := query.Get(name)
+		if value == "" {
+			return nil, nil
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s parameter must be a boolean, got %q", name, value)
+		}
+		set = true
+		return &b, nil
+	}
+	var err error
+	var dscp *int
+	for _, p := range []struct {
+		value    **int
+		name     string
+		min, max int
+	}{
+		{&o.TOS, "tos", 0, 255},
+		{&dscp, "dscp", 0, 63},
+		{&o.TTL, "ttl", 1, 255},
+		{&o.KeepAliveIdle, "keepaliveIdle", 1, 32767},
+		{&o.KeepAliveInterval, "keepaliveInterval", 1, 32767},
+		{&o.KeepAliveCount, "keepaliveCount", 1, 127},
+		{&o.Linger, "linger", -1, 3600},
+		{&o.MSS, "mss", 88, 65535},
+		{&o.SendBuffer, "sndbuf", 1, 1 << 30},
+		{&o.ReceiveBuffer, "rcvbuf", 1, 1 << 30},
+	} {
+		if *p.value, err = intParam(p.name, p.min, p.max); err != nil {
+			return nil, err
+		}
+	}
+	if o.NoDelay, err = boolParam("nodelay"); err != nil {
+		return nil, err
+	}
+	if o.KeepAlive, err = boolParam("keepalive"); err != nil {
+		return nil, err
+	}
+	if !set {
+		return nil, nil
+	}
+	if dscp != nil {
+		if o.TOS != nil {
+			return nil, fmt.Errorf("dscp and tos parameters are exclusive")
+		}
+		tos := *dscp << 2
+		o.TOS = &tos
+	}
+	if o.KeepAlive == nil && (o.KeepAliveIdle != nil || o.KeepAliveInterval != nil || o.KeepAliveCount != nil) {
+		keepAlive := true
+		o.KeepAlive = &keepAlive
+	}
+	switch strings.ToLower(protocol) {
+	case "", "http", "tcp":
+	case "udp":
+		if o.NoDelay != nil || o.KeepAlive != nil || o.Linger != nil || o.MSS != nil {
+			return nil, fmt.Errorf("nodelay, keepalive, linger and mss parameters do not apply to udp")
+		}
+	case "sctp":
+		if o.KeepAlive != nil || o.MSS != nil {
+			return nil, fmt.Errorf("keepalive and mss parameters do not apply to sctp")
+		}
+	default:
+		return nil, fmt.Errorf("socket options are not supported for protocol %s", protocol)
+	}
+	return o, nil
+}
+
+// dialSockets carries the requested socket options of a dial through its
+// context, and the options in effect on the last socket it opened.
+type dialSockets struct {
+	requested *SocketOptions
+
+	mu        sync.Mutex
+	effective *SocketOptions
+}
+
+type dialSocketsKey struct{}
+
+// withSocketOptions returns ctx making the dialers apply o, and the record
+// of the options in effect.
+func withSocketOptions(ctx context.Context, o *SocketOptions) (context.Context, *dialSockets) {
+	d := &dialSockets{requested: o}
+	return context.WithValue(ctx, dialSocketsKey{}, d), d
+}
+
+func dialSocketsFromContext(ctx context.Context) *dialSockets {
+	d, _ := ctx.Value(dialSocketsKey{}).(*dialSockets)
+	return d
+}
+
+// lastEffective returns the options in effect on the last socket opened.
+func (d *dialSockets) lastEffective() *SocketOptions {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.effective
+}
+
+func (d *dialSockets) record(o *SocketOptions) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.effective = o
+}
+
+// socketDialer returns a net.Dialer applying the socket options of ctx.
+func socketDialer(ctx context.Context, timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout}
+	d := dialSocketsFromContext(ctx)
+	if d == nil {
+		return dialer
+	}
+	if d.requested.KeepAlive != nil {
+		// Otherwise the dialer enables the keepalives with its own periods.
+		dialer.KeepAlive = -1
+	}
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		return controlSocket(c, func(fd int) error { return d.requested.apply(fd) })
+	}
+	return dialer
+}
+
+// sctpSocketConfig returns the SCTP socket configuration applying the socket
+// options and connect timeout of ctx. As SCTP connections do not expose their
+// socket, the options in effect are read back before connecting.
+func sctpSocketConfig(ctx context.Context) *sctp.SocketConfig {
+	cfg := &sctp.SocketConfig{InitMsg: sctp.InitMsg{NumOstreams: sctp.SCTP_MAX_STREAM}}
+	timeout := dialPolicyFromContext(ctx).connectTimeout
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+	}
+	d := dialSocketsFromContext(ctx)
+	cfg.Control = func(network, address string, c syscall.RawConn) error {
+		if timeout <= 0 {
+			return context.DeadlineExceeded
+		}
+		return controlSocket(c, func(fd int) error {
+			// The blocking connect of the SCTP dialer waits for at most the
+			// send timeout.
+			tv := unix.NsecToTimeval(timeout.Nanoseconds())
+			if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_SNDTIMEO, &tv); err != nil {
+				return fmt.Errorf("failed to set the connect timeout: %v", err)
+			}
+			if d == nil {
+				return nil
+			}
+			if err := d.requested.apply(fd); err != nil {
+				return err
+			}
+			d.record(readSocketOptions(fd))
+			return nil
+		})
+	}
+	return cfg
+}
+
+// recordSocketOptions applies the options of ctx that the dialers reset once
+// connected, and records the options in effect on conn.
+func recordSocketOptions(ctx context.Context, conn net.Conn) error {
+	d := dialSocketsFromContext(ctx)
+	if d == nil {
+		return nil
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok && d.requested.NoDelay != nil {
+		if err := tcpConn.SetNoDelay(*d.requested.NoDelay); err != nil {
+			return fmt.Errorf("failed to set TCP_NODELAY: %v", err)
+		}
+	}
+	syscallConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := syscallConn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return controlSocket(raw, func(fd int) error {
+		d.record(readSocketOptions(fd))
+		return nil
+	})
+}
+
+func controlSocket(c syscall.RawConn, f func(fd int) error) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) { sockErr = f(int(fd)) }); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// socketKind returns whether fd is an IPv6 socket, and its protocol.
+func socketKind(fd int) (bool, int) {
+	domain, _ := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	protocol, _ := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_PROTOCOL)
+	return domain == unix.AF_INET6, protocol
+}
+
+// apply sets the requested options on fd, before it connects.
+func (o *SocketOptions) apply(fd int) error {
+	ipv6, protocol := socketKind(fd)
+	set := func(name string, level, opt int, value *int) error {
+		if value == nil {
+			return nil
+		}
+		if err := unix.SetsockoptInt(fd, level, opt, *value); err != nil {
+			return fmt.Errorf("failed to set %s to %d: %v", name, *value, err)
+		}
+		return nil
+	}
+	setBool := func(name string, level, opt int, value *bool) error {
+		if value == nil {
+			return nil
+		}
+		n := 0
+		if *value {
+			n = 1
+		}
+		return set(name, level, opt, &n)
+	}
+	var errs []error
+	if ipv6 {
+		// IPv4 options also apply to the IPv4 peers of dual-stack sockets,
+		// when the kernel lets them be set.
+		_ = set("IP_TOS", unix.IPPROTO_IP, unix.IP_TOS, o.TOS)
+		_ = set("IP_TTL", unix.IPPROTO_IP, unix.IP_TTL, o.TTL)
+		errs = append(errs,
+			set("IPV6_TCLASS", unix.IPPROTO_IPV6, unix.IPV6_TCLASS, o.TOS),
+			set("IPV6_UNICAST_HOPS", unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, o.TTL))
+	} else {
+		errs = append(errs,
+			set("IP_TOS", unix.IPPROTO_IP, unix.IP_TOS, o.TOS),
+			set("IP_TTL", unix.IPPROTO_IP, unix.IP_TTL, o.TTL))
+	}
+	errs = append(errs,
+		set("SO_SNDBUF", unix.SOL_SOCKET, unix.SO_SNDBUF, o.SendBuffer),
+		set("SO_RCVBUF", unix.SOL_SOCKET, unix.SO_RCVBUF, o.ReceiveBuffer))
+	if o.Linger != nil {
+		linger := &unix.Linger{Onoff: 1, Linger: int32(*o.Linger)}
+		if *o.Linger < 0 {
+			linger = &unix.Linger{}
+		}
+		if err := unix.SetsockoptLinger(fd, unix.SOL_SOCKET, unix.SO_LINGER, linger); err != nil {
+			errs = append(errs, fmt.Errorf("failed to set SO_LINGER to %d: %v", *o.Linger, err))
+		}
+	}
+	switch protocol {
+	case unix.IPPROTO_TCP:
+		errs = append(errs,
+			setBool("TCP_NODELAY", unix.IPPROTO_TCP, unix.TCP_NODELAY, o.NoDelay),
+			setBool("SO_KEEPALIVE", unix.SOL_SOCKET, unix.SO_KEEPALIVE, o.KeepAlive),
+			set("TCP_KEEPIDLE", unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, o.KeepAliveIdle),
+			set("TCP_KEEPINTVL", unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, o.KeepAliveInterval),
+			set("TCP_KEEPCNT", unix.IPPROTO_TCP, unix.TCP_KEEPCNT, o.KeepAliveCount),
+			set("TCP_MAXSEG", unix.IPPROTO_TCP, unix.TCP_MAXSEG, o.MSS))
+	case unix.IPPROTO_SCTP:
+		errs = append(errs, setBool("SCTP_NODELAY", sctp.SOL_SCTP, sctp.SCTP_NODELAY, o.NoDelay))
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSocketOptions reads the options in effect on fd.
+func readSocketOptions(fd int) *SocketOptions {
+	ipv6, protocol := socketKind(fd)
+	o := &SocketOptions{}
+	get := func(level, opt int) *int {
+		n, err := unix.GetsockoptInt(fd, level, opt)
+		if err != nil {
+			return nil
+		}
+		return &n
+	}
+	getBool := func(level, opt int) *bool {
+		n := get(level, opt)
+		if n == nil {
+			return nil
+		}
+		b := *n != 0
+		return &b
+	}
+	if ipv6 {
+		o.TOS = get(unix.IPPROTO_IPV6, unix.IPV6_TCLASS)
+		o.TTL = get(unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS)
+	} else {
+		o.TOS = get(unix.IPPROTO_IP, unix.IP_TOS)
+		o.TTL = get(unix.IPPROTO_IP, unix.IP_TTL)
+	}
+	o.SendBuffer = get(unix.SOL_SOCKET, unix.SO_SNDBUF)
+	o.ReceiveBuffer = get(unix.SOL_SOCKET, unix.SO_RCVBUF)
+	if protocol != unix.IPPROTO_UDP {
+		if linger, err := unix.GetsockoptLinger(fd, unix.SOL_SOCKET, unix.SO_LINGER); err == nil {
+			seconds := -1
+			if linger.Onoff != 0 {
+				seconds = int(linger.Linger)
+			}
+			o.Linger = &seconds
+		}
+	}
+	switch protocol {
+	case unix.IPPROTO_TCP:
+		o.NoDelay = getBool(unix.IPPROTO_TCP, unix.TCP_NODELAY)
+		o.KeepAlive = getBool(unix.SOL_SOCKET, unix.SO_KEEPALIVE)
+		o.KeepAliveIdle = get(unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+		o.KeepAliveInterval = get(unix.IPPROTO_TCP, unix.TCP_KEEPINTVL)
+		o.KeepAliveCount = get(unix.IPPROTO_TCP, unix.TCP_KEEPCNT)
+		o.MSS = get(unix.IPPROTO_TCP, unix.TCP_MAXSEG)
+	case unix.IPPROTO_SCTP:
+		o.NoDelay = getBool(sctp.SOL_SCTP, sctp.SCTP_NODELAY)
+	}
+	return o
+}
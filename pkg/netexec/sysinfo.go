@@ -0,0 +1,651 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// resolvConfPath is read by /sysinfo and /dns.
+const resolvConfPath = "/etc/resolv.conf"
+
+// sysctls are the network settings reported by /sysinfo, when they exist.
+var sysctls = []string{
+	"net.core.rmem_max",
+	"net.core.somaxconn",
+	"net.core.wmem_max",
+	"net.ipv4.conf.all.rp_filter",
+	"net.ipv4.conf.default.rp_filter",
+	"net.ipv4.ip_forward",
+	"net.ipv4.ip_local_port_range",
+	"net.ipv4.ping_group_range",
+	"net.ipv4.tcp_congestion_control",
+	"net.ipv4.tcp_fin_timeout",
+	"net.ipv4.tcp_keepalive_intvl",
+	"net.ipv4.tcp_keepalive_probes",
+	"net.ipv4.tcp_keepalive_time",
+	"net.ipv4.tcp_mtu_probing",
+	"net.ipv4.tcp_syn_retries",
+	"net.ipv6.conf.all.disable_ipv6",
+	"net.ipv6.conf.all.forwarding",
+	"net.netfilter.nf_conntrack_max",
+	"net.netfilter.nf_conntrack_tcp_timeout_established",
+	"net.netfilter.nf_conntrack_udp_timeout",
+	"net.netfilter.nf_conntrack_udp_timeout_stream",
+}
+
+// nativeEndian is the byte order of the integers in netlink messages.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// SysInfo is the JSON answer of /sysinfo, describing the network namespace
+// netexec runs in.
+type SysInfo struct {
+	Hostname   string            `json:"hostname"`
+	Interfaces []SysInterface    `json:"interfaces"`
+	Routes     []SysRoute        `json:"routes"`
+	Rules      []SysRule         `json:"rules"`
+	Neighbors  []SysNeighbor     `json:"neighbors"`
+	Sockets    []SysSocket       `json:"sockets"`
+	Sysctls    map[string]string `json:"sysctls"`
+	ResolvConf *ResolvConf       `json:"resolvConf,omitempty"`
+	// Errors maps the sections that could not be read to the reason.
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// SysInterface is a network interface, like "ip -s addr" shows it.
+type SysInterface struct {
+	Index        int      `json:"index"`
+	Name         string   `json:"name"`
+	Kind         string   `json:"kind,omitempty"`
+	HardwareAddr string   `json:"hardwareAddr,omitempty"`
+	MTU          int      `json:"mtu"`
+	Flags        []string `json:"flags"`
+	OperState    string   `json:"operState"`
+	Master       string   `json:"master,omitempty"`
+	Addresses    []string `json:"addresses"`
+	Stats        *struct {
+		RxPackets uint64 `json:"rxPackets"`
+		TxPackets uint64 `json:"txPackets"`
+		RxBytes   uint64 `json:"rxBytes"`
+		TxBytes   uint64 `json:"txBytes"`
+		RxErrors  uint64 `json:"rxErrors"`
+		TxErrors  uint64 `json:"txErrors"`
+		RxDropped uint64 `json:"rxDropped"`
+		TxDropped uint64 `json:"txDropped"`
+	} `json:"stats,omitempty"`
+}
+
+// SysRoute is a route of any table, like "ip route show table all" shows it.
+type SysRoute struct {
+	Family      string `json:"family"`
+	Table       string `json:"table"`
+	Type        string `json:"type"`
+	Destination string `json:"destination"`
+	Source      string `json:"source,omitempty"`
+	Gateway     string `json:"gateway,omitempty"`
+	Device      string `json:"device,omitempty"`
+	PrefSrc     string `json:"prefSrc,omitempty"`
+	Protocol    string `json:"protocol"`
+	Scope       string `json:"scope"`
+	Metric      uint32 `json:"metric,omitempty"`
+}
+
+// SysRule is a policy routing rule, like "ip rule" shows it.
+type SysRule struct {
+	Family   string `json:"family"`
+	Priority uint32 `json:"priority"`
+	From     string `json:"from,omitempty"`
+	To       string `json:"to,omitempty"`
+	IIF      string `json:"iif,omitempty"`
+	OIF      string `json:"oif,omitempty"`
+	FwMark   string `json:"fwmark,omitempty"`
+	Action   string `json:"action"`
+	Table    string `json:"table,omitempty"`
+}
+
+// SysNeighbor is an ARP or NDP entry, like "ip neigh" shows it.
+type SysNeighbor struct {
+	Address      string   `json:"address"`
+	Device       string   `json:"device"`
+	HardwareAddr string   `json:"hardwareAddr,omitempty"`
+	State        []string `json:"state"`
+}
+
+// SysSocket is a listening TCP socket or a bound UDP socket, like "ss -tuln"
+// shows it.
+type SysSocket struct {
+	Protocol     string `json:"protocol"`
+	LocalAddress string `json:"localAddress"`
+	UID          int    `json:"uid"`
+	Inode        uint64 `json:"inode"`
+}
+
+// ResolvConf is the parsed content of /etc/resolv.conf.
+type ResolvConf struct {
+	Nameservers []string `json:"nameservers"`
+	Search      []string `json:"search"`
+	Options     []string `json:"options"`
+}
+
+// sysinfoHandler reports the interfaces, routes, rules, neighbors, sockets,
+// network sysctls and resolver configuration of netexec's network namespace.
+func (s *Server) sysinfoHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET /sysinfo")
+	info := SysInfo{Hostname: s.hostname, Errors: map[string]string{}}
+	links := map[int]string{}
+	var err error
+	if info.Interfaces, err = readInterfaces(); err != nil {
+		info.Errors["interfaces"] = err.Error()
+	}
+	for _, ifi := range info.Interfaces {
+		links[ifi.Index] = ifi.Name
+	}
+	for i := range info.Interfaces {
+		if master, err := strconv.Atoi(info.Interfaces[i].Master); err == nil {
+			info.Interfaces[i].Master = links[master]
+		}
+	}
+	if info.Routes, err = readRoutes(links); err != nil {
+		info.Errors["routes"] = err.Error()
+	}
+	if info.Rules, err = readRules(); err != nil {
+		info.Errors["rules"] = err.Error()
+	}
+	if info.Neighbors, err = readNeighbors(links); err != nil {
+		info.Errors["neighbors"] = err.Error()
+	}
+	if info.Sockets, err = readSockets(); err != nil {
+		info.Errors["sockets"] = err.Error()
+	}
+	info.Sysctls = readSysctls()
+	if info.ResolvConf, err = readResolvConf(resolvConfPath); err != nil {
+		info.Errors["resolvConf"] = err.Error()
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// netlinkDump returns the messages of a netlink route dump request.
+func netlinkDump(proto, family int) ([]syscall.NetlinkMessage, error) {
+	data, err := syscall.NetlinkRIB(proto, family)
+	if err != nil {
+		return nil, fmt.Errorf("netlink request %d failed: %v", proto, err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(data)
+	if err != nil {
+		return nil, fmt.Errorf("netlink reply %d could not be parsed: %v", proto, err)
+	}
+	res := msgs[:0]
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.NLMSG_DONE && msg.Header.Type != syscall.NLMSG_ERROR {
+			res = append(res, msg)
+		}
+	}
+	return res, nil
+}
+
+// netlinkAttrs parses the attributes following a fixed size header.
+func netlinkAttrs(b []byte) map[uint16][]byte {
+	attrs := map[uint16][]byte{}
+	for len(b) >= unix.SizeofRtAttr {
+		length := int(nativeEndian.Uint16(b[0:2]))
+		kind := nativeEndian.Uint16(b[2:4])
+		if length < unix.SizeofRtAttr || length > len(b) {
+			break
+		}
+		// Strip the nested and byte order flags.
+		attrs[kind&0x3fff] = b[unix.SizeofRtAttr:length]
+		aligned := (length + unix.RTA_ALIGNTO - 1) &^ (unix.RTA_ALIGNTO - 1)
+		if aligned > len(b) {
+			break
+		}
+		b = b[aligned:]
+	}
+	return attrs
+}
+
+func attrString(b []byte) string {
+	return strings.TrimRight(string(b), "\x00")
+}
+
+func attrUint32(b []byte) uint32 {
+	if len(b) < 4 {
+		return 0
+	}
+	return nativeEndian.Uint32(b)
+}
+
+func familyName(family uint8) string {
+	switch family {
+	case unix.AF_INET:
+		return "ipv4"
+	case unix.AF_INET6:
+		return "ipv6"
+	}
+	return strconv.Itoa(int(family))
+}
+
+// prefix formats a destination or source of length bits, "default" or "all"
+// if there is none.
+func prefix(addr []byte, bits uint8, none string) string {
+	if len(addr) == 0 {
+		return none
+	}
+	return fmt.Sprintf("%s/%d", net.IP(addr), bits)
+}
+
+var interfaceFlagNames = []struct {
+	flag uint32
+	name string
+}{
+	{unix.IFF_UP, "up"},
+	{unix.IFF_BROADCAST, "broadcast"},
+	{unix.IFF_LOOPBACK, "loopback"},
+	{unix.IFF_POINTOPOINT, "pointtopoint"},
+	{unix.IFF_NOARP, "noarp"},
+	{unix.IFF_PROMISC, "promisc"},
+	{unix.IFF_MULTICAST, "multicast"},
+	{unix.IFF_LOWER_UP, "lower_up"},
+}
+
+var operStateNames = []string{"unknown", "notpresent", "down", "lowerlayerdown", "testing", "dormant", "up"}
+
+func readInterfaces() ([]SysInterface, error) {
+	msgs, err := netlinkDump(unix.RTM_GETLINK, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	interfaces := []SysInterface{}
+	byIndex := map[int]int{}
+	for _, msg := range msgs {
+		if msg.Header.Type != unix.RTM_NEWLINK || len(msg.Data) < unix.SizeofIfInfomsg {
+			continue
+		}
+		flags := nativeEndian.Uint32(msg.Data[8:12])
+		ifi := SysInterface{
+			Index:     int(int32(nativeEndian.Uint32(msg.Data[4:8]))),
+			Flags:     []string{},
+			Addresses: []string{},
+			OperState: "unknown",
+		}
+		for _, f := range interfaceFlagNames {
+			if flags&f.flag != 0 {
+				ifi.Flags = append(ifi.Flags, f.name)
+			}
+		}
+		attrs := netlinkAttrs(msg.Data[unix.SizeofIfInfomsg:])
+		ifi.Name = attrString(attrs[unix.IFLA_IFNAME])
+		ifi.MTU = int(attrUint32(attrs[unix.IFLA_MTU]))
+		if addr := attrs[unix.IFLA_ADDRESS]; len(addr) > 0 {
+			ifi.HardwareAddr = net.HardwareAddr(addr).String()
+		}
+		if state := attrs[unix.IFLA_OPERSTATE]; len(state) == 1 && int(state[0]) < len(operStateNames) {
+			ifi.OperState = operStateNames[state[0]]
+		}
+		if master := attrs[unix.IFLA_MASTER]; len(master) == 4 {
+			// Resolved to a name once every interface is known.
+			ifi.Master = strconv.Itoa(int(attrUint32(master)))
+		}
+		if linkInfo, ok := attrs[unix.IFLA_LINKINFO]; ok {
+			ifi.Kind = attrString(netlinkAttrs(linkInfo)[unix.IFLA_INFO_KIND])
+		}
+		if stats := attrs[unix.IFLA_STATS64]; len(stats) >= 64 {
+			ifi.Stats = &struct {
+				RxPackets uint64 `json:"rxPackets"`
+				TxPackets uint64 `json:"txPackets"`
+				RxBytes   uint64 `json:"rxBytes"`
+				TxBytes   uint64 `json:"txBytes"`
+				RxErrors  uint64 `json:"rxErrors"`
+				TxErrors  uint64 `json:"txErrors"`
+				RxDropped uint64 `json:"rxDropped"`
+				TxDropped uint64 `json:"txDropped"`
+			}{
+				RxPackets: nativeEndian.Uint64(stats[0:]),
+				TxPackets: nativeEndian.Uint64(stats[8:]),
+				RxBytes:   nativeEndian.Uint64(stats[16:]),
+				TxBytes:   nativeEndian.Uint64(stats[24:]),
+				RxErrors:  nativeEndian.Uint64(stats[32:]),
+				TxErrors:  nativeEndian.Uint64(stats[40:]),
+				RxDropped: nativeEndian.Uint64(stats[48:]),
+				TxDropped: nativeEndian.Uint64(stats[56:]),
+			}
+		}
+		byIndex[ifi.Index] = len(interfaces)
+		interfaces = append(interfaces, ifi)
+	}
+
+	msgs, err = netlinkDump(unix.RTM_GETADDR, unix.AF_UNSPEC)
+	if err != nil {
+		return interfaces, err
+	}
+	for _, msg := range msgs {
+		if msg.Header.Type != unix.RTM_NEWADDR || len(msg.Data) < unix.SizeofIfAddrmsg {
+			continue
+		}
+		prefixLen := msg.Data[1]
+		index := int(nativeEndian.Uint32(msg.Data[4:8]))
+		attrs := netlinkAttrs(msg.Data[unix.SizeofIfAddrmsg:])
+		addr := attrs[unix.IFA_LOCAL]
+		if addr == nil {
+			addr = attrs[unix.IFA_ADDRESS]
+		}
+		if i, ok := byIndex[index]; ok && addr != nil {
+			interfaces[i].Addresses = append(interfaces[i].Addresses, prefix(addr, prefixLen, ""))
+		}
+	}
+	sort.Slice(interfaces, func(i, j int) bool { return interfaces[i].Index < interfaces[j].Index })
+	return interfaces, nil
+}
+
+func tableName(table uint32) string {
+	switch table {
+	case unix.RT_TABLE_DEFAULT:
+		return "default"
+	case unix.RT_TABLE_MAIN:
+		return "main"
+	case unix.RT_TABLE_LOCAL:
+		return "local"
+	}
+	return strconv.Itoa(int(table))
+}
+
+var routeTypeNames = map[uint8]string{
+	unix.RTN_UNICAST:     "unicast",
+	unix.RTN_LOCAL:       "local",
+	unix.RTN_BROADCAST:   "broadcast",
+	unix.RTN_ANYCAST:     "anycast",
+	unix.RTN_MULTICAST:   "multicast",
+	unix.RTN_BLACKHOLE:   "blackhole",
+	unix.RTN_UNREACHABLE: "unreachable",
+	unix.RTN_PROHIBIT:    "prohibit",
+	unix.RTN_THROW:       "throw",
+}
+
+var routeProtocolNames = map[uint8]string{
+	unix.RTPROT_REDIRECT: "redirect",
+	unix.RTPROT_KERNEL:   "kernel",
+	unix.RTPROT_BOOT:     "boot",
+	unix.RTPROT_STATIC:   "static",
+	unix.RTPROT_RA:       "ra",
+	unix.RTPROT_DHCP:     "dhcp",
+	unix.RTPROT_BGP:      "bgp",
+	unix.RTPROT_BIRD:     "bird",
+}
+
+var routeScopeNames = map[uint8]string{
+	unix.RT_SCOPE_UNIVERSE: "global",
+	unix.RT_SCOPE_SITE:     "site",
+	unix.RT_SCOPE_LINK:     "link",
+	unix.RT_SCOPE_HOST:     "host",
+	unix.RT_SCOPE_NOWHERE:  "nowhere",
+}
+
+func lookupName(names map[uint8]string, value uint8) string {
+	if name, ok := names[value]; ok {
+		return name
+	}
+	return strconv.Itoa(int(value))
+}
+
+func readRoutes(links map[int]string) ([]SysRoute, error) {
+	msgs, err := netlinkDump(unix.RTM_GETROUTE, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	routes := []SysRoute{}
+	for _, msg := range msgs {
+		if msg.Header.Type != unix.RTM_NEWROUTE || len(msg.Data) < unix.SizeofRtMsg {
+			continue
+		}
+		attrs := netlinkAttrs(msg.Data[unix.SizeofRtMsg:])
+		table := uint32(msg.Data[4])
+		if t, ok := attrs[unix.RTA_TABLE]; ok {
+			table = attrUint32(t)
+		}
+		route := SysRoute{
+			Family:      familyName(msg.Data[0]),
+			Table:       tableName(table),
+			Type:        lookupName(routeTypeNames, msg.Data[7]),
+			Destination: prefix(attrs[unix.RTA_DST], msg.Data[1], "default"),
+			Protocol:    lookupName(routeProtocolNames, msg.Data[5]),
+			Scope:       lookupName(routeScopeNames, msg.Data[6]),
+			Metric:      attrUint32(attrs[unix.RTA_PRIORITY]),
+		}
+		if src := attrs[unix.RTA_SRC]; src != nil {
+			route.Source = prefix(src, msg.Data[2], "")
+		}
+		if gw := attrs[unix.RTA_GATEWAY]; gw != nil {
+			route.Gateway = net.IP(gw).String()
+		}
+		if prefSrc := attrs[unix.RTA_PREFSRC]; prefSrc != nil {
+			route.PrefSrc = net.IP(prefSrc).String()
+		}
+		if oif, ok := attrs[unix.RTA_OIF]; ok {
+			route.Device = links[int(attrUint32(oif))]
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+var ruleActionNames = map[uint8]string{
+	unix.FR_ACT_TO_TBL:      "lookup",
+	unix.FR_ACT_GOTO:        "goto",
+	unix.FR_ACT_NOP:         "nop",
+	unix.FR_ACT_BLACKHOLE:   "blackhole",
+	unix.FR_ACT_UNREACHABLE: "unreachable",
+	unix.FR_ACT_PROHIBIT:    "prohibit",
+}
+
+func readRules() ([]SysRule, error) {
+	rules := []SysRule{}
+	for _, family := range []int{unix.AF_INET, unix.AF_INET6} {
+		msgs, err := netlinkDump(unix.RTM_GETRULE, family)
+		if err != nil {
+			return rules, err
+		}
+		for _, msg := range msgs {
+			// struct fib_rule_hdr has the size and layout of struct rtmsg.
+			if msg.Header.Type != unix.RTM_NEWRULE || len(msg.Data) < unix.SizeofRtMsg {
+				continue
+			}
+			attrs := netlinkAttrs(msg.Data[unix.SizeofRtMsg:])
+			rule := SysRule{
+				Family:   familyName(msg.Data[0]),
+				Priority: attrUint32(attrs[unix.FRA_PRIORITY]),
+				IIF:      attrString(attrs[unix.FRA_IIFNAME]),
+				OIF:      attrString(attrs[unix.FRA_OIFNAME]),
+				Action:   lookupName(ruleActionNames, msg.Data[7]),
+			}
+			if src := attrs[unix.FRA_SRC]; src != nil {
+				rule.From = prefix(src, msg.Data[2], "")
+			}
+			if dst := attrs[unix.FRA_DST]; dst != nil {
+				rule.To = prefix(dst, msg.Data[1], "")
+			}
+			if mark, ok := attrs[unix.FRA_FWMARK]; ok {
+				rule.FwMark = fmt.Sprintf("0x%x", attrUint32(mark))
+			}
+			if msg.Data[7] == unix.FR_ACT_TO_TBL {
+				table := uint32(msg.Data[4])
+				if t, ok := attrs[unix.FRA_TABLE]; ok {
+					table = attrUint32(t)
+				}
+				rule.Table = tableName(table)
+			}
+			rules = append(rules, rule)
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].Priority < rules[j].Priority })
+	return rules, nil
+}
+
+var neighborStateNames = []struct {
+	state uint16
+	name  string
+}{
+	{unix.NUD_INCOMPLETE, "incomplete"},
+	{unix.NUD_REACHABLE, "reachable"},
+	{unix.NUD_STALE, "stale"},
+	{unix.NUD_DELAY, "delay"},
+	{unix.NUD_PROBE, "probe"},
+	{unix.NUD_FAILED, "failed"},
+	{unix.NUD_NOARP, "noarp"},
+	{unix.NUD_PERMANENT, "permanent"},
+}
+
+func readNeighbors(links map[int]string) ([]SysNeighbor, error) {
+	msgs, err := netlinkDump(unix.RTM_GETNEIGH, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, err
+	}
+	neighbors := []SysNeighbor{}
+	for _, msg := range msgs {
+		if msg.Header.Type != unix.RTM_NEWNEIGH || len(msg.Data) < unix.SizeofNdMsg {
+			continue
+		}
+		attrs := netlinkAttrs(msg.Data[unix.SizeofNdMsg:])
+		dst := attrs[unix.NDA_DST]
+		if dst == nil {
+			continue
+		}
+		state := nativeEndian.Uint16(msg.Data[8:10])
+		neighbor := SysNeighbor{
+			Address: net.IP(dst).String(),
+			Device:  links[int(int32(nativeEndian.Uint32(msg.Data[4:8])))],
+			State:   []string{},
+		}
+		if lladdr := attrs[unix.NDA_LLADDR]; len(lladdr) > 0 {
+			neighbor.HardwareAddr = net.HardwareAddr(lladdr).String()
+		}
+		for _, s := range neighborStateNames {
+			if state&s.state != 0 {
+				neighbor.State = append(neighbor.State, s.name)
+			}
+		}
+		neighbors = append(neighbors, neighbor)
+	}
+	return neighbors, nil
+}
+
+// readSockets lists the listening TCP sockets and the bound UDP sockets of
+// /proc/net.
+func readSockets() ([]SysSocket, error) {
+	sockets := []SysSocket{}
+	for _, protocol := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		f, err := os.Open(filepath.Join("/proc/net", protocol))
+		if err != nil {
+			if os.IsNotExist(err) {
+				// IPv6 may be disabled.
+				continue
+			}
+			return sockets, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			// 0A is TCP_LISTEN; UDP sockets are listed with 07 (TCP_CLOSE)
+			// unless connected.
+			if (strings.HasPrefix(protocol, "tcp") && fields[3] != "0A") || (strings.HasPrefix(protocol, "udp") && fields[3] != "07") {
+				continue
+			}
+			address, err := parseProcNetAddress(fields[1])
+			if err != nil {
+				continue
+			}
+			uid, _ := strconv.Atoi(fields[7])
+			inode, _ := strconv.ParseUint(fields[9], 10, 64)
+			sockets = append(sockets, SysSocket{Protocol: protocol, LocalAddress: address, UID: uid, Inode: inode})
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return sockets, err
+		}
+	}
+	return sockets, nil
+}
+
+// parseProcNetAddress parses a "0100007F:1F90" address of /proc/net/tcp,
+// whose IP is made of 32 bits words in host byte order.
+func parseProcNetAddress(value string) (string, error) {
+	ipHex, portHex, ok := strings.Cut(value, ":")
+	if !ok {
+		return "", fmt.Errorf("invalid address %q", value)
+	}
+	ip, err := hex.DecodeString(ipHex)
+	if err != nil || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+		return "", fmt.Errorf("invalid address %q", value)
+	}
+	for i := 0; i < len(ip); i += 4 {
+		nativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(ip[i:]))
+	}
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q", value)
+	}
+	return net.JoinHostPort(net.IP(ip).String(), strconv.Itoa(int(port))), nil
+}
+
+func readSysctls() map[string]string {
+	values := map[string]string{}
+	for _, name := range sysctls {
+		data, err := ioutil.ReadFile(filepath.Join("/proc/sys", strings.ReplaceAll(name, ".", "/")))
+		if err != nil {
+			continue
+		}
+		values[name] = strings.Join(strings.Fields(string(data)), " ")
+	}
+	return values
+}
+
+// readResolvConf parses the nameserver, search (or domain) and options lines
+// of a resolv.conf file.
+func readResolvConf(path string) (*ResolvConf, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := &ResolvConf{Nameservers: []string{}, Search: []string{}, Options: []string{}}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			conf.Nameservers = append(conf.Nameservers, fields[1])
+		case "search", "domain":
+			// The last of them wins.
+			conf.Search = append([]string{}, fields[1:]...)
+		case "options":
+			conf.Options = append(conf.Options, fields[1:]...)
+		}
+	}
+	return conf, nil
+}
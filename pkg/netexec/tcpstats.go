@@ -0,0 +1,255 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// kernelTCPInfo is the struct tcp_info of Linux up to tcpi_snd_wnd, of which
+// unix.TCPInfo only has the fields up to tcpi_total_retrans. Older kernels
+// leave the fields they do not know zero.
+type kernelTCPInfo struct {
+	unix.TCPInfo
+	Pacing_rate     uint64
+	Max_pacing_rate uint64
+	Bytes_acked     uint64
+	Bytes_received  uint64
+	Segs_out        uint32
+	Segs_in         uint32
+	Notsent_bytes   uint32
+	Min_rtt         uint32
+	Data_segs_in    uint32
+	Data_segs_out   uint32
+	Delivery_rate   uint64
+	Busy_time       uint64
+	Rwnd_limited    uint64
+	Sndbuf_limited  uint64
+	Delivered       uint32
+	Delivered_ce    uint32
+	Bytes_sent      uint64
+	Bytes_retrans   uint64
+	Dsack_dups      uint32
+	Reord_seen      uint32
+	Rcv_ooopack     uint32
+	Snd_wnd         uint32
+}
+
+// tcpInfo returns the TCP_INFO of the TCP connection underlying conn.
+func tcpInfo(conn net.Conn) (*kernelTCPInfo, bool) {
+	tcpConn, ok := underlyingTCPConn(conn)
+	if !ok {
+		return nil, false
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, false
+	}
+	info := &kernelTCPInfo{}
+	if err := controlSocket(raw, func(fd int) error {
+		// GetsockoptTCPInfo would only read the fields of unix.TCPInfo.
+		size := uint32(unsafe.Sizeof(*info))
+		if _, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.IPPROTO_TCP, unix.TCP_INFO,
+			uintptr(unsafe.Pointer(info)), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+			return errno
+		}
+		return nil
+	}); err != nil {
+		return nil, false
+	}
+	return info, true
+}
+
+// tcpStates are the names of the TCP states of TCP_INFO.
+var tcpStates = []string{"", "ESTABLISHED", "SYN-SENT", "SYN-RECV", "FIN-WAIT-1", "FIN-WAIT-2", "TIME-WAIT",
+	"CLOSE", "CLOSE-WAIT", "LAST-ACK", "LISTEN", "CLOSING"}
+
+// TCPStats are the TCP_INFO statistics of a connection that "ss -ti" shows.
+// Times are in microseconds and rates in bytes per second.
+type TCPStats struct {
+	State string `json:"state"`
+	// RTT is the smoothed round-trip time, and RTTVar its mean deviation.
+	RTT    uint32 `json:"rtt"`
+	RTTVar uint32 `json:"rttVar"`
+	MinRTT uint32 `json:"minRTT"`
+	RTO    uint32 `json:"rto"`
+	SndMSS uint32 `json:"sndMSS"`
+	RcvMSS uint32 `json:"rcvMSS"`
+	PMTU   uint32 `json:"pmtu"`
+	// SndCwnd and SndSsthresh are in segments.
+	SndCwnd     uint32 `json:"sndCwnd"`
+	SndSsthresh uint32 `json:"sndSsthresh"`
+	Unacked     uint32 `json:"unacked"`
+	Lost        uint32 `json:"lost"`
+	// Retransmits are the segments retransmitted over the connection's
+	// lifetime, RetransOut the ones not acknowledged yet.
+	Retransmits   uint32 `json:"retransmits"`
+	RetransOut    uint32 `json:"retransOut"`
+	BytesSent     uint64 `json:"bytesSent"`
+	BytesRetrans  uint64 `json:"bytesRetrans"`
+	BytesAcked    uint64 `json:"bytesAcked"`
+	BytesReceived uint64 `json:"bytesReceived"`
+	SegsOut       uint32 `json:"segsOut"`
+	SegsIn        uint32 `json:"segsIn"`
+	DeliveryRate  uint64 `json:"deliveryRate"`
+	PacingRate    uint64 `json:"pacingRate"`
+}
+
+func newTCPStats(info *kernelTCPInfo) *TCPStats {
+	stats := &TCPStats{
+		RTT:           info.Rtt,
+		RTTVar:        info.Rttvar,
+		MinRTT:        info.Min_rtt,
+		RTO:           info.Rto,
+		SndMSS:        info.Snd_mss,
+		RcvMSS:        info.Rcv_mss,
+		PMTU:          info.Pmtu,
+		SndCwnd:       info.Snd_cwnd,
+		SndSsthresh:   info.Snd_ssthresh,
+		Unacked:       info.Unacked,
+		Lost:          info.Lost,
+		Retransmits:   info.Total_retrans,
+		RetransOut:    info.Retrans,
+		BytesSent:     info.Bytes_sent,
+		BytesRetrans:  info.Bytes_retrans,
+		BytesAcked:    info.Bytes_acked,
+		BytesReceived: info.Bytes_received,
+		SegsOut:       info.Segs_out,
+		SegsIn:        info.Segs_in,
+		DeliveryRate:  info.Delivery_rate,
+		PacingRate:    info.Pacing_rate,
+	}
+	if int(info.State) < len(tcpStates) {
+		stats.State = tcpStates[info.State]
+	}
+	return stats
+}
+
+// connTCPStats returns the TCP_INFO statistics of the TCP connection
+// underlying conn, or nil.
+func connTCPStats(conn net.Conn) *TCPStats {
+	if info, ok := tcpInfo(conn); ok {
+		return newTCPStats(info)
+	}
+	return nil
+}
+
+// String formats the statistics the way "ss -ti" does, times in
+// milliseconds and rates in bits per second.
+func (t *TCPStats) String() string {
+	ms := func(us uint32) string { return strconv.FormatFloat(float64(us)/1000, 'f', -1, 64) }
+	return fmt.Sprintf("%s rtt:%s/%s minrtt:%s rto:%s mss:%d rcvmss:%d pmtu:%d cwnd:%d ssthresh:%d "+
+		"bytes_sent:%d bytes_retrans:%d bytes_acked:%d bytes_received:%d segs_out:%d segs_in:%d "+
+		"unacked:%d lost:%d retrans:%d/%d delivery_rate:%dbps pacing_rate:%dbps",
+		t.State, ms(t.RTT), ms(t.RTTVar), ms(t.MinRTT), ms(t.RTO), t.SndMSS, t.RcvMSS, t.PMTU, t.SndCwnd, t.SndSsthresh,
+		t.BytesSent, t.BytesRetrans, t.BytesAcked, t.BytesReceived, t.SegsOut, t.SegsIn,
+		t.Unacked, t.Lost, t.RetransOut, t.Retransmits, 8*t.DeliveryRate, 8*t.PacingRate)
+}
+
+// dialTCPStats collects the TCP_INFO statistics of the connections of a
+// /dial, one per try that got a response.
+type dialTCPStats struct {
+	mu    sync.Mutex
+	stats []*TCPStats
+}
+
+type dialTCPStatsKey struct{}
+
+func withTCPStats(ctx context.Context) (context.Context, *dialTCPStats) {
+	d := &dialTCPStats{}
+	return context.WithValue(ctx, dialTCPStatsKey{}, d), d
+}
+
+// recordTCPStats records the TCP_INFO statistics of conn in the
+// dialTCPStats of ctx, if any, and logs them.
+func recordTCPStats(ctx context.Context, conn net.Conn) {
+	d, ok := ctx.Value(dialTCPStatsKey{}).(*dialTCPStats)
+	if !ok {
+		return
+	}
+	stats := connTCPStats(conn)
+	if stats == nil {
+		return
+	}
+	log.Printf("TCP_INFO of the connection to %s: %s", conn.RemoteAddr(), stats)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stats = append(d.stats, stats)
+}
+
+func (d *dialTCPStats) all() []*TCPStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.stats
+}
+
+// tcpStatsLogger logs the TCP_INFO statistics of the connection of every
+// HTTP request once its response is sent, when the connection turns idle.
+// Forcing the response out from the handler instead would drop its
+// Content-Length.
+type tcpStatsLogger struct {
+	mu sync.Mutex
+	// requests are the last requests answered on each connection, not
+	// logged yet.
+	requests map[*net.TCPConn]string
+}
+
+func newTCPStatsLogger() *tcpStatsLogger {
+	return &tcpStatsLogger{requests: map[*net.TCPConn]string{}}
+}
+
+func (l *tcpStatsLogger) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hijacked := false
+		next.ServeHTTP(&responseWriter{ResponseWriter: w, onHijack: func() { hijacked = true }}, r)
+		tcpConn, ok := underlyingTCPConn(requestConn(r))
+		if hijacked || !ok {
+			return
+		}
+		request := fmt.Sprintf("%s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		if r.Close || w.Header().Get("Connection") == "close" {
+			// The connection is closed without turning idle, so log now,
+			// before the end of the response is sent.
+			logTCPStats(request, tcpConn)
+			return
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.requests[tcpConn] = request
+	})
+}
+
+// connState is the http.Server ConnState hook logging the statistics of the
+// connections that turned idle.
+func (l *tcpStatsLogger) connState(conn net.Conn, state http.ConnState) {
+	if state != http.StateIdle && state != http.StateClosed && state != http.StateHijacked {
+		return
+	}
+	tcpConn, ok := underlyingTCPConn(conn)
+	if !ok {
+		return
+	}
+	l.mu.Lock()
+	request, ok := l.requests[tcpConn]
+	delete(l.requests, tcpConn)
+	l.mu.Unlock()
+	if ok && state == http.StateIdle {
+		logTCPStats(request, tcpConn)
+	}
+}
+
+func logTCPStats(request string, conn net.Conn) {
+	if stats := connTCPStats(conn); stats != nil {
+		log.Printf("TCP_INFO of %s: %s", request, stats)
+	}
+}
@@ -0,0 +1,280 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxThroughputDuration and maxThroughputStreams bound the tests that
+	// /dial?mode=throughput, /sink and /source run.
+	maxThroughputDuration = 5 * time.Minute
+	maxThroughputStreams  = 128
+	throughputBufferSize  = 128 * 1024
+	retransmitsTrailer    = "X-Netexec-Retransmits"
+)
+
+// ThroughputResult is the JSON answer of /dial?mode=throughput.
+type ThroughputResult struct {
+	Address   string `json:"address"`
+	Direction string `json:"direction"`
+	Duration  string `json:"duration"`
+	// Streams are measured each on their own connection.
+	Streams    []ThroughputStream `json:"streams"`
+	TotalBytes int64              `json:"totalBytes"`
+	TotalGbps  float64            `json:"totalGbps"`
+	// Retransmits is the sum of the streams' retransmits, if the sender of
+	// every stream could read them from TCP_INFO.
+	Retransmits *uint32 `json:"retransmits,omitempty"`
+}
+
+// ThroughputStream is the outcome of one stream of a throughput test.
+// Retransmits are counted by the sending side: netexec itself for uploads,
+// the remote /source for downloads.
+type ThroughputStream struct {
+	Stream      int     `json:"stream"`
+	Bytes       int64   `json:"bytes"`
+	Seconds     float64 `json:"seconds"`
+	Gbps        float64 `json:"gbps"`
+	Retransmits *uint32 `json:"retransmits,omitempty"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// SinkResult is the JSON answer of /sink.
+type SinkResult struct {
+	Bytes   int64   `json:"bytes"`
+	Seconds float64 `json:"seconds"`
+	Gbps    float64 `json:"gbps"`
+}
+
+func gbps(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / elapsed.Seconds() / 1e9
+}
+
+// parseThroughputDuration parses the duration of a throughput test.
+func parseThroughputDuration(value string, defaultDuration time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultDuration, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 || d > maxThroughputDuration {
+		return 0, fmt.Errorf("duration parameter must be a positive golang duration up to %v, got %q", maxThroughputDuration, value)
+	}
+	return d, nil
+}
+
+// zeroReader yields zeros until its deadline, counting them.
+type zeroReader struct {
+	deadline time.Time
+	n        int64
+}
+
+func (z *zeroReader) Read(p []byte) (int, error) {
+	if !time.Now().Before(z.deadline) {
+		return 0, io.EOF
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	z.n += int64(len(p))
+	return len(p), nil
+}
+
+// sinkHandler discards the request body and reports how fast it arrived.
+func sinkHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("%s /sink", r.Method)
+	start := time.Now()
+	n, err := io.CopyBuffer(io.Discard, r.Body, make([]byte, throughputBufferSize))
+	elapsed := time.Since(start)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read the request body after %d bytes. %v", n, err), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Received %d bytes from %s in %v", n, r.RemoteAddr, elapsed)
+	writeJSON(w, http.StatusOK, SinkResult{Bytes: n, Seconds: elapsed.Seconds(), Gbps: gbps(n, elapsed)})
+}
+
+// sourceHandler streams zeros for "duration" (10s by default) or up to
+// "bytes", whichever comes first. The retransmits of the connection are sent
+// in the X-Netexec-Retransmits trailer.
+func sourceHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET /source?duration=%s&bytes=%s", r.FormValue("duration"), r.FormValue("bytes"))
+	duration, err := parseThroughputDuration(r.FormValue("duration"), 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := int64(-1)
+	if bytesString := r.FormValue("bytes"); bytesString != "" {
+		if limit, err = strconv.ParseInt(bytesString, 10, 64); err != nil || limit < 0 {
+			http.Error(w, fmt.Sprintf("argument 'bytes' must be a non-negative integer or empty, got %q", bytesString), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Trailer", retransmitsTrailer)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	src := &zeroReader{deadline: time.Now().Add(duration)}
+	var body io.Reader = src
+	if limit >= 0 {
+		body = io.LimitReader(src, limit)
+	}
+	if _, err := io.CopyBuffer(w, body, make([]byte, throughputBufferSize)); err != nil {
+		log.Printf("Failed to stream to %s after %d bytes: %v", r.RemoteAddr, src.n, err)
+		return
+	}
+	if info, ok := tcpInfo(requestConn(r)); ok {
+		w.Header().Set(retransmitsTrailer, strconv.FormatUint(uint64(info.Total_retrans), 10))
+	}
+	log.Printf("Sent %d bytes to %s", src.n, r.RemoteAddr)
+}
+
+// throughputDialHandler serves /dial?mode=throughput: it runs "streams"
+// parallel uploads to the /sink, or downloads from the /source, of the
+// netexec HTTP server at host and port for "duration".
+func throughputDialHandler(w http.ResponseWriter, r *http.Request, host, port string) {
+	query := r.URL.Query()
+	duration, err := parseThroughputDuration(query.Get("duration"), 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	streams := 1
+	if streamsParam := query.Get("streams"); streamsParam != "" {
+		if streams, err = strconv.Atoi(streamsParam); err != nil || streams < 1 || streams > maxThroughputStreams {
+			http.Error(w, fmt.Sprintf("streams parameter must be an integer between 1 and %d, got %q", maxThroughputStreams, streamsParam), http.StatusBadRequest)
+			return
+		}
+	}
+	direction := strings.ToLower(query.Get("direction"))
+	switch direction {
+	case "":
+		direction = "upload"
+	case "upload", "download":
+	default:
+		http.Error(w, fmt.Sprintf("unsupported direction. %s, acceptable values: upload, download", direction), http.StatusBadRequest)
+		return
+	}
+	if protocol := strings.ToLower(query.Get("protocol")); protocol != "" && protocol != "http" {
+		http.Error(w, fmt.Sprintf("unsupported protocol for mode throughput. %s", protocol), http.StatusBadRequest)
+		return
+	}
+	address := net.JoinHostPort(host, port)
+	log.Printf("Measuring %s throughput with %s over %d streams for %v", direction, address, streams, duration)
+
+	result := ThroughputResult{
+		Address:   address,
+		Direction: direction,
+		Duration:  duration.String(),
+		Streams:   make([]ThroughputStream, streams),
+	}
+	var wg sync.WaitGroup
+	for i := range result.Streams {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result.Streams[i] = runThroughputStream(r.Context(), address, direction, duration)
+			result.Streams[i].Stream = i + 1
+		}(i)
+	}
+	wg.Wait()
+
+	var longest time.Duration
+	var retransmits uint32
+	allRetransmits := true
+	for _, stream := range result.Streams {
+		result.TotalBytes += stream.Bytes
+		if elapsed := time.Duration(stream.Seconds * float64(time.Second)); elapsed > longest {
+			longest = elapsed
+		}
+		if stream.Retransmits != nil {
+			retransmits += *stream.Retransmits
+		} else {
+			allRetransmits = false
+		}
+	}
+	result.TotalGbps = gbps(result.TotalBytes, longest)
+	if allRetransmits {
+		result.Retransmits = &retransmits
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// runThroughputStream uploads to or downloads from address over a new
+// connection for duration.
+func runThroughputStream(ctx context.Context, address, direction string, duration time.Duration) ThroughputStream {
+	var stream ThroughputStream
+	var conn net.Conn
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+		DialContext:       (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+	}
+	defer transport.CloseIdleConnections()
+	// Allow the peer to drain its buffers past the test duration.
+	ctx, cancel := context.WithTimeout(ctx, duration+30*time.Second)
+	defer cancel()
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { conn = info.Conn },
+	})
+
+	start := time.Now()
+	var req *http.Request
+	var err error
+	src := &zeroReader{deadline: start.Add(duration)}
+	if direction == "upload" {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, "http://"+address+"/sink", io.NopCloser(src))
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s/source?duration=%s", address, duration), nil)
+	}
+	if err != nil {
+		stream.Error = err.Error()
+		return stream
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		stream.Error = fmt.Sprintf("request failed. err:%v", err)
+		stream.Bytes = src.n
+		return stream
+	}
+	defer resp.Body.Close()
+	if direction == "upload" && conn != nil {
+		// The upload is over once the sink answers. Read TCP_INFO before
+		// the connection is closed along with the response body.
+		if info, ok := tcpInfo(conn); ok {
+			stream.Retransmits = &info.Total_retrans
+		}
+	}
+	n, err := io.CopyBuffer(io.Discard, resp.Body, make([]byte, throughputBufferSize))
+	elapsed := time.Since(start)
+	if direction == "upload" {
+		n = src.n
+	} else if value := resp.Trailer.Get(retransmitsTrailer); value != "" {
+		if retransmits, err := strconv.ParseUint(value, 10, 32); err == nil {
+			r := uint32(retransmits)
+			stream.Retransmits = &r
+		}
+	}
+	stream.Bytes = n
+	stream.Seconds = elapsed.Seconds()
+	stream.Gbps = gbps(n, elapsed)
+	if err != nil {
+		stream.Error = fmt.Sprintf("failed to read the response. err:%v", err)
+	} else if resp.StatusCode != http.StatusOK {
+		stream.Error = fmt.Sprintf("unexpected status %s", resp.Status)
+	}
+	return stream
+}
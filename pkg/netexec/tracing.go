@@ -0,0 +1,472 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	traceparentHeader = "traceparent"
+	baggageHeader     = "baggage"
+
+	// OTLP span kinds and status codes.
+	spanKindServer  = 2
+	spanKindClient  = 3
+	statusCodeError = 2
+
+	maxQueuedSpans    = 2048
+	maxSpansPerExport = 512
+	exportInterval    = time.Second
+)
+
+// TracingConfig configures the export of spans over OTLP/HTTP. The W3C
+// trace context is propagated even if Endpoint is empty.
+type TracingConfig struct {
+	// Endpoint is the URL of the OTLP/HTTP collector, e.g.
+	// "http://otel-collector:4318"; "/v1/traces" is added if it has no
+	// path.
+	Endpoint    string `json:"endpoint" yaml:"endpoint"`
+	ServiceName string `json:"serviceName" yaml:"serviceName"`
+}
+
+// tracesURL returns the URL the spans are posted to.
+func (c *TracingConfig) tracesURL() (string, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("scheme must be http or https, got %q", u.Scheme)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return u.String(), nil
+}
+
+// span is an operation of a trace. Spans received from a remote parent are
+// only used to start their children, and never recorded.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	baggage  string
+	remote   bool
+
+	name       string
+	kind       int
+	start      time.Time
+	attributes []otlpKeyValue
+	errMessage string
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the current span of ctx, or nil.
+func spanFromContext(ctx context.Context) *span {
+	sp, _ := ctx.Value(spanContextKey{}).(*span)
+	return sp
+}
+
+// withRemoteParent returns ctx with the parent span of the traceparent and
+// baggage values, if traceparent is valid, and the tracer recording its
+// children.
+func withRemoteParent(ctx context.Context, t *tracer, traceparent, baggage string) context.Context {
+	parent := &span{tracer: t, remote: true, sampled: true, baggage: baggage}
+	// Without a valid traceparent, the children start a new trace.
+	parseTraceparent(traceparent, parent)
+	return context.WithValue(ctx, spanContextKey{}, parent)
+}
+
+// parseTraceparent reads a "00-<trace-id>-<parent-id>-<flags>" value into sp.
+func parseTraceparent(value string, sp *span) bool {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return false
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != 16 || bytes.Equal(traceID, make([]byte, 16)) {
+		return false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != 8 || bytes.Equal(spanID, make([]byte, 8)) {
+		return false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return false
+	}
+	copy(sp.traceID[:], traceID)
+	copy(sp.spanID[:], spanID)
+	sp.sampled = flags[0]&1 == 1
+	return true
+}
+
+// traceparent formats the W3C trace context of sp.
+func (sp *span) traceparent() string {
+	flags := 0
+	if sp.sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%x-%x-%02x", sp.traceID, sp.spanID, flags)
+}
+
+// startSpan starts a span, child of the current span of ctx if any, and
+// returns it along with ctx carrying it.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	sp := &span{name: name, kind: kind, start: time.Now(), sampled: true}
+	_, _ = rand.Read(sp.spanID[:])
+	if parent := spanFromContext(ctx); parent != nil {
+		sp.tracer = parent.tracer
+		sp.sampled = parent.sampled
+		sp.baggage = parent.baggage
+		sp.traceID = parent.traceID
+		sp.parentID = parent.spanID
+	}
+	if sp.traceID == [16]byte{} {
+		_, _ = rand.Read(sp.traceID[:])
+		sp.parentID = [8]byte{}
+	}
+	return context.WithValue(ctx, spanContextKey{}, sp), sp
+}
+
+func (sp *span) setAttribute(key string, value interface{}) {
+	var v otlpAnyValue
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case int:
+		s := strconv.Itoa(value)
+		v.IntValue = &s
+	case bool:
+		v.BoolValue = &value
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+	sp.attributes = append(sp.attributes, otlpKeyValue{Key: key, Value: v})
+}
+
+func (sp *span) setError(message string) {
+	sp.errMessage = message
+}
+
+// end records the span, if it is sampled and spans are exported.
+func (sp *span) end() {
+	if sp.remote || !sp.sampled || sp.tracer == nil {
+		return
+	}
+	sp.tracer.record(sp.otlp(time.Now()))
+}
+
+// injectHeaders sets the trace context of the current span of ctx on header.
+func injectHeaders(ctx context.Context, header http.Header) {
+	if sp := spanFromContext(ctx); sp != nil {
+		header.Set(traceparentHeader, sp.traceparent())
+		if sp.baggage != "" {
+			header.Set(baggageHeader, sp.baggage)
+		}
+	}
+}
+
+// injectGRPCMetadata adds the trace context of the current span of ctx to the
+// outgoing gRPC metadata.
+func injectGRPCMetadata(ctx context.Context) context.Context {
+	sp := spanFromContext(ctx)
+	if sp == nil {
+		return ctx
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, traceparentHeader, sp.traceparent())
+	if sp.baggage != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, baggageHeader, sp.baggage)
+	}
+	return ctx
+}
+
+// tracer exports the spans of a Server in batches.
+type tracer struct {
+	url      string
+	resource otlpResource
+	client   *http.Client
+
+	spans    chan otlpSpan
+	done     chan struct{}
+	exited   chan struct{}
+	dropOnce sync.Once
+}
+
+// newTracer returns the tracer of cfg, or nil if spans are not exported.
+func newTracer(cfg TracingConfig, hostname string) (*tracer, error) {
+	if cfg.Endpoint == "" {
+		return nil, nil
+	}
+	u, err := cfg.tracesURL()
+	if err != nil {
+		return nil, err
+	}
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "netexec"
+	}
+	resource := otlpResource{Attributes: []otlpKeyValue{
+		{Key: "service.name", Value: otlpAnyValue{StringValue: &serviceName}},
+		{Key: "host.name", Value: otlpAnyValue{StringValue: &hostname}},
+	}}
+	t := &tracer{
+		url:      u,
+		resource: resource,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan otlpSpan, maxQueuedSpans),
+		done:     make(chan struct{}),
+		exited:   make(chan struct{}),
+	}
+	go t.run()
+	return t, nil
+}
+
+func (t *tracer) record(s otlpSpan) {
+	select {
+	case t.spans <- s:
+	default:
+		t.dropOnce.Do(func() { log.Printf("Dropping spans: the OTLP export to %s cannot keep up", t.url) })
+	}
+}
+
+// run exports the queued spans every exportInterval, and once more when the
+// tracer is closed.
+func (t *tracer) run() {
+	defer close(t.exited)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+	var batch []otlpSpan
+	for {
+		select {
+		case s := <-t.spans:
+			if batch = append(batch, s); len(batch) >= maxSpansPerExport {
+				t.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(batch)
+			batch = nil
+		case <-t.done:
+			for {
+				select {
+				case s := <-t.spans:
+					batch = append(batch, s)
+				default:
+					t.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// close exports the remaining spans, waiting until ctx expires at most.
+func (t *tracer) close(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	close(t.done)
+	select {
+	case <-t.exited:
+	case <-ctx.Done():
+	}
+}
+
+func (t *tracer) export(spans []otlpSpan) {
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   t.resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "netexec"}, Spans: spans}},
+	}}})
+	if err != nil {
+		log.Printf("Failed to encode %d spans: %v", len(spans), err)
+		return
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to export %d spans to %s: %v", len(spans), t.url, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("Failed to export %d spans to %s: %s", len(spans), t.url, resp.Status)
+	}
+}
+
+// The OTLP/JSON encoding of spans, with hexadecimal IDs and 64-bit integers
+// as strings.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func (sp *span) otlp(end time.Time) otlpSpan {
+	s := otlpSpan{
+		TraceID:           hex.EncodeToString(sp.traceID[:]),
+		SpanID:            hex.EncodeToString(sp.spanID[:]),
+		Name:              sp.name,
+		Kind:              sp.kind,
+		StartTimeUnixNano: strconv.FormatInt(sp.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        sp.attributes,
+	}
+	if sp.parentID != [8]byte{} {
+		s.ParentSpanID = hex.EncodeToString(sp.parentID[:])
+	}
+	if sp.errMessage != "" {
+		s.Status = otlpStatus{Code: statusCodeError, Message: sp.errMessage}
+	}
+	return s
+}
+
+// traceMiddleware continues the trace of every HTTP request but the probes
+// and metrics scrapes, with a server span.
+func (s *Server) traceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := withRemoteParent(r.Context(), s.tracer, r.Header.Get(traceparentHeader), r.Header.Get(baggageHeader))
+		ctx, sp := startSpan(ctx, r.Method+" "+r.URL.Path, spanKindServer)
+		sp.setAttribute("http.method", r.Method)
+		sp.setAttribute("http.target", r.URL.RequestURI())
+		sp.setAttribute("net.peer.ip", remoteIP(r.RemoteAddr).String())
+		defer sp.end()
+		defer func() {
+			// An aborted handler, e.g. by a fault closing the connection,
+			// sends no response.
+			if v := recover(); v != nil {
+				sp.setError(fmt.Sprintf("handler aborted: %v", v))
+				panic(v)
+			}
+		}()
+		var status int
+		next.ServeHTTP(&responseWriter{ResponseWriter: w, onWriteHeader: func(code int) int {
+			status = code
+			return code
+		}}, r.WithContext(ctx))
+		if status != 0 {
+			sp.setAttribute("http.status_code", status)
+		}
+		if status >= 500 {
+			sp.setError(http.StatusText(status))
+		}
+	})
+}
+
+// startGRPCSpan continues the trace of a gRPC call with a server span.
+func (s *Server) startGRPCSpan(ctx context.Context, method string) (context.Context, *span) {
+	var traceparent, baggage string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(traceparentHeader); len(values) > 0 {
+			traceparent = values[0]
+		}
+		if values := md.Get(baggageHeader); len(values) > 0 {
+			baggage = values[0]
+		}
+	}
+	ctx, sp := startSpan(withRemoteParent(ctx, s.tracer, traceparent, baggage), strings.TrimPrefix(method, "/"), spanKindServer)
+	sp.setAttribute("rpc.system", "grpc")
+	sp.setAttribute("rpc.method", method)
+	return ctx, sp
+}
+
+func (s *Server) traceUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, sp := s.startGRPCSpan(ctx, info.FullMethod)
+	defer sp.end()
+	resp, err := handler(ctx, req)
+	if err != nil {
+		sp.setError(err.Error())
+	}
+	return resp, err
+}
+
+func (s *Server) traceStreamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, sp := s.startGRPCSpan(stream.Context(), info.FullMethod)
+	defer sp.end()
+	err := handler(srv, &tracedServerStream{ServerStream: stream, ctx: ctx})
+	if err != nil {
+		sp.setError(err.Error())
+	}
+	return err
+}
+
+// tracedServerStream carries the span of a streaming call in its context.
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tracedServerStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,168 @@
+// Copyright 2022 Authors of spidernet-io
+// SPDX-License-Identifier: Apache-2.0
+
+package netexec
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Headers of the responses when virtual hosts are configured.
+const (
+	virtualHostHeader = "X-Netexec-Virtual-Host"
+	identityHeader    = "X-Netexec-Identity"
+	sniHeader         = "X-Netexec-SNI"
+)
+
+// VirtualHostConfig makes the HTTP server answer the requests to Hostname as
+// a distinct application.
+type VirtualHostConfig struct {
+	// Hostname is matched against the Host header of the requests, and the
+	// SNI of the TLS connections, ignoring case. A "*." prefix matches any
+	// single label, exact hostnames taking precedence.
+	Hostname string `json:"hostname" yaml:"hostname"`
+	// Identity replaces the server's hostname in /hostname. It defaults to
+	// Hostname.
+	Identity string `json:"identity" yaml:"identity"`
+	// Status replaces the 200 OK of the responses, if set.
+	Status int `json:"status" yaml:"status"`
+	// TLSCertFile and TLSPrivateKeyFile are the certificate served to the
+	// TLS connections for Hostname, instead of http.tlsCertFile.
+	TLSCertFile       string `json:"tlsCertFile" yaml:"tlsCertFile"`
+	TLSPrivateKeyFile string `json:"tlsPrivateKeyFile" yaml:"tlsPrivateKeyFile" redact:"true"`
+}
+
+func (v *VirtualHostConfig) validate() error {
+	name := strings.TrimPrefix(v.Hostname, "*.")
+	if name == "" || strings.ContainsAny(name, "*:/ ") {
+		return fmt.Errorf("hostname must be a hostname, optionally prefixed by \"*.\", got %q", v.Hostname)
+	}
+	if v.Status != 0 && (v.Status < 100 || v.Status > 999) {
+		return fmt.Errorf("status must be an HTTP status code, got %d", v.Status)
+	}
+	if v.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(v.TLSCertFile, v.TLSPrivateKeyFile); err != nil {
+			return fmt.Errorf("tlsCertFile and tlsPrivateKeyFile are invalid: %v", err)
+		}
+	} else if v.TLSPrivateKeyFile != "" {
+		return fmt.Errorf("tlsPrivateKeyFile requires tlsCertFile")
+	}
+	return nil
+}
+
+// virtualHost is a configured virtual host and its certificate, if any.
+type virtualHost struct {
+	config VirtualHostConfig
+	cert   *tls.Certificate
+}
+
+// virtualHosts are the virtual hosts of a Server, in the configured order.
+type virtualHosts []*virtualHost
+
+// newVirtualHosts loads the certificates of valid virtual hosts.
+func newVirtualHosts(configs []VirtualHostConfig) (virtualHosts, error) {
+	var res virtualHosts
+	for _, cfg := range configs {
+		if cfg.Identity == "" {
+			cfg.Identity = cfg.Hostname
+		}
+		v := &virtualHost{config: cfg}
+		if cfg.TLSCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSPrivateKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("virtual host %q: %v", cfg.Hostname, err)
+			}
+			v.cert = &cert
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+// match returns the virtual host of host, a Host header or SNI, or nil.
+func (vs virtualHosts) match(host string) *virtualHost {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	for _, v := range vs {
+		if strings.EqualFold(v.config.Hostname, host) {
+			return v
+		}
+	}
+	if i := strings.IndexByte(host, '.'); i > 0 {
+		for _, v := range vs {
+			if strings.HasPrefix(v.config.Hostname, "*.") && strings.EqualFold(v.config.Hostname[1:], host[i:]) {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// hasCertificates tells whether a virtual host has its own certificate.
+func (vs virtualHosts) hasCertificates() bool {
+	for _, v := range vs {
+		if v.cert != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// getCertificate returns the certificate of the virtual host of the SNI, or
+// nil for the default certificate.
+func (vs virtualHosts) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if v := vs.match(hello.ServerName); v != nil && v.cert != nil {
+		return v.cert, nil
+	}
+	return nil, nil
+}
+
+type virtualHostKey struct{}
+
+// identity returns the identity of the virtual host of r, or the server's
+// hostname.
+func (s *Server) identity(r *http.Request) string {
+	if v, ok := r.Context().Value(virtualHostKey{}).(*virtualHost); ok {
+		return v.config.Identity
+	}
+	return s.hostname
+}
+
+// virtualHostMiddleware tells which virtual host, if any, every request
+// matched, and applies its status.
+func (s *Server) virtualHostMiddleware(next http.Handler) http.Handler {
+	if len(s.vhosts) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && r.TLS.ServerName != "" {
+			w.Header().Set(sniHeader, r.TLS.ServerName)
+		}
+		v := s.vhosts.match(r.Host)
+		if v == nil {
+			w.Header().Set(identityHeader, s.hostname)
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set(virtualHostHeader, v.config.Hostname)
+		w.Header().Set(identityHeader, v.config.Identity)
+		r = r.WithContext(context.WithValue(r.Context(), virtualHostKey{}, v))
+		if v.config.Status != 0 {
+			// Only the 200 OK of the responses is replaced.
+			w = &responseWriter{ResponseWriter: w, onWriteHeader: func(code int) int {
+				if code == http.StatusOK {
+					return v.config.Status
+				}
+				return code
+			}}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
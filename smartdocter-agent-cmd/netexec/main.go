@@ -21,46 +21,22 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"net"
-	"net/http"
-	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
-	"strconv"
-	"strings"
-	"sync/atomic"
 	"syscall"
-	"time"
 
-	"github.com/ishidawataru/sctp"
 	"github.com/spf13/cobra"
 
-	utilnet "k8s.io/apimachinery/pkg/util/net"
-	"k8s.io/apimachinery/pkg/util/sets"
-	netutils "k8s.io/utils/net"
+	"smartdocter/pkg/netexec"
 )
 
 var (
-	httpPort           = 8080
-	udpPort            = 8081
-	sctpPort           = -1
-	shellPath          = "/bin/sh"
-	serverReady        = &atomicBool{0}
-	certFile           = ""
-	privKeyFile        = ""
-	httpOverride       = ""
-	udpListenAddresses = ""
-	delayShutdown      = 0
+	config     = netexec.DefaultConfig()
+	configFile = ""
 )
 
-const bindToAny = ""
-
 // CmdNetexec is used by agnhost Cobra.
 var CmdNetexec = &cobra.Command{
 	Use:   "netexec",
@@ -68,13 +44,34 @@ var CmdNetexec = &cobra.Command{
 	Long: `Starts a HTTP(S) server on given port with the following endpoints:
 
 - /: Returns the request's timestamp.
-- /clientip: Returns the request's IP address.
+- /clientinfo: Returns a JSON with the request's address and the TTL (or IPv6 hop limit) and
+  TOS (or IPv6 traffic class) of its packets as they arrived, with the number of "hops" inferred
+  from the next initial TTL of "64", "128" or "255", and the "dscp" and "ecn" bits of the TOS. For
+  TCP, the TTL is the one of the last in-order segment over IPv6, and unknown over IPv4, Linux only
+  keeping the TOS of the SYN. Over TCP, "tcpInfo" holds the server's TCP_INFO statistics of the
+  connection, as in "/dial". The HTTP and TCP servers also log these statistics, the way "ss -ti"
+  shows them, after answering every request or command.
+- /clientip: Returns the request's IP address. If the connection carried a PROXY protocol
+  header (see "--proxy-protocol"), this is the proxied client's address, followed by the immediate
+  peer's address, the header itself and any TLVs it contains, one per line.
+  With "format=json", returns a JSON describing the forwarding chain instead: the socket
+  "peer", the "localAddr" the request arrived on, the PROXY protocol header, the parsed
+  "X-Forwarded-For", "Forwarded" and "X-Real-IP" headers, the resulting "chain" of client
+  addresses and the "originalClient" heading it. If the "expected" client IP is given, the
+  "verdict" tells whether it was "preserved" as the socket peer, is only carried by the
+  "proxy-protocol" header or the forwarding "headers", or was "lost".
+- "/config": Returns the effective configuration as JSON, secrets redacted.
 - /header: Returns the request's header value corresponding to the key provided or the entire 
   header marshalled as json, if no form value (key) is provided.
   ("/header?key=X-Forwarded-For" or /header)
 - /dial: Creates a given number of requests to the given host and port using the given protocol,
   and returns a JSON with the fields "responses" (successful request responses) and "errors" (
-  failed request responses). Returns "200 OK" status code if the last request succeeded,
+  failed request responses, each prefixed by its class: "dns", "refused", "timeout", "reset"
+  or "other"), and for "http" and "tcp" "tcpInfo", the TCP_INFO statistics of the
+  connection of every try that got a response: "state", "rtt", "rttVar" and "minRTT", "rto"
+  (microseconds), "sndMSS", "rcvMSS", "pmtu", "sndCwnd", "sndSsthresh", "unacked", "lost",
+  "retransmits" and "retransOut", the "bytes" and "segs" counters and the "deliveryRate" and
+  "pacingRate" (bytes per second). Returns "200 OK" status code if the last request succeeded,
   "417 Expectation Failed" if it did not, or "400 Bad Request" if any of the endpoint's parameters
   is invalid. The endpoint's parameters are:
   - "host": The host that will be dialed.
@@ -82,8 +79,76 @@ var CmdNetexec = &cobra.Command{
   - "request": The HTTP endpoint or data to be sent through UDP. If not specified, it will result
     in a "400 Bad Request" status code being returned.
   - "protocol": The protocol which will be used when making the request. Default value: "http".
-    Acceptable values: "http", "udp", "sctp".
+    Acceptable values: "http", "tcp", "udp", "sctp", "grpc".
   - "tries": The number of times the request will be performed. Default value: "1".
+  - "groupBy": Aggregates the responses of the tries by backend, identified by the whole
+      response ("response", e.g. for "hostname") or by a dotted JSON field (e.g. "hostname" or
+      "metadata.name"), and returns in "distribution" the count and share of each backend, the
+      chi-square deviation from a uniform distribution with its "pValue", and the
+      "longestRun" of the same backend. Enabled by any of the "expect" parameters too:
+  - "expectBackends": The number of distinct backends that must answer, also the number the
+      uniform distribution is computed over.
+  - "expectAffinity": If "true", every try must be answered by the same backend, as with
+      "ClientIP" session affinity.
+  - "expectUniform": If "true", the "pValue" of the distribution must not be below "alpha".
+      Default value of "alpha": "0.01".
+      The "distribution" lists the outcome of each expectation in "checks", and "pass" is only
+      "true" if they all passed.
+  - "tos" or "dscp", "ttl", "sndbuf", "rcvbuf": The IPv4 TOS or IPv6 traffic class (or its
+      DSCP, the upper 6 bits), the TTL or hop limit and the socket buffer sizes of the "http",
+      "tcp", "udp" and "sctp" sockets. The streams also accept "linger" (seconds, "-1" to
+      disable it) and "nodelay", and TCP "keepalive", "keepaliveIdle", "keepaliveInterval",
+      "keepaliveCount" (seconds and count, enabling "keepalive") and "mss". If any is set, the
+      options in effect on the socket of the last try are read back in "socketOptions"; SCTP
+      ones before connecting.
+  - "connectTimeout", "readTimeout": Golang durations bounding the connection of every try and
+      the wait for its response once the request is sent. Default value: "5s".
+  - "timeout": A golang duration bounding the whole dial, retries included.
+  - "retries": The number of times a failed try is retried, counted in the result's "retries".
+      Default value: "0". Unresolvable hosts fail tries too, and are resolved again by the next.
+  - "backoff", "jitter": The delay before the first retry, doubled at every retry up to "10s"
+      (default "100ms"), and the fraction of it by which it is randomized (default "0").
+  - "retryOn": The comma separated classes of the errors to retry. Default: all of them.
+  - "mode": If "mtu", probes the path MTU towards the first IPv4 and IPv6 address of the
+    host instead, binary-searching the largest packet that makes a round trip, and returns a JSON
+    with one entry per address family in "results". Over "udp", "echo" commands are sent
+    with the DF bit set; over "http" (default) and "tcp", the MSS is clamped and several full
+    segments are echoed. "request" is not needed in this mode, "maxMTU" sets the upper
+    bound of the search. Default value: "9000".
+    If "clock", estimates the offset of the clock of the netexec "udp" (default), "tcp" or
+    "http" server at host and port, exchanging timestamps with its "timestamp" command or
+    "/timestamp" endpoint over "rounds" rounds (default "8") spaced by "interval" (default
+    "100ms"). Returns a JSON with the offset and delay of each round, and the "offset" (how far
+    the peer's clock is ahead) and "delay" of the round with the lowest delay, whose offset is
+    accurate to half of its delay.
+    If "idle", detects after which idle duration sessions to the netexec "tcp" (default) or
+    "udp" server at host and port stop working, e.g. because of conntrack or NAT timeouts. One
+    session is opened per duration of "intervals" (default "30s,1m,2m,3m,4m,6m"), all at once;
+    each exchanges a heartbeat, stays idle for its duration, then exchanges another heartbeat,
+    which must be answered within "timeout" (default "5s"). Returns, once the longest duration
+    is over, a JSON with the outcome of each session, the "maxWorkingIdle" and the
+    "minFailingIdle". Failed sessions have a "failure": "rst" if the connection was reset,
+    "drop" if the heartbeat was silently dropped, "timeout" if it was acknowledged but never
+    answered, "eof" if the peer closed the connection, or "refused" if an ICMP error rejected it.
+    If "multicast", sends the "request" "tries" times to the multicast group "host" and "port",
+    out of the given "interface" with the given "ttl" (default "1"), and returns a JSON with
+    the address, reply and number of replies of every group member that answered within
+    "window" (default "2s").
+    If "throughput", measures the throughput towards the netexec HTTP server at host and port
+    instead, uploading to its "/sink" ("direction=upload", default) or downloading from its
+    "/source" ("direction=download") over "streams" parallel connections (default "1") for
+    "duration" (default "10s"). Returns a JSON with the bytes and Gbit/s of each stream and in
+    total, and the retransmits counted by the sending side from TCP_INFO, where available.
+- "/dns": Resolves the given "name" ("/dns?name=kubernetes.default&type=A"), of "type" "A"
+  (default) or "AAAA", like the resolver of the server would, and explains how. Returns a JSON
+  with the parsed "resolvConf" and "ndots", the addresses "/etc/hosts" has for the name in
+  "hosts", and the "candidates" built from the search list in the order they are tried, each with
+  the "rcode", "answers" and "rtt" of every nameserver. Every nameserver is asked for every
+  candidate, even though the resolver only asks the next nameserver when one fails or answers
+  neither NOERROR nor NXDOMAIN, and stops at the first candidate with addresses: "decidedBy" tells
+  which nameserver settled each candidate, and "matchedName" and "matchedSuffix" the candidate the
+  resolver stops at. The "rotate" option of resolv.conf is not followed. Queries time out after
+  the resolv.conf "timeout", unless a "timeout" is given.
 - "/echo": Returns the given "msg" ("/echo?msg=echoed_msg"), with the optional status "code".
 - "/exit": Closes the server with the given code and graceful shutdown. The endpoint's parameters
 	are:
@@ -93,17 +158,64 @@ var CmdNetexec = &cobra.Command{
 		shutdown.
 	- "wait": The amount of time to wait before starting shutdown. Acceptable values are
 	  golang durations. If 0 the process will start shutdown immediately.
+- "/fault": Manages fault rules applied to the responses of the other endpoints, the UDP,
+  TCP and SCTP servers. "GET" lists the active rules, "POST" adds the rule given as JSON
+  body and "DELETE" clears every rule, or only the one given by the "id" parameter. The first
+  matching rule that fires wins; affected HTTP responses carry the "X-Netexec-Fault" header, and
+  every affected response is logged and counted in "/metrics". The rule's fields are:
+  - "path", "clientCIDR", "headerName", "headerValue": The scope of the rule: a
+    path prefix, the client's CIDR and a header that must be present (with the given value, if
+    any). Rules scoped by path or header never match UDP, TCP or SCTP commands.
+  - "errorPercent", "errorCode": The percentage of HTTP requests answered with
+    "errorCode". Default code: "503".
+  - "latency": The latency added to the "percent" (default "100") of the matching
+    responses, following a "distribution": "fixed" (default) and "exponential" take a
+    "mean", "uniform" takes a "min" and a "max", and "normal" takes a
+    "mean" and a "stddev". Acceptable values are golang durations.
+  - "dropPercent": The percentage of UDP (and SCTP) replies that are not sent.
+  - "closePercent": The percentage of HTTP and SCTP connections closed without a response,
+    and of TCP commands answered by closing the connection.
+  - "ttl": How long the rule stays active. Acceptable values are golang durations. Default
+    value: "10m".
 - "/healthz": Returns "200 OK" if the server is ready, "412 Status Precondition Failed"
   otherwise. The server is considered not ready if the UDP server did not start yet or
-  it exited.
+  it exited. Returns "503 Service Unavailable" once the server is terminating. If limits are
+  configured, the body is a JSON with the current "requestsInFlight", "connections" and the
+  number of requests, commands and connections "limited" so far.
 - "/hostname": Returns the server's hostname.
 - "/hostName": Returns the server's hostname.
+- "/jobs": Runs dials in the background, for probes longer than the timeout of a "/dial"
+  call. "POST /jobs" starts the job given as JSON body and returns it with its "id"; "GET /jobs"
+  lists the running jobs and those finished less than "--job-retention" seconds ago (default
+  "3600"); "GET /jobs/<id>" returns the state of a job, the "attempts" and "successes" per
+  target, and its "results" after the "since" sequence number, or streams them as
+  newline-delimited JSON until the job finishes if "follow=true"; "DELETE /jobs/<id>" cancels
+  it. Each result has a "seq" number, the "time", "target", "response" or "error", and
+  "latency". The job's fields are:
+  - "targets": The "host:port" addresses to dial, resolved again for every dial.
+  - "protocol", "request": As for "/dial". Default: "http" and "hostname".
+  - "interval": How often every target is dialed. Default: "1s".
+  - "duration": How long the job runs, at most "168h".
+- "/metrics": Returns the server's metrics in the Prometheus text format.
 - "/redirect": Returns a redirect response to the given "location", with the optional status "code"
   ("/redirect?location=/echo%3Fmsg=foobar&code=307").
 - "/shell": Executes the given "shellCommand" or "cmd" ("/shell?cmd=some-command") and
   returns a JSON containing the fields "output" (command's output) and "error" (command's
   error message). Returns "200 OK" if the command succeeded, "417 Expectation Failed" if not.
 - "/shutdown": Closes the server with the exit code 0.
+- "/sink": Discards the request's body and returns a JSON with the number of "bytes" received,
+  the "seconds" it took and the resulting "gbps".
+- "/source": Streams zeros for the given "duration" (default "10s", at most "5m") or up to the
+  given number of "bytes", whichever comes first. The retransmits of the connection are sent in
+  the "X-Netexec-Retransmits" trailer.
+- "/sysinfo": Returns a JSON describing the network namespace of the server, read from netlink
+  and "/proc": its "interfaces" (addresses, MTU, state and counters), "routes" of every table,
+  policy routing "rules", "neighbors", listening "sockets", network "sysctls" and "resolvConf".
+  Sections that could not be read are listed in "errors".
+- "/timestamp": Returns a JSON with the times, in nanoseconds since the epoch, at which the server
+  received the request ("receive") and answered it ("transmit"), for clients to estimate the
+  offset of its clock. The UDP, SCTP and TCP servers answer the "timestamp" command with the same
+  two numbers, separated by a space.
 - "/upload": Accepts a file to be uploaded, writing it in the "/uploads" folder on the host.
   Returns a JSON with the fields "output" (containing the file's name on the server) and
   "error" containing any potential server side errors.
@@ -112,19 +224,130 @@ If "--tls-cert-file" is added (ideally in conjunction with "--tls-private-key-fi
 will be upgraded to HTTPS. The image has default, "localhost"-based cert/privkey files at
 "/localhost.crt" and "/localhost.key" (see: "porter" subcommand)
 
+Any request may carry a "misbehave" parameter, making the server misbehave at the connection level
+instead of answering normally (HTTP/1.x only):
+
+- "rst": Resets the connection with a RST.
+- "hang": Never responds, keeping the connection open until the client closes it.
+- "halfclose:<bytes>": Sends the first "<bytes>" bytes of the response, then half-closes the
+  connection with a FIN.
+- "partial:<bytes>": Sends the first "<bytes>" bytes of the response, then hangs.
+- "delay-accept:<duration>": Answers normally, but delays accepting the next connection by the
+  given golang duration. The kernel still completes the handshake of the delayed connection.
+
+If "--proxy-protocol" is set to "accept", the HTTP(S) and TCP servers accept an optional HAProxy
+PROXY protocol v1 or v2 header at the start of each connection and use the address it carries as
+the client's address. If set to "require", connections without such a header are closed.
+
+Every flag can also be set by a "--config" YAML or JSON file, and by a "NETEXEC_<FLAG>" environment
+variable ("NETEXEC_HTTP_PORT" for "--http-port", "NETEXEC_CONFIG" for "--config", ...). Environment
+variables override the file, and flags override both. The file groups the settings by listener,
+each listener also accepting an "address" to bind to, and "http" and "tcp" their own
+"proxyProtocol" mode. Invalid settings are all reported at startup. For example:
+
+  http:
+    port: 8080
+    proxyProtocol: require
+  tcp:
+    port: 8082
+  udp:
+    listenAddresses: 10.0.0.1,10.0.0.2
+
 If "--http-override" is set, the HTTP(S) server will always serve the override path & options,
 ignoring the request URL.
 
+The "http" section of the file can also list "virtualHosts", so that one server stands in for
+several routed applications. The "Host" header of a request, or the SNI of a TLS connection,
+selects the first virtual host whose "hostname" it equals, or else matches as a "*." wildcard.
+"/hostname" then answers the virtual host's "identity" (default: its "hostname"), the responses
+that would be "200 OK" get its "status" if set, and TLS connections get its certificate if
+it has one. Once virtual hosts are configured, every response carries the matched
+"X-Netexec-Virtual-Host", if any, the "X-Netexec-Identity" that answered and the "X-Netexec-SNI"
+of its TLS connection. For example:
+
+  http:
+    tlsCertFile: /certs/default.crt
+    tlsPrivateKeyFile: /certs/default.key
+    virtualHosts:
+    - hostname: app-a.example.com
+      identity: app-a
+      tlsCertFile: /certs/app-a.crt
+      tlsPrivateKeyFile: /certs/app-a.key
+    - hostname: "*.example.org"
+      status: 503
+
 It will also start a UDP server on the indicated UDP port and addresses that responds to the following commands:
 
 - "hostname": Returns the server's hostname
 - "echo <msg>": Returns the given <msg>
 - "clientip": Returns the request's IP address
+- "clientinfo": Returns the JSON of "/clientinfo" for the command's packet, or the TCP
+  connection
+- "timestamp": Returns the times, in nanoseconds since the epoch, at which the command was
+  received and answered, separated by a space
 
 The UDP server can be disabled by setting --udp-port to -1.
 
 Additionally, if (and only if) --sctp-port is passed, it will start an SCTP server on that port,
 responding to the same commands as the UDP server.
+
+Additionally, if (and only if) "--tcp-port" is passed, it will start a TCP server on that port,
+responding to the same commands as the UDP server, one per line. A command prefixed by
+"misbehave <mode> " (e.g. "misbehave partial:3 hostname") makes the TCP server misbehave like
+the HTTP server does for the "misbehave" parameter.
+
+Additionally, if (and only if) "--grpc-port" is passed, it will start a gRPC server on that port,
+exposing server reflection and the "netexec.Echo" service, whose methods all return the request's
+"message" along with the server's "hostname" and the client's "peer" address:
+
+- "Echo": Unary, returns the request's message.
+- "ServerStream": Streams "count" echoes of the request's message, "interval_ms" apart.
+- "ClientStream": Returns the messages of every request, space separated, once the client
+  closes its stream.
+- "BidiStream": Returns the message of every request as it arrives.
+
+When dialing it with "/dial" and "protocol=grpc", the "request" is sent to "Echo" and behaves
+like the UDP commands.
+
+Additionally, if (and only if) "--multicast-groups" is passed, it will join each of these IPv4 or
+IPv6 multicast groups on port "--multicast-port" (default "8084") and each of the
+"--multicast-interfaces" (the kernel chooses if empty), responding to the same commands as the UDP
+server with unicast replies.
+
+On SIGTERM, the server terminates gracefully: "/healthz" fails with "503 Service Unavailable" at
+once, every server keeps serving for "--delay-shutdown" seconds (default "0") while the removal of
+its endpoints propagates, then the HTTP and gRPC servers stop accepting connections and wait up
+to "--drain-timeout" seconds (default "30") for the in-flight requests to complete before netexec
+exits with "0". Each phase is logged along with the number of requests received since SIGTERM,
+per protocol, and how long after SIGTERM the last one arrived.
+
+To behave like a saturated service, the server can limit the HTTP requests and UDP commands per
+second ("--limit-rps", with bursts of up to "--limit-burst"), the HTTP requests served at once
+("--limit-concurrent-requests") and the HTTP, TCP and gRPC connections open at once
+("--limit-concurrent-connections"), globally or per client IP ("--limit-per-client"), the one of
+the PROXY protocol header if any. HTTP requests over the rate get a "429 Too Many Requests", those
+over the concurrency a "503 Service Unavailable", both with a "Retry-After" header; UDP commands
+over the rate are silently dropped; connections over the limit are closed once accepted, after a
+"503" for plain HTTP. "/healthz" and "/metrics" are exempt from the request limits. The refusals
+are counted by the "netexec_limited_total" metric, next to the "netexec_requests_in_flight" and
+"netexec_connections" gauges.
+
+The server continues the W3C trace context ("traceparent" and "baggage") of every HTTP and gRPC
+request it serves, but "/healthz" and "/metrics", and propagates it to the requests "/dial"
+performs. If "--otlp-endpoint" is set to an OTLP/HTTP collector (e.g.
+"http://otel-collector:4318"), a server span per request and a client span per "/dial" try are
+exported to its "/v1/traces" in batches, as "--otlp-service-name" (default "netexec").
+
+For test suites written against httpbin, the HTTP server also serves "/anything", "/status/<codes>",
+"/bytes/<n>", "/delay/<n>", "/headers", "/ip", "/cookies" (with "/cookies/set" and
+"/cookies/delete"), "/basic-auth/<user>/<passwd>", "/gzip" and "/response-headers" with the
+same answers as httpbin.org, under "--httpbin-prefix" (default "/httpbin", "/" for the root,
+disabled if empty). Their responses carry the hostname of the server in the "X-Netexec-Hostname"
+header.
+
+Tests can also run these servers in-process, several at once, with the "smartdocter/pkg/netexec"
+package: "NewServer" and "Start" a "Server" per configuration (port 0 picks a free port), then
+call its endpoints with the typed "Client".
 `,
 	Args: cobra.MaximumNArgs(0),
 	Run:  rootmain,
@@ -138,606 +361,28 @@ func main() {
 }
 
 func init() {
-	CmdNetexec.Flags().IntVar(&httpPort, "http-port", 8080, "HTTP Listen Port")
-	CmdNetexec.Flags().StringVar(&certFile, "tls-cert-file", "",
-		"File containing an x509 certificate for HTTPS. (CA cert, if any, concatenated after server cert)")
-	CmdNetexec.Flags().StringVar(&privKeyFile, "tls-private-key-file", "",
-		"File containing an x509 private key matching --tls-cert-file")
-	CmdNetexec.Flags().IntVar(&udpPort, "udp-port", 8081, "UDP Listen Port")
-	CmdNetexec.Flags().IntVar(&sctpPort, "sctp-port", -1, "SCTP Listen Port")
-	CmdNetexec.Flags().StringVar(&httpOverride, "http-override", "", "Override the HTTP handler to always respond as if it were a GET with this path & params")
-	CmdNetexec.Flags().StringVar(&udpListenAddresses, "udp-listen-addresses", "", "A comma separated list of ip addresses the udp servers listen from")
-	CmdNetexec.Flags().IntVar(&delayShutdown, "delay-shutdown", 0, "Number of seconds to delay shutdown when receiving SIGTERM.")
-}
-
-// atomicBool uses load/store operations on an int32 to simulate an atomic boolean.
-type atomicBool struct {
-	v int32
-}
-
-// set sets the int32 to the given boolean.
-func (a *atomicBool) set(value bool) {
-	if value {
-		atomic.StoreInt32(&a.v, 1)
-		return
-	}
-	atomic.StoreInt32(&a.v, 0)
-}
-
-// get returns true if the int32 == 1
-func (a *atomicBool) get() bool {
-	return atomic.LoadInt32(&a.v) == 1
+	CmdNetexec.Flags().StringVar(&configFile, "config", "", "YAML or JSON file setting any flag and per-listener settings. Environment variables (NETEXEC_HTTP_PORT for --http-port, ...) override it, flags override both")
+	config.AddFlags(CmdNetexec.Flags())
 }
 
 func rootmain(cmd *cobra.Command, args []string) {
-	exitCh := make(chan shutdownRequest)
-
-	if delayShutdown > 0 {
-		termCh := make(chan os.Signal, 1)
-		signal.Notify(termCh, syscall.SIGTERM)
-		go func() {
-			<-termCh
-			log.Printf("Sleeping %d seconds before terminating...", delayShutdown)
-			time.Sleep(time.Duration(delayShutdown) * time.Second)
-			os.Exit(0)
-		}()
-	}
-
-	if httpOverride != "" {
-		mux := http.NewServeMux()
-		addRoutes(mux, exitCh)
-
-		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			overrideReq, err := http.NewRequestWithContext(r.Context(), "GET", httpOverride, nil)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("override request failed: %v", err), http.StatusInternalServerError)
-				return
-			}
-			mux.ServeHTTP(w, overrideReq)
-		})
-	} else {
-		addRoutes(http.DefaultServeMux, exitCh)
-	}
-
-	// UDP server
-	if udpPort != -1 {
-		udpBindTo, err := parseAddresses(udpListenAddresses)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		for _, address := range udpBindTo {
-			go startUDPServer(address, udpPort)
-		}
-	}
-
-	// SCTP server
-	if sctpPort != -1 {
-		go startSCTPServer(sctpPort)
-	}
-
-	server := &http.Server{Addr: fmt.Sprintf(":%d", httpPort)}
-	if len(certFile) > 0 {
-		startServer(server, exitCh, func() error { return server.ListenAndServeTLS(certFile, privKeyFile) })
-	} else {
-		startServer(server, exitCh, server.ListenAndServe)
-	}
-}
-
-func addRoutes(mux *http.ServeMux, exitCh chan shutdownRequest) {
-	mux.HandleFunc("/", rootHandler)
-	mux.HandleFunc("/clientip", clientIPHandler)
-	mux.HandleFunc("/header", headerHandler)
-	mux.HandleFunc("/dial", dialHandler)
-	mux.HandleFunc("/echo", echoHandler)
-	mux.HandleFunc("/exit", func(w http.ResponseWriter, req *http.Request) { exitHandler(w, req, exitCh) })
-	mux.HandleFunc("/healthz", healthzHandler)
-	mux.HandleFunc("/hostname", hostnameHandler)
-	mux.HandleFunc("/redirect", redirectHandler)
-	mux.HandleFunc("/shell", shellHandler)
-	mux.HandleFunc("/upload", uploadHandler)
-	// older handlers
-	mux.HandleFunc("/hostName", hostNameHandler)
-	mux.HandleFunc("/shutdown", shutdownHandler)
-}
-
-func startServer(server *http.Server, exitCh chan shutdownRequest, fn func() error) {
-	log.Printf("Started HTTP server on port %d", httpPort)
-	go func() {
-		re := <-exitCh
-		ctx, cancelFn := context.WithTimeout(context.Background(), re.timeout)
-		defer cancelFn()
-		err := server.Shutdown(ctx)
-		log.Printf("Graceful shutdown completed with: %v", err)
-		os.Exit(re.code)
-	}()
-
-	if err := fn(); err != nil {
-		if err == http.ErrServerClosed {
-			// wait until the goroutine calls os.Exit()
-			select {}
-		}
+	if err := netexec.LoadConfig(cmd.Flags(), &config, configFile); err != nil {
 		log.Fatal(err)
 	}
-}
-
-func rootHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("GET /")
-	printRequest(r)
-	fmt.Fprintf(w, "NOW: %v", time.Now())
-}
-
-func echoHandler(w http.ResponseWriter, r *http.Request) {
-	printRequest(r)
-	msg := r.FormValue("msg")
-	codeString := r.FormValue("code")
-	log.Printf("GET /echo?msg=%s&code=%s", msg, codeString)
-	if codeString != "" {
-		code, err := strconv.Atoi(codeString)
-		if err != nil && codeString != "" {
-			fmt.Fprintf(w, "argument 'code' must be an integer or empty, got %q\n", codeString)
-			return
-		}
-		w.WriteHeader(code)
-	}
-	fmt.Fprintf(w, "%s", msg)
-}
-
-func clientIPHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("GET /clientip")
-	printRequest(r)
-	fmt.Fprintf(w, r.RemoteAddr)
-}
-func headerHandler(w http.ResponseWriter, r *http.Request) {
-	printRequest(r)
-	key := r.FormValue("key")
-	if key != "" {
-		log.Printf("GET /header?key=%s", key)
-		fmt.Fprintf(w, "%s", r.Header.Get(key))
-	} else {
-		log.Printf("GET /header")
-		data, err := json.Marshal(r.Header)
-		if err != nil {
-			fmt.Fprintf(w, "error marshalling header, err: %v", err)
-			return
-		}
-		fmt.Fprintf(w, "%s", string(data))
-	}
-}
-
-func printRequest(r *http.Request) {
-	fmt.Printf("request(%s): %+v \n", r.RemoteAddr, r)
-}
-
-type shutdownRequest struct {
-	code    int
-	timeout time.Duration
-}
-
-func exitHandler(w http.ResponseWriter, r *http.Request, exitCh chan<- shutdownRequest) {
-	waitString := r.FormValue("wait")
-	timeoutString := r.FormValue("timeout")
-	codeString := r.FormValue("code")
-	log.Printf("GET /exit?code=%s&timeout=%s&wait=%s", codeString, timeoutString, waitString)
-	timeout, err := time.ParseDuration(timeoutString)
-	if err != nil && timeoutString != "" {
-		fmt.Fprintf(w, "argument 'timeout' must be a valid golang duration or empty, got %q\n", timeoutString)
-		return
-	}
-	wait, err := time.ParseDuration(waitString)
-	if err != nil && waitString != "" {
-		fmt.Fprintf(w, "argument 'wait' must be a valid golang duration or empty, got %q\n", waitString)
-		return
-	}
-	code, err := strconv.Atoi(codeString)
-	if err != nil && codeString != "" {
-		fmt.Fprintf(w, "argument 'code' must be an integer [0-127] or empty, got %q\n", codeString)
-		return
-	}
-	log.Printf("Will begin shutdown in %s, allowing %s for connections to close, then will exit with %d", wait, timeout, code)
-	time.Sleep(wait)
-	if timeout == 0 {
-		os.Exit(code)
-	}
-	exitCh <- shutdownRequest{code: code, timeout: timeout}
-}
-
-func hostnameHandler(w http.ResponseWriter, r *http.Request) {
-	printRequest(r)
-	log.Printf("GET /hostname")
-	fmt.Fprint(w, getHostName())
-}
-
-// healthHandler response with a 200 if the UDP server is ready. It also serves
-// as a health check of the HTTP server by virtue of being a HTTP handler.
-func healthzHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("GET /healthz")
-	if serverReady.get() {
-		w.WriteHeader(200)
-		return
-	}
-	w.WriteHeader(http.StatusPreconditionFailed)
-}
-
-func shutdownHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("GET /shutdown")
-	os.Exit(0)
-}
-
-func dialHandler(w http.ResponseWriter, r *http.Request) {
-	printRequest(r)
-	values, err := url.Parse(r.URL.RequestURI())
-	if err != nil {
-		http.Error(w, fmt.Sprintf("%v", err), http.StatusBadRequest)
-		return
-	}
-
-	host := values.Query().Get("host")
-	port := values.Query().Get("port")
-	request := values.Query().Get("request") // hostName
-	protocol := values.Query().Get("protocol")
-	tryParam := values.Query().Get("tries")
-	log.Printf("GET /dial?host=%s&protocol=%s&port=%s&request=%s&tries=%s", host, protocol, port, request, tryParam)
-	tries := 1
-	if len(tryParam) > 0 {
-		tries, err = strconv.Atoi(tryParam)
-	}
+	server, err := netexec.NewServer(config)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("tries parameter is invalid. %v", err), http.StatusBadRequest)
-		return
-	}
-	if len(request) == 0 {
-		http.Error(w, fmt.Sprintf("request parameter not specified. %v", err), http.StatusBadRequest)
-		return
-	}
-
-	hostPort := net.JoinHostPort(host, port)
-	var addr net.Addr
-	var dialer func(string, net.Addr) (string, error)
-	switch strings.ToLower(protocol) {
-	case "", "http":
-		dialer = dialHTTP
-		addr, err = net.ResolveTCPAddr("tcp", hostPort)
-	case "udp":
-		dialer = dialUDP
-		addr, err = net.ResolveUDPAddr("udp", hostPort)
-	case "sctp":
-		dialer = dialSCTP
-		addr, err = sctp.ResolveSCTPAddr("sctp", hostPort)
-	default:
-		http.Error(w, fmt.Sprintf("unsupported protocol. %s", protocol), http.StatusBadRequest)
-		return
-	}
-	if err != nil {
-		http.Error(w, fmt.Sprintf("host and/or port param are invalid. %v", err), http.StatusBadRequest)
-		return
-	}
-
-	errors := make([]string, 0)
-	responses := make([]string, 0)
-	var response string
-	for i := 0; i < tries; i++ {
-		response, err = dialer(request, addr)
-		if err != nil {
-			errors = append(errors, fmt.Sprintf("%v", err))
-		} else {
-			responses = append(responses, response)
-		}
-	}
-	output := map[string][]string{}
-	if len(response) > 0 {
-		output["responses"] = responses
-	}
-	if len(errors) > 0 {
-		output["errors"] = errors
-	}
-	bytes, err := json.Marshal(output)
-	if err == nil {
-		fmt.Fprint(w, string(bytes))
-	} else {
-		http.Error(w, fmt.Sprintf("response could not be serialized. %v", err), http.StatusExpectationFailed)
-	}
-}
-
-func dialHTTP(request string, addr net.Addr) (string, error) {
-	transport := utilnet.SetTransportDefaults(&http.Transport{})
-	httpClient := createHTTPClient(transport)
-	resp, err := httpClient.Get(fmt.Sprintf("http://%s/%s", addr.String(), request))
-	defer transport.CloseIdleConnections()
-	if err == nil {
-		defer resp.Body.Close()
-		body, err := ioutil.ReadAll(resp.Body)
-		if err == nil {
-			return string(body), nil
-		}
-	}
-	return "", err
-}
-
-func createHTTPClient(transport *http.Transport) *http.Client {
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   5 * time.Second,
-	}
-	return client
-}
-
-func dialUDP(request string, addr net.Addr) (string, error) {
-	Conn, err := net.DialUDP("udp", nil, addr.(*net.UDPAddr))
-	if err != nil {
-		return "", fmt.Errorf("udp dial failed. err:%v", err)
-	}
-
-	defer Conn.Close()
-	buf := []byte(request)
-	_, err = Conn.Write(buf)
-	if err != nil {
-		return "", fmt.Errorf("udp connection write failed. err:%v", err)
-	}
-	udpResponse := make([]byte, 2048)
-	e := Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	if e != nil {
-		return "", fmt.Errorf("SetReadDeadline failed. err:'%v'", e)
-	}
-	count, err := Conn.Read(udpResponse)
-	if err != nil || count == 0 {
-		return "", fmt.Errorf("reading from udp connection failed. err:'%v'", err)
-	}
-	return string(udpResponse[0:count]), nil
-}
-
-func dialSCTP(request string, addr net.Addr) (string, error) {
-	Conn, err := sctp.DialSCTP("sctp", nil, addr.(*sctp.SCTPAddr))
-	if err != nil {
-		return "", fmt.Errorf("sctp dial failed. err:%v", err)
-	}
-
-	defer Conn.Close()
-	buf := []byte(request)
-	_, err = Conn.Write(buf)
-	if err != nil {
-		return "", fmt.Errorf("sctp connection write failed. err:%v", err)
-	}
-	sctpResponse := make([]byte, 1024)
-	e := Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	if e != nil {
-		return "", fmt.Errorf("SetReadDeadline failed. err:'%v'", e)
-	}
-	count, err := Conn.Read(sctpResponse)
-	if err != nil || count == 0 {
-		return "", fmt.Errorf("reading from sctp connection failed. err:'%v'", err)
-	}
-	return string(sctpResponse[0:count]), nil
-}
-
-func shellHandler(w http.ResponseWriter, r *http.Request) {
-	printRequest(r)
-	cmd := r.FormValue("shellCommand")
-	if cmd == "" {
-		cmd = r.FormValue("cmd")
-	}
-	log.Printf("GET /shell?cmd=%s", cmd)
-	cmdOut, err := exec.Command(shellPath, "-c", cmd).CombinedOutput()
-	output := map[string]string{}
-	if len(cmdOut) > 0 {
-		output["output"] = string(cmdOut)
-	}
-	if err != nil {
-		output["error"] = fmt.Sprintf("%v", err)
-	}
-	log.Printf("Output: %s", output)
-	bytes, err := json.Marshal(output)
-	if err == nil {
-		fmt.Fprint(w, string(bytes))
-	} else {
-		http.Error(w, fmt.Sprintf("response could not be serialized. %v", err), http.StatusExpectationFailed)
-	}
-}
-
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("GET /upload")
-	result := map[string]string{}
-	file, _, err := r.FormFile("file")
-	if err != nil {
-		result["error"] = "Unable to upload file."
-		bytes, err := json.Marshal(result)
-		if err == nil {
-			fmt.Fprint(w, string(bytes))
-		} else {
-			http.Error(w, fmt.Sprintf("%s. Also unable to serialize output. %v", result["error"], err), http.StatusInternalServerError)
-		}
-		log.Printf("Unable to upload file: %s", err)
-		return
-	}
-	defer file.Close()
-
-	f, err := ioutil.TempFile("/uploads", "upload")
-	if err != nil {
-		result["error"] = "Unable to open file for write"
-		bytes, err := json.Marshal(result)
-		if err == nil {
-			fmt.Fprint(w, string(bytes))
-		} else {
-			http.Error(w, fmt.Sprintf("%s. Also unable to serialize output. %v", result["error"], err), http.StatusInternalServerError)
-		}
-		log.Printf("Unable to open file for write: %s", err)
-		return
-	}
-	defer f.Close()
-	if _, err = io.Copy(f, file); err != nil {
-		result["error"] = "Unable to write file."
-		bytes, err := json.Marshal(result)
-		if err == nil {
-			fmt.Fprint(w, string(bytes))
-		} else {
-			http.Error(w, fmt.Sprintf("%s. Also unable to serialize output. %v", result["error"], err), http.StatusInternalServerError)
-		}
-		log.Printf("Unable to write file: %s", err)
-		return
-	}
-
-	UploadFile := f.Name()
-	if err := os.Chmod(UploadFile, 0700); err != nil {
-		result["error"] = "Unable to chmod file."
-		bytes, err := json.Marshal(result)
-		if err == nil {
-			fmt.Fprint(w, string(bytes))
-		} else {
-			http.Error(w, fmt.Sprintf("%s. Also unable to serialize output. %v", result["error"], err), http.StatusInternalServerError)
-		}
-		log.Printf("Unable to chmod file: %s", err)
-		return
-	}
-	log.Printf("Wrote upload to %s", UploadFile)
-	result["output"] = UploadFile
-	w.WriteHeader(http.StatusCreated)
-	bytes, err := json.Marshal(result)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("%s. Also unable to serialize output. %v", result["error"], err), http.StatusInternalServerError)
-		return
-	}
-	fmt.Fprint(w, string(bytes))
-}
-
-func hostNameHandler(w http.ResponseWriter, r *http.Request) {
-	printRequest(r)
-	log.Printf("GET /hostName")
-	fmt.Fprint(w, getHostName())
-}
-
-func redirectHandler(w http.ResponseWriter, r *http.Request) {
-	printRequest(r)
-	location := r.FormValue("location")
-	codeString := r.FormValue("code")
-	log.Printf("%s /redirect?msg=%s&code=%s", r.Method, location, codeString)
-	code := http.StatusFound
-	if codeString != "" {
-		var err error
-		code, err = strconv.Atoi(codeString)
-		if err != nil && codeString != "" {
-			fmt.Fprintf(w, "argument 'code' must be an integer or empty, got %q\n", codeString)
-			return
-		}
-	}
-	http.Redirect(w, r, location, code)
-}
-
-// udp server supports the hostName, echo and clientIP commands.
-func startUDPServer(address string, udpPort int) {
-	serverAddress, err := net.ResolveUDPAddr("udp", net.JoinHostPort(address, strconv.Itoa(udpPort)))
-	assertNoError(err, fmt.Sprintf("failed to resolve UDP address for port %d", sctpPort))
-	serverConn, err := net.ListenUDP("udp", serverAddress)
-	assertNoError(err, fmt.Sprintf("failed to create listener for UDP address %v", serverAddress))
-	defer serverConn.Close()
-	buf := make([]byte, 2048)
-
-	log.Printf("Started UDP server on port %s %d", address, udpPort)
-	// Start responding to readiness probes.
-	serverReady.set(true)
-	defer func() {
-		log.Printf("UDP server exited")
-		serverReady.set(false)
-	}()
-	for {
-		n, clientAddress, err := serverConn.ReadFromUDP(buf)
-		assertNoError(err, "failed accepting UDP connections")
-		receivedText := strings.ToLower(strings.TrimSpace(string(buf[0:n])))
-		if receivedText == "hostname" {
-			log.Println("Sending udp hostName response")
-			_, err = serverConn.WriteToUDP([]byte(getHostName()), clientAddress)
-			assertNoError(err, fmt.Sprintf("failed to write hostname to UDP client %s", clientAddress))
-		} else if strings.HasPrefix(receivedText, "echo ") {
-			parts := strings.SplitN(receivedText, " ", 2)
-			resp := ""
-			if len(parts) == 2 {
-				resp = parts[1]
-			}
-			log.Printf("Echoing %v to UDP client %s\n", resp, clientAddress)
-			_, err = serverConn.WriteToUDP([]byte(resp), clientAddress)
-			assertNoError(err, fmt.Sprintf("failed to echo to UDP client %s", clientAddress))
-		} else if receivedText == "clientip" {
-			log.Printf("Sending clientip back to UDP client %s\n", clientAddress)
-			_, err = serverConn.WriteToUDP([]byte(clientAddress.String()), clientAddress)
-			assertNoError(err, fmt.Sprintf("failed to write clientip to UDP client %s", clientAddress))
-		} else if len(receivedText) > 0 {
-			log.Printf("Unknown UDP command received from %s: %v\n", clientAddress, receivedText)
-		}
+		log.Fatal(err)
 	}
-}
 
-// sctp server supports the hostName, echo and clientIP commands.
-func startSCTPServer(sctpPort int) {
-	serverAddress, err := sctp.ResolveSCTPAddr("sctp", fmt.Sprintf(":%d", sctpPort))
-	assertNoError(err, fmt.Sprintf("failed to resolve SCTP address for port %d", sctpPort))
-	listener, err := sctp.ListenSCTP("sctp", serverAddress)
-	assertNoError(err, fmt.Sprintf("failed to create listener for SCTP address %v", serverAddress))
-	defer listener.Close()
-	buf := make([]byte, 1024)
-
-	log.Printf("Started SCTP server")
-	// Start responding to readiness probes.
-	serverReady.set(true)
-	defer func() {
-		log.Printf("SCTP server exited")
-		serverReady.set(false)
+	termCh := make(chan os.Signal, 1)
+	signal.Notify(termCh, syscall.SIGTERM)
+	go func() {
+		<-termCh
+		server.Terminate()
 	}()
-	for {
-		conn, err := listener.AcceptSCTP()
-		assertNoError(err, "failed accepting SCTP connections")
-		clientAddress := conn.RemoteAddr().String()
-		n, err := conn.Read(buf)
-		assertNoError(err, fmt.Sprintf("failed to read from SCTP client %s", clientAddress))
-		receivedText := strings.ToLower(strings.TrimSpace(string(buf[0:n])))
-		if receivedText == "hostname" {
-			log.Println("Sending SCTP hostName response")
-			_, err = conn.Write([]byte(getHostName()))
-			assertNoError(err, fmt.Sprintf("failed to write hostname to SCTP client %s", clientAddress))
-		} else if strings.HasPrefix(receivedText, "echo ") {
-			parts := strings.SplitN(receivedText, " ", 2)
-			resp := ""
-			if len(parts) == 2 {
-				resp = parts[1]
-			}
-			log.Printf("Echoing %v to SCTP client %s\n", resp, clientAddress)
-			_, err = conn.Write([]byte(resp))
-			assertNoError(err, fmt.Sprintf("failed to echo to SCTP client %s", clientAddress))
-		} else if receivedText == "clientip" {
-			log.Printf("Sending clientip back to SCTP client %s\n", clientAddress)
-			_, err = conn.Write([]byte(clientAddress))
-			assertNoError(err, fmt.Sprintf("failed to write clientip to SCTP client %s", clientAddress))
-		} else if len(receivedText) > 0 {
-			log.Printf("Unknown SCTP command received from %s: %v\n", clientAddress, receivedText)
-		}
-		conn.Close()
-	}
-}
 
-func getHostName() string {
-	hostName, err := os.Hostname()
-	assertNoError(err, "failed to get hostname")
-	return hostName
-}
-
-func assertNoError(err error, detail string) {
-	if err != nil {
-		log.Fatalf("Error occurred: %s:%v", detail, err)
-	}
-}
-
-func parseAddresses(addresses string) ([]string, error) {
-	if addresses == "" {
-		return []string{bindToAny}, nil
-	}
-	// Using a set to remove duplicates
-	res := make([]string, 0)
-	split := strings.Split(addresses, ",")
-	for _, address := range split {
-		netAddr := netutils.ParseIPSloppy(address)
-		if netAddr == nil {
-			return nil, fmt.Errorf("parseAddress: invalid address %s", address)
-		}
-		res = append(res, address)
+	if err := server.Start(context.Background()); err != nil {
+		log.Fatal(err)
 	}
-	set := sets.NewString(res...)
-	return set.List(), nil
+	os.Exit(<-server.Exited())
 }